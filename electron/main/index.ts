@@ -3,6 +3,7 @@ import { join } from "path";
 import { electronApp, optimizer, is } from "@electron-toolkit/utils";
 
 import icon from "../../public/icon.png?asset";
+import { registerUdpHandlers } from "./udp";
 
 const USB_DEVICE_FILTER = [
   { vendorId: 0x0483, productId: 0xdf11 },
@@ -65,6 +66,25 @@ function createWindow(): void {
     }
   );
 
+  // fires repeatedly while scanning, only ask once per request
+  let bluetoothCallback: ((id: string) => void) | undefined;
+  mainWindow.webContents.on(
+    "select-bluetooth-device",
+    (event, deviceList, callback) => {
+      event.preventDefault();
+      if (bluetoothCallback) {
+        bluetoothCallback = callback;
+        return;
+      }
+      bluetoothCallback = callback;
+      mainWindow.webContents.send("select-bluetooth-device", deviceList);
+      ipcMain.once("bluetooth-device", (_event, id) => {
+        bluetoothCallback?.(id ? id : "");
+        bluetoothCallback = undefined;
+      });
+    }
+  );
+
   mainWindow.webContents.session.setPermissionCheckHandler(
     (webContents, permission, requestingOrigin, details) => {
       if (permission === "serial" || permission === "usb") {
@@ -83,6 +103,8 @@ function createWindow(): void {
     return false;
   });
 
+  registerUdpHandlers(mainWindow.webContents);
+
   // HMR for renderer base on electron-vite cli.
   // Load the remote URL for development or the local html file for production.
   if (is.dev && process.env["ELECTRON_RENDERER_URL"]) {
@@ -0,0 +1,39 @@
+import { ipcMain, type WebContents } from "electron";
+import { createSocket, type Socket } from "dgram";
+
+// the renderer has no access to udp sockets, relay datagrams over ipc
+export function registerUdpHandlers(webContents: WebContents) {
+  let socket: Socket | undefined;
+
+  ipcMain.removeHandler("udp-open");
+  ipcMain.removeAllListeners("udp-send");
+  ipcMain.removeAllListeners("udp-close");
+
+  const close = () => {
+    socket?.close();
+    socket = undefined;
+  };
+
+  ipcMain.handle("udp-open", (_event, host: string, port: number) => {
+    close();
+
+    return new Promise<void>((resolve, reject) => {
+      const s = createSocket("udp4");
+      s.once("error", reject);
+      s.on("message", (msg) => webContents.send("udp-data", msg));
+      s.on("close", () => webContents.send("udp-close"));
+      s.connect(port, host, () => {
+        s.off("error", reject);
+        s.on("error", (err) => webContents.send("udp-error", err.message));
+        socket = s;
+        resolve();
+      });
+    });
+  });
+
+  ipcMain.on("udp-send", (_event, data: Uint8Array) => {
+    socket?.send(data);
+  });
+
+  ipcMain.on("udp-close", () => close());
+}
@@ -10,6 +10,8 @@ import {
   faDownload,
   faFileExport,
   faSpinner,
+  faLock,
+  faLockOpen,
 } from "@fortawesome/free-solid-svg-icons";
 
 import { faPenToSquare } from "@fortawesome/free-regular-svg-icons";
@@ -23,7 +25,9 @@ library.add(
   faDownload,
   faPenToSquare,
   faFileExport,
-  faSpinner
+  faSpinner,
+  faLock,
+  faLockOpen
 );
 
 export default FontAwesomeIcon;
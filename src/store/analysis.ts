@@ -0,0 +1,128 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import {
+  BlackboxFields,
+  useBlackboxStore,
+  type BlackboxFieldDef,
+} from "./blackbox";
+import { BlackboxField } from "./constants";
+import {
+  averageSpectrum,
+  fieldSeries,
+  frameSampleRate,
+  RollingSpectrum,
+  spectrogram,
+  type Spectrogram,
+  type Spectrum,
+} from "./analysis/spectrum";
+import { stepResponse, type StepResponse } from "./analysis/stepresponse";
+import { decodeFrame, parseBlackboxFile } from "./util/recorder";
+
+export const ANALYSIS_FIELDS = [
+  BlackboxField.GYRO_RAW,
+  BlackboxField.GYRO_FILTER,
+  BlackboxField.PID_D_TERM,
+];
+
+// the live spectrum is copied into the store at this interval
+const LIVE_UPDATE_INTERVAL = 500;
+
+let unsubscribe: (() => void) | undefined;
+let liveTimer: any;
+
+export const useAnalysisStore = defineStore("analysis", {
+  state: () => ({
+    field: BlackboxField.GYRO_RAW,
+    live: false,
+    source: "",
+    spectrum: null as Spectrum | null,
+    spectrogram: null as Spectrogram | null,
+    step: null as StepResponse | null,
+    step_source: "",
+  }),
+  getters: {
+    def(state): BlackboxFieldDef {
+      return BlackboxFields[state.field];
+    },
+  },
+  actions: {
+    async analyze_file(file: File) {
+      this.stop_live();
+
+      const { header, frames } = parseBlackboxFile(await file.text());
+      if (!header.fields.some((f) => f.name == this.def.name)) {
+        throw new Error(`${file.name} has no ${this.def.title} data`);
+      }
+      const decoded = frames.map((v) => decodeFrame(header.fields, v));
+      const sample_rate = frameSampleRate(decoded) || header.sample_rate_hz;
+
+      this.spectrogram = spectrogram(
+        fieldSeries(decoded, this.def),
+        sample_rate
+      );
+      this.spectrum = averageSpectrum(this.spectrogram);
+      this.source = file.name;
+    },
+    async analyze_step_response(file: File) {
+      const { header, frames } = parseBlackboxFile(await file.text());
+      const names = header.fields.map((f) => f.name);
+      if (!names.includes("setpoint") || !names.includes("gyro_filter")) {
+        throw new Error(`${file.name} needs setpoint and gyro filter data`);
+      }
+      const decoded = frames.map((v) => decodeFrame(header.fields, v));
+      const sample_rate = frameSampleRate(decoded) || header.sample_rate_hz;
+
+      const step = stepResponse(decoded, sample_rate);
+      if (!step.axes.some((a) => a.segments)) {
+        throw new Error("not enough stick input to measure a response");
+      }
+      this.step = step;
+      this.step_source = file.name;
+    },
+    // the stream has to run at full rate, a thinned out live view would
+    // fold the noise down onto lower frequencies
+    start_live() {
+      this.stop_live();
+
+      const def = this.def;
+      const blackbox = useBlackboxStore();
+      const first: number[] = [];
+      let rolling: RollingSpectrum | undefined;
+
+      unsubscribe = blackbox.subscribe_frames((f) => {
+        const val = f[def.name];
+        if (val === undefined) {
+          return;
+        }
+        if (!rolling) {
+          // the rate is measured over the first frames
+          first.push(f.time);
+          if (first.length < 64) {
+            return;
+          }
+          const span = first[first.length - 1] - first[0];
+          const rate = ((first.length - 1) * 1e6) / span;
+          rolling = new RollingSpectrum(rate);
+          Log.info("analysis", "live spectrum at", rate);
+        }
+        const values = Array.isArray(val) ? val : [val];
+        rolling.push(values.map((v) => v / def.scale));
+      });
+      liveTimer = setInterval(() => {
+        if (rolling) {
+          this.spectrogram = rolling.spectrogram();
+          this.spectrum = averageSpectrum(this.spectrogram);
+        }
+      }, LIVE_UPDATE_INTERVAL);
+
+      this.live = true;
+      this.source = "live";
+    },
+    stop_live() {
+      unsubscribe?.();
+      unsubscribe = undefined;
+      clearInterval(liveTimer);
+      this.live = false;
+    },
+  },
+});
@@ -0,0 +1,97 @@
+export function isPowerOfTwo(n: number) {
+  return n > 0 && (n & (n - 1)) == 0;
+}
+
+export function hannWindow(n: number) {
+  const window = new Float64Array(n);
+  for (let i = 0; i < n; i++) {
+    window[i] = 0.5 - 0.5 * Math.cos((2 * Math.PI * i) / (n - 1));
+  }
+  return window;
+}
+
+// iterative radix 2, in place. both arrays hold n = 2^k values
+export function fft(re: Float64Array, im: Float64Array) {
+  const n = re.length;
+  if (!isPowerOfTwo(n) || im.length != n) {
+    throw new Error("fft size must be a power of two, got " + n);
+  }
+
+  for (let i = 1, j = 0; i < n; i++) {
+    let bit = n >> 1;
+    for (; j & bit; bit >>= 1) {
+      j ^= bit;
+    }
+    j ^= bit;
+    if (i < j) {
+      [re[i], re[j]] = [re[j], re[i]];
+      [im[i], im[j]] = [im[j], im[i]];
+    }
+  }
+
+  for (let len = 2; len <= n; len <<= 1) {
+    const angle = (-2 * Math.PI) / len;
+    const wr = Math.cos(angle);
+    const wi = Math.sin(angle);
+    for (let i = 0; i < n; i += len) {
+      let cr = 1;
+      let ci = 0;
+      for (let k = 0; k < len / 2; k++) {
+        const a = i + k;
+        const b = a + len / 2;
+        const tr = re[b] * cr - im[b] * ci;
+        const ti = re[b] * ci + im[b] * cr;
+        re[b] = re[a] - tr;
+        im[b] = im[a] - ti;
+        re[a] += tr;
+        im[a] += ti;
+        [cr, ci] = [cr * wr - ci * wi, cr * wi + ci * wr];
+      }
+    }
+  }
+}
+
+// one sided power of a real signal, n / 2 bins from dc up. the mean is
+// removed first, a gyro offset would otherwise swamp the low bins
+export function powerSpectrum(
+  samples: ArrayLike<number>,
+  window = hannWindow(samples.length)
+) {
+  const n = samples.length;
+  let mean = 0;
+  for (let i = 0; i < n; i++) {
+    mean += samples[i] / n;
+  }
+
+  const re = new Float64Array(n);
+  const im = new Float64Array(n);
+  let gain = 0;
+  for (let i = 0; i < n; i++) {
+    re[i] = (samples[i] - mean) * window[i];
+    gain += window[i] * window[i];
+  }
+  fft(re, im);
+
+  const power = new Float64Array(n / 2);
+  for (let k = 0; k < n / 2; k++) {
+    power[k] = (re[k] * re[k] + im[k] * im[k]) / gain;
+  }
+  return power;
+}
+
+export function binFrequencies(size: number, sample_rate: number) {
+  return Array.from({ length: size / 2 }, (_, k) => (k * sample_rate) / size);
+}
+
+// through the forward transform, conjugating in and out
+export function ifft(re: Float64Array, im: Float64Array) {
+  const n = re.length;
+  for (let i = 0; i < n; i++) {
+    im[i] = -im[i];
+  }
+  fft(re, im);
+  for (let i = 0; i < n; i++) {
+    re[i] /= n;
+    im[i] = -im[i] / n;
+  }
+}
@@ -0,0 +1,186 @@
+import type { BlackboxFieldDef, BlackboxFrame } from "../blackbox";
+import {
+  binFrequencies,
+  hannWindow,
+  isPowerOfTwo,
+  powerSpectrum,
+} from "./fft";
+
+export interface SpectrumOptions {
+  // samples per fft, a power of two
+  size: number;
+  // fraction of a window shared with the next one
+  overlap: number;
+}
+
+export const DEFAULT_SPECTRUM_OPTIONS: SpectrumOptions = {
+  size: 256,
+  overlap: 0.5,
+};
+
+export interface Spectrum {
+  sample_rate: number;
+  freqs: number[];
+  // per axis, one value per frequency bin
+  power: number[][];
+}
+
+export interface Spectrogram {
+  sample_rate: number;
+  freqs: number[];
+  // seconds from the first sample to the middle of each window
+  times: number[];
+  // per axis, one spectrum per window
+  power: number[][][];
+}
+
+// frame time is in us, the rate is taken from the frames themselves as
+// the stream may be thinned out or have gaps
+export function frameSampleRate(frames: BlackboxFrame[]) {
+  if (frames.length < 2) {
+    return 0;
+  }
+  const span = frames[frames.length - 1].time - frames[0].time;
+  return span > 0 ? ((frames.length - 1) * 1e6) / span : 0;
+}
+
+// scaled to the unit of the field, one series per axis
+export function fieldSeries(frames: BlackboxFrame[], def: BlackboxFieldDef) {
+  const axes = def.axis ? def.axis.length : 1;
+  return Array.from({ length: axes }, (_, axis) =>
+    frames.map((f) => {
+      const val = f[def.name];
+      return (Array.isArray(val) ? val[axis] : val) / def.scale;
+    })
+  );
+}
+
+function hopSize(opts: SpectrumOptions) {
+  return Math.max(1, Math.round(opts.size * (1 - opts.overlap)));
+}
+
+function checkOptions(opts: SpectrumOptions) {
+  if (!isPowerOfTwo(opts.size)) {
+    throw new Error("spectrum size must be a power of two");
+  }
+}
+
+export function spectrogram(
+  series: number[][],
+  sample_rate: number,
+  opts = DEFAULT_SPECTRUM_OPTIONS
+): Spectrogram {
+  checkOptions(opts);
+  const window = hannWindow(opts.size);
+  const hop = hopSize(opts);
+  const length = series.length ? series[0].length : 0;
+
+  const times: number[] = [];
+  for (let start = 0; start + opts.size <= length; start += hop) {
+    times.push((start + opts.size / 2) / sample_rate);
+  }
+
+  return {
+    sample_rate,
+    freqs: binFrequencies(opts.size, sample_rate),
+    times,
+    power: series.map((values) =>
+      times.map((_, i) =>
+        Array.from(
+          powerSpectrum(values.slice(i * hop, i * hop + opts.size), window)
+        )
+      )
+    ),
+  };
+}
+
+// welch's method, the windows of the spectrogram averaged
+export function averageSpectrum(s: Spectrogram): Spectrum {
+  return {
+    sample_rate: s.sample_rate,
+    freqs: s.freqs,
+    power: s.power.map((rows) =>
+      s.freqs.map((_, k) =>
+        rows.length ? rows.reduce((sum, r) => sum + r[k], 0) / rows.length : 0
+      )
+    ),
+  };
+}
+
+export function spectrum(
+  series: number[][],
+  sample_rate: number,
+  opts = DEFAULT_SPECTRUM_OPTIONS
+): Spectrum {
+  return averageSpectrum(spectrogram(series, sample_rate, opts));
+}
+
+export function toDecibel(power: number) {
+  return 10 * Math.log10(Math.max(power, 1e-12));
+}
+
+// live counterpart of spectrogram, a new window is taken every hop and
+// only the latest rows are kept
+export class RollingSpectrum {
+  private buffers: number[][] = [];
+  private pending = 0;
+  private window: Float64Array;
+  private rows: number[][][] = [];
+  private times: number[] = [];
+  private samples = 0;
+
+  constructor(
+    private sample_rate: number,
+    private opts = DEFAULT_SPECTRUM_OPTIONS,
+    private history = 64
+  ) {
+    checkOptions(opts);
+    this.window = hannWindow(opts.size);
+  }
+
+  // one value per axis, returns true when a new window was added
+  push(values: number[]) {
+    values.forEach((v, axis) => {
+      const buf = this.buffers[axis] || (this.buffers[axis] = []);
+      buf.push(v);
+      if (buf.length > this.opts.size) {
+        buf.shift();
+      }
+    });
+    this.samples++;
+
+    if (this.buffers[0].length < this.opts.size) {
+      return false;
+    }
+    if (++this.pending < hopSize(this.opts) && this.rows.length) {
+      return false;
+    }
+    this.pending = 0;
+
+    this.buffers.forEach((buf, axis) => {
+      const rows = this.rows[axis] || (this.rows[axis] = []);
+      rows.push(Array.from(powerSpectrum(buf, this.window)));
+      if (rows.length > this.history) {
+        rows.shift();
+      }
+    });
+    this.times.push((this.samples - this.opts.size / 2) / this.sample_rate);
+    if (this.times.length > this.history) {
+      this.times.shift();
+    }
+    return true;
+  }
+
+  spectrogram(): Spectrogram {
+    return {
+      sample_rate: this.sample_rate,
+      freqs: binFrequencies(this.opts.size, this.sample_rate),
+      times: [...this.times],
+      power: this.rows.map((rows) => rows.map((r) => [...r])),
+    };
+  }
+
+  spectrum(): Spectrum {
+    return averageSpectrum(this.spectrogram());
+  }
+}
@@ -0,0 +1,176 @@
+import type { BlackboxFrame } from "../blackbox";
+import { fft, hannWindow, ifft } from "./fft";
+
+export interface StepResponseOptions {
+  // seconds per deconvolved segment, rounded up to a power of two samples
+  segment: number;
+  // seconds of response kept
+  length: number;
+  // segments with less stick input than this in rad/s are skipped, there
+  // is nothing to respond to
+  min_input: number;
+}
+
+export const DEFAULT_STEP_OPTIONS: StepResponseOptions = {
+  segment: 2,
+  length: 0.5,
+  min_input: 0.35,
+};
+
+export interface StepResponseAxis {
+  // ms after the step
+  time: number[];
+  // 1 is the setpoint
+  response: number[];
+  segments: number;
+  // all in ms, undefined if the response never got there
+  rise_time?: number;
+  latency?: number;
+  peak_time?: number;
+  // percent above the settled value
+  overshoot?: number;
+}
+
+export interface StepResponse {
+  sample_rate: number;
+  axes: StepResponseAxis[];
+}
+
+// a settled response sits around 1, anything far off is a segment where
+// the craft was not following the sticks, e.g. on the ground
+const MIN_STEADY = 0.5;
+const MAX_STEADY = 3;
+
+// the tail of the response taken as the settled value
+const STEADY_FROM = 0.6;
+
+function nextPowerOfTwo(n: number) {
+  let p = 1;
+  while (p < n) {
+    p <<= 1;
+  }
+  return p;
+}
+
+function mean(values: number[]) {
+  return values.reduce((sum, v) => sum + v, 0) / (values.length || 1);
+}
+
+function steadyValue(response: number[]) {
+  return mean(response.slice(Math.floor(response.length * STEADY_FROM)));
+}
+
+// wiener deconvolution of the gyro by the setpoint gives the impulse
+// response, its running sum the step response
+export function deconvolveStep(
+  input: number[],
+  output: number[],
+  length: number
+): number[] {
+  const n = input.length;
+  const window = hannWindow(n);
+  const inRe = new Float64Array(n);
+  const inIm = new Float64Array(n);
+  const outRe = new Float64Array(n);
+  const outIm = new Float64Array(n);
+  for (let i = 0; i < n; i++) {
+    inRe[i] = input[i] * window[i];
+    outRe[i] = output[i] * window[i];
+  }
+  fft(inRe, inIm);
+  fft(outRe, outIm);
+
+  let maxPower = 0;
+  for (let k = 0; k < n; k++) {
+    maxPower = Math.max(maxPower, inRe[k] * inRe[k] + inIm[k] * inIm[k]);
+  }
+  // keeps bins without stick input from blowing up
+  const reg = maxPower * 1e-4;
+
+  const hRe = new Float64Array(n);
+  const hIm = new Float64Array(n);
+  for (let k = 0; k < n; k++) {
+    const power = inRe[k] * inRe[k] + inIm[k] * inIm[k] + reg;
+    hRe[k] = (outRe[k] * inRe[k] + outIm[k] * inIm[k]) / power;
+    hIm[k] = (outIm[k] * inRe[k] - outRe[k] * inIm[k]) / power;
+  }
+  ifft(hRe, hIm);
+
+  const step: number[] = [];
+  let sum = 0;
+  for (let i = 0; i < Math.min(length, n); i++) {
+    sum += hRe[i];
+    step.push(sum);
+  }
+  return step;
+}
+
+function firstCrossing(time: number[], response: number[], level: number) {
+  const i = response.findIndex((v) => v >= level);
+  return i < 0 ? undefined : time[i];
+}
+
+export function stepMetrics(time: number[], response: number[]) {
+  const steady = steadyValue(response);
+  if (!response.length || steady <= 0) {
+    return {};
+  }
+
+  const peak = response.indexOf(Math.max(...response));
+  const rise10 = firstCrossing(time, response, steady * 0.1);
+  const rise90 = firstCrossing(time, response, steady * 0.9);
+  return {
+    rise_time:
+      rise10 === undefined || rise90 === undefined
+        ? undefined
+        : rise90 - rise10,
+    latency: firstCrossing(time, response, steady * 0.5),
+    peak_time: time[peak],
+    overshoot: Math.max(0, (response[peak] / steady - 1) * 100),
+  };
+}
+
+// setpoint against filtered gyro per axis, in overlapping segments that
+// are averaged like pidtoolbox does
+export function stepResponse(
+  frames: BlackboxFrame[],
+  sample_rate: number,
+  opts = DEFAULT_STEP_OPTIONS
+): StepResponse {
+  const size = nextPowerOfTwo(Math.round(opts.segment * sample_rate));
+  const length = Math.round(opts.length * sample_rate);
+  const hop = size / 2;
+  const time = Array.from({ length }, (_, i) => (i * 1000) / sample_rate);
+
+  const axes = [0, 1, 2].map((axis): StepResponseAxis => {
+    const input = frames.map((f) => (f.setpoint?.[axis] ?? 0) / 1000);
+    const output = frames.map((f) => (f.gyro_filter?.[axis] ?? 0) / 1000);
+
+    const steps: number[][] = [];
+    for (let start = 0; start + size <= frames.length; start += hop) {
+      const seg = input.slice(start, start + size);
+      if (Math.max(...seg.map(Math.abs)) < opts.min_input) {
+        continue;
+      }
+      const out = output.slice(start, start + size);
+      const step = deconvolveStep(seg, out, length);
+      const steady = steadyValue(step);
+      if (steady > MIN_STEADY && steady < MAX_STEADY) {
+        steps.push(step);
+      }
+    }
+
+    if (!steps.length) {
+      return { time, response: [], segments: 0 };
+    }
+    const response = time.map((_, i) => mean(steps.map((s) => s[i])));
+    return {
+      time,
+      response,
+      segments: steps.length,
+      ...stepMetrics(time, response),
+    };
+  });
+
+  return { sample_rate, axes };
+}
@@ -0,0 +1,158 @@
+import { defineStore } from "pinia";
+import { $enum } from "ts-enum-util";
+import { Log } from "@/log";
+import { serial } from "./serial/serial";
+import { QuicEvent } from "./serial/events";
+import { QuicVal } from "./serial/quic";
+import { useInfoStore } from "./info";
+import { diffObjects, type DiffEntry } from "./util/diff";
+import { decodeJSON, encodeJSON } from "./util/profilefile";
+
+const AUDIT_STORAGE_KEY = "audit-log";
+
+// oldest entries are dropped past this, across all targets
+export const AUDIT_RETENTION = 500;
+
+// values worth a before/after diff, everything else is logged as written
+const DIFFED_VALUES = [QuicVal.Profile, QuicVal.VtxSettings, QuicVal.BindInfo];
+
+// volatile bookkeeping that changes on every write
+const IGNORED_PATHS = [/^meta\.datetime$/];
+
+export const DEFAULT_SOURCE = "configurator";
+
+export interface AuditEntry {
+  seq: number;
+  timestamp: number;
+  target_name: string;
+  value: string;
+  source: string;
+  changes: DiffEntry[];
+}
+
+export interface AuditQuery {
+  value?: string;
+  path?: string;
+  source?: string;
+  since?: number;
+  until?: number;
+}
+
+interface PendingWrite {
+  before?: any;
+  source: string;
+}
+
+const pending = new Map<QuicVal, PendingWrite>();
+
+function loadEntries(): AuditEntry[] {
+  try {
+    return decodeJSON(localStorage.getItem(AUDIT_STORAGE_KEY) || "[]");
+  } catch {
+    return [];
+  }
+}
+
+function matchesPath(entry: AuditEntry, path: string) {
+  return entry.changes.some(
+    (c) => c.path == path || c.path.startsWith(path + ".")
+  );
+}
+
+export const useAuditStore = defineStore("audit", {
+  state: () => ({
+    entries: loadEntries(),
+    source: DEFAULT_SOURCE,
+  }),
+  actions: {
+    persist() {
+      try {
+        localStorage.setItem(AUDIT_STORAGE_KEY, encodeJSON(this.entries));
+      } catch (err) {
+        Log.warn("audit", "storage full, pruning", err);
+        this.entries = this.entries.slice(Math.floor(this.entries.length / 2));
+        localStorage.setItem(AUDIT_STORAGE_KEY, encodeJSON(this.entries));
+      }
+    },
+    // tags every write made while fn runs, so the log can tell a file sync
+    // from a template or a restore
+    async with_source<T>(source: string, fn: () => Promise<T>) {
+      const previous = this.source;
+      this.source = source;
+      try {
+        return await fn();
+      } finally {
+        this.source = previous;
+      }
+    },
+    append(id: QuicVal, value: any) {
+      const write = pending.get(id);
+      pending.delete(id);
+
+      const changes =
+        write?.before !== undefined
+          ? diffObjects(write.before, value).filter(
+              (c) => !IGNORED_PATHS.some((re) => re.test(c.path))
+            )
+          : [];
+
+      const last = this.entries[this.entries.length - 1];
+      const entry: AuditEntry = {
+        seq: (last?.seq || 0) + 1,
+        timestamp: Math.floor(Date.now() / 1000),
+        target_name: useInfoStore().target_name,
+        value: $enum(QuicVal).getKeyOrDefault(id, String(id)),
+        source: write?.source || this.source,
+        changes,
+      };
+      this.entries = [...this.entries, entry].slice(-AUDIT_RETENTION);
+      this.persist();
+      return entry;
+    },
+    watch_writes() {
+      const removeHook = serial.beforeSet(async (ids) => {
+        for (const id of ids) {
+          const write: PendingWrite = { source: this.source };
+          if (DIFFED_VALUES.includes(id)) {
+            try {
+              write.before = await serial.get(id);
+            } catch (err) {
+              Log.warn("audit", "reading previous value failed", err);
+            }
+          }
+          pending.set(id, write);
+        }
+      });
+      const unsubscribe = serial.events.subscribe(
+        QuicEvent.ValueSet,
+        ({ id, value }) => this.append(id, value)
+      );
+      return () => {
+        removeHook();
+        unsubscribe();
+        pending.clear();
+      };
+    },
+    query(q: AuditQuery = {}) {
+      return this.entries.filter((e) => {
+        if (q.value && e.value != q.value) {
+          return false;
+        }
+        if (q.source && e.source != q.source) {
+          return false;
+        }
+        if (q.since && e.timestamp < q.since) {
+          return false;
+        }
+        if (q.until && e.timestamp > q.until) {
+          return false;
+        }
+        return !q.path || matchesPath(e, q.path);
+      });
+    },
+    clear() {
+      this.entries = [];
+      this.persist();
+    },
+  },
+});
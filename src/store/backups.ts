@@ -0,0 +1,129 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { serial } from "./serial/serial";
+import { QuicVal } from "./serial/quic";
+import { useAuditStore } from "./audit";
+import { useInfoStore } from "./info";
+import { useProfileStore } from "./profile";
+import { profileHash } from "./util/hash";
+import { decodeJSON, encodeJSON } from "./util/profilefile";
+
+const BACKUPS_STORAGE_KEY = "profile-backups";
+
+// per target, the oldest snapshot is dropped once this many are kept
+export const BACKUP_RETENTION = 20;
+
+export interface ProfileBackup {
+  id: string;
+  target_name: string;
+  name: string;
+  datetime: number;
+  hash?: string;
+  profile: any;
+}
+
+function loadBackups(): ProfileBackup[] {
+  try {
+    return decodeJSON(localStorage.getItem(BACKUPS_STORAGE_KEY) || "[]");
+  } catch {
+    return [];
+  }
+}
+
+export const useBackupsStore = defineStore("backups", {
+  state: () => ({
+    backups: loadBackups(),
+  }),
+  getters: {
+    current(state) {
+      const info = useInfoStore();
+      return state.backups.filter((b) => b.target_name == info.target_name);
+    },
+  },
+  actions: {
+    persist() {
+      try {
+        localStorage.setItem(BACKUPS_STORAGE_KEY, encodeJSON(this.backups));
+      } catch (err) {
+        // storage full, give up the oldest half rather than the write
+        Log.warn("backup", "storage full, pruning", err);
+        const sorted = [...this.backups].sort(
+          (a, b) => b.datetime - a.datetime
+        );
+        this.backups = sorted.slice(0, Math.ceil(sorted.length / 2));
+        localStorage.setItem(BACKUPS_STORAGE_KEY, encodeJSON(this.backups));
+      }
+    },
+    async backup_hash(backup: ProfileBackup) {
+      if (!backup.hash) {
+        backup.hash = await profileHash(backup.profile);
+      }
+      return backup.hash;
+    },
+    // an identical older snapshot is dropped in favour of the new one, so
+    // flipping between two tunes does not eat up the retention
+    async save_backup(profile: any) {
+      const info = useInfoStore();
+      const hash = await profileHash(profile);
+      const [latest] = this.current;
+      if (latest && (await this.backup_hash(latest)) == hash) {
+        return latest;
+      }
+
+      const datetime = Date.now();
+      const backup: ProfileBackup = {
+        id: `${info.target_name}/${datetime}`,
+        target_name: info.target_name,
+        name: (profile.meta?.name || "").replace(/\0/g, ""),
+        datetime: Math.floor(datetime / 1000),
+        hash,
+        profile,
+      };
+
+      const previous: ProfileBackup[] = [];
+      for (const b of this.current) {
+        if ((await this.backup_hash(b)) != hash) {
+          previous.push(b);
+        }
+      }
+
+      const others = this.backups.filter(
+        (b) => b.target_name != info.target_name
+      );
+      const kept = [backup, ...previous].slice(0, BACKUP_RETENTION);
+      this.backups = [...kept, ...others];
+      this.persist();
+      Log.info("backup", "saved", backup.id);
+      return backup;
+    },
+    // snapshots what the board holds right before the profile is replaced
+    watch_writes() {
+      return serial.beforeSet(async (ids) => {
+        if (!ids.includes(QuicVal.Profile)) {
+          return;
+        }
+        try {
+          await this.save_backup(await serial.get(QuicVal.Profile));
+        } catch (err) {
+          Log.warn("backup", "snapshot failed", err);
+        }
+      });
+    },
+    get_backup(id: string) {
+      return this.backups.find((b) => b.id == id);
+    },
+    restore_backup(id: string) {
+      const backup = this.get_backup(id);
+      if (!backup) {
+        throw new Error("backup " + id + " not found");
+      }
+      return useAuditStore().with_source("backup", () =>
+        useProfileStore().apply_profile(backup.profile)
+      );
+    },
+    delete_backup(id: string) {
+      this.backups = this.backups.filter((b) => b.id != id);
+      this.persist();
+    },
+  },
+});
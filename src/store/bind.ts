@@ -3,6 +3,17 @@ import { QuicVal } from "./serial/quic";
 import { Log } from "@/log";
 import { defineStore } from "pinia";
 import { useRootStore } from "./root";
+import { useStateStore } from "./state";
+import { useInfoStore } from "./info";
+import { useProfileStore } from "./profile";
+import { useConstantStore } from "./constants";
+import { useSerialStore } from "./serial";
+import { asyncDelay } from "./util";
+import { $enum } from "ts-enum-util";
+import { decodeRxStatus, hasLink, type RxStatus } from "./serial/rx";
+
+const BIND_TIMEOUT = 60_000;
+const BIND_POLL_INTERVAL = 500;
 
 export const useBindStore = defineStore("bind", {
   state: () => ({
@@ -10,11 +21,100 @@ export const useBindStore = defineStore("bind", {
       bind_saved: 0,
       raw: new Uint8Array(),
     },
+    binding: false,
+    cancelled: false,
   }),
+  getters: {
+    status(): RxStatus {
+      const constants = useConstantStore();
+      const info = useInfoStore();
+      const profile = useProfileStore();
+      const state = useStateStore();
+      return decodeRxStatus(
+        state,
+        $enum(constants.RXProtocol as any).getKeys(),
+        profile.receiver?.protocol || info.rx_protocol,
+        $enum(constants.RXSerialProtocol).getKeys()
+      );
+    },
+  },
   actions: {
     fetch_bind_info() {
       return serial.get(QuicVal.BindInfo).then((b) => (this.info = b));
     },
+    // dropping the saved bind makes the receiver enter bind mode on boot.
+    // bind info only reaches flash with the profile, so it is persisted
+    // before every reboot and once the new bind is made. the old bind is
+    // written back if no transmitter shows up, a failed attempt must not
+    // cost a working bind
+    async rx_bind() {
+      const root = useRootStore();
+      const serial_store = useSerialStore();
+      const state = useStateStore();
+
+      this.binding = true;
+      this.cancelled = false;
+      let previous: any = undefined;
+      try {
+        await this.fetch_bind_info();
+        previous = this.info;
+        await serial.set(QuicVal.BindInfo, {
+          ...previous,
+          bind_saved: 0,
+          raw: new Uint8Array(previous.raw.length),
+        });
+        await serial.persist();
+        await serial_store.soft_reboot();
+        if (!serial_store.is_connected) {
+          throw new Error("board did not come back after reboot");
+        }
+
+        const deadline = Date.now() + BIND_TIMEOUT;
+        while (!hasLink(this.status)) {
+          if (this.cancelled) {
+            throw new Error("cancelled");
+          }
+          if (Date.now() > deadline) {
+            throw new Error("no transmitter found");
+          }
+          await asyncDelay(BIND_POLL_INTERVAL);
+          await state.fetch_state();
+        }
+
+        await serial.persist();
+        await this.fetch_bind_info();
+        root.append_alert({ type: "success", msg: "Receiver bound!" });
+      } catch (err) {
+        Log.error("bind", err);
+        let msg = "Bind failed! " + err;
+        if (previous && !(await this.restore_bind_info(previous))) {
+          msg += ", the previous bind could not be restored";
+        }
+        root.append_alert({ type: "danger", msg });
+      } finally {
+        this.binding = false;
+      }
+    },
+    cancel_bind() {
+      this.cancelled = true;
+    },
+    async restore_bind_info(previous) {
+      const serial_store = useSerialStore();
+      if (!serial_store.is_connected) {
+        return false;
+      }
+      try {
+        await serial.set(QuicVal.BindInfo, previous);
+        await serial.persist();
+        await serial_store.soft_reboot();
+        await this.fetch_bind_info();
+        Log.info("bind", "previous bind restored");
+        return true;
+      } catch (err) {
+        Log.error("bind", "restoring the previous bind failed", err);
+        return false;
+      }
+    },
     apply_bind_info(info) {
       const root = useRootStore();
 
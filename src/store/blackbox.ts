@@ -1,10 +1,16 @@
 import { defineStore } from "pinia";
 import { useRootStore } from "./root";
-import { QuicBlackbox, QuicCmd, QuicVal } from "./serial/quic";
+import { QuicVal } from "./serial/quic";
 import { serial } from "./serial/serial";
+import { QuicEvent } from "./serial/events";
+import { BlackboxDownload, BlackboxStorage } from "./blackbox/storage";
 import { Blackbox } from "./util/blackbox";
+import { cacheGet, cacheSet } from "./util/cache";
+import { FrameDecimator } from "./util/downsample";
 import { BlackboxField } from "./constants";
 import { useProfileStore } from "./profile";
+import { useStateStore } from "./state";
+import { Log } from "@/log";
 import type { profile_t } from "./types";
 
 export enum BlackboxFieldUnit {
@@ -36,6 +42,23 @@ export interface BlackboxFile {
   size: number;
 }
 
+export interface BlackboxFrame {
+  loop: number;
+  time: number;
+  pid_pterm?: number[];
+  pid_iterm?: number[];
+  pid_dterm?: number[];
+  rx?: number[];
+  setpoint?: number[];
+  accel_raw?: number[];
+  accel_filter?: number[];
+  gyro_raw?: number[];
+  gyro_filter?: number[];
+  motor?: number[];
+  cpu_load?: number;
+  debug?: number[];
+}
+
 const AxisRPY = ["Roll", "Pitch", "Yaw"];
 const AxisRPYT = [...AxisRPY, "Throttle"];
 const AxisIndex = (count) =>
@@ -145,20 +168,108 @@ export function transformBlackboxFieldFlags(flags: number) {
   return res | (1 << BlackboxField.LOOP) | (1 << BlackboxField.TIME);
 }
 
+// the fields present in a frame, in the order the firmware sends them
+export function blackboxFieldDefs(field_flags?: number): BlackboxFieldDef[] {
+  const fieldflags = transformBlackboxFieldFlags(field_flags as number);
+  return Object.entries(BlackboxFields)
+    .filter(([field]) => fieldflags & (1 << Number(field)))
+    .map(([, def]) => def);
+}
+
+export function decodeBlackboxFrame(
+  val: any[],
+  field_flags?: number
+): BlackboxFrame {
+  const fieldflags = transformBlackboxFieldFlags(field_flags as number);
+
+  const frame: any = {};
+  let index = 0;
+  for (const [field, def] of Object.entries(BlackboxFields)) {
+    if (fieldflags & (1 << Number(field))) {
+      frame[def.name] = val[index++];
+    }
+  }
+  return frame;
+}
+
+export enum BlackboxFieldGroup {
+  GYRO = "gyro",
+  GYRO_RX = "gyro_rx",
+  FULL = "full",
+}
+
+export const BlackboxFieldGroups: {
+  [group in BlackboxFieldGroup]: { title: string; fields: BlackboxField[] };
+} = {
+  [BlackboxFieldGroup.GYRO]: {
+    title: "Gyro",
+    fields: [BlackboxField.GYRO_RAW, BlackboxField.GYRO_FILTER],
+  },
+  [BlackboxFieldGroup.GYRO_RX]: {
+    title: "Gyro + RX",
+    fields: [
+      BlackboxField.GYRO_RAW,
+      BlackboxField.GYRO_FILTER,
+      BlackboxField.RX,
+      BlackboxField.SETPOINT,
+    ],
+  },
+  [BlackboxFieldGroup.FULL]: {
+    title: "Full",
+    fields: Object.keys(BlackboxFields).map(Number),
+  },
+};
+
+export function blackboxGroupFlags(group: BlackboxFieldGroup) {
+  return BlackboxFieldGroups[group].fields.reduce(
+    (flags, field) => flags | (1 << field),
+    transformBlackboxFieldFlags(0)
+  );
+}
+
+// the firmware logs every nth loop, looptime is in us
+export function blackboxSampleRate(looptime: number, divisor: number) {
+  return Math.round(1e6 / looptime / Math.max(1, Math.floor(divisor)));
+}
+
+const storage = new BlackboxStorage(serial);
+
+// kept after a failed download so the next attempt at the same file
+// continues from there
+let pending: BlackboxDownload | undefined;
+
+function downloadError(resume_index?: number) {
+  if (resume_index === undefined) {
+    return "Blackbox download failed";
+  }
+  return "Blackbox download failed, download the file again to resume";
+}
+
+const LIVE_RATE_CACHE_KEY = "blackbox/live-rate";
+
+// frames per second handed to live views, a chart redraw per frame at the
+// loop rate stalls the page
+const DEFAULT_LIVE_RATE = 100;
+
 export const useBlackboxStore = defineStore("blackbox", {
   state: () => ({
     busy: false,
     speed: undefined as number | undefined,
     progress: undefined as number | undefined,
     list: { flash_size: 0, files: [] as BlackboxFile[] },
+    // file index of a download that failed part way
+    resume_index: undefined as number | undefined,
     presets: [] as BlackboxPreset[],
+    live_rate: cacheGet<number>(LIVE_RATE_CACHE_KEY) ?? DEFAULT_LIVE_RATE,
   }),
   actions: {
     reset_blackbox() {
       const root = useRootStore();
 
-      return serial
-        .command(QuicCmd.Blackbox, QuicBlackbox.Reset)
+      pending = undefined;
+      this.resume_index = undefined;
+      return storage
+        .erase()
         .then(() => {
           root.append_alert({
             type: "success",
@@ -170,43 +281,113 @@ export const useBlackboxStore = defineStore("blackbox", {
         });
     },
     list_blackbox() {
-      return serial
-        .command(QuicCmd.Blackbox, QuicBlackbox.List)
-        .then((p) => (this.list = p.payload[0]));
+      return storage.list().then((list) => {
+        const file = pending && list.files[pending.index];
+        if (pending && (!file || !pending.matches(pending.index, file))) {
+          pending = undefined;
+          this.resume_index = undefined;
+        }
+        return (this.list = list);
+      });
+    },
+    subscribe_frames(fn: (frame: BlackboxFrame) => void) {
+      const profile = useProfileStore();
+      return serial.events.subscribe(
+        QuicEvent.Blackbox,
+        (payload) => {
+          const field_flags = profile.blackbox.field_flags;
+          for (const val of payload) {
+            fn(decodeBlackboxFrame(val, field_flags));
+          }
+        },
+        1024
+      );
+    },
+    // the rate is fixed for the subscription, views resubscribe on change
+    subscribe_live(fn: (frame: BlackboxFrame) => void, rate = this.live_rate) {
+      const decimator = new FrameDecimator(rate, fn);
+      return this.subscribe_frames((f) => decimator.push(f));
+    },
+    set_live_rate(rate: number) {
+      this.live_rate = rate;
+      cacheSet(LIVE_RATE_CACHE_KEY, rate);
+    },
+    // the firmware may round the rate to what its looptime allows, the
+    // stored settings are returned so the caller sees what was granted.
+    // frames are decoded with the profile field flags, so the live decoder
+    // follows once the profile is updated
+    async configure_stream(group: BlackboxFieldGroup, divisor: number) {
+      const profile = useProfileStore();
+      const state = useStateStore();
+
+      await state.fetch_state();
+      if (!state.looptime_autodetect) {
+        throw new Error("looptime unknown");
+      }
+      const requested = {
+        field_flags: blackboxGroupFlags(group),
+        sample_rate_hz: blackboxSampleRate(state.looptime_autodetect, divisor),
+      };
+
+      const current = await serial.get(QuicVal.Profile);
+      const stored = await serial.set(QuicVal.Profile, {
+        ...current,
+        blackbox: { ...current.blackbox, ...requested },
+      });
+      profile.set_profile(stored);
+
+      const granted = stored.blackbox;
+      if (
+        granted.field_flags != requested.field_flags ||
+        granted.sample_rate_hz != requested.sample_rate_hz
+      ) {
+        Log.warn("blackbox", "requested", requested, "granted", granted);
+      }
+      return granted;
     },
     fetch_presets() {
       return serial
         .get(QuicVal.BlackboxPresets)
         .then((val) => (this.presets = val));
     },
+    // entries of a flash file, continuing a failed download of the same
+    // file instead of starting over
+    fetch_blackbox(index: number) {
+      const file = this.list.files[index];
+      if (!pending || !pending.matches(index, file)) {
+        pending = new BlackboxDownload(index, file);
+      }
+      const dl = pending;
+
+      return storage
+        .download(dl, (p) => {
+          this.progress = p.offset / p.size;
+          this.speed = p.speed;
+        })
+        .then((entries) => {
+          pending = undefined;
+          this.resume_index = undefined;
+          return entries;
+        })
+        .catch((err) => {
+          this.resume_index = storage.chunked && dl.offset ? index : undefined;
+          throw err;
+        })
+        .finally(() => {
+          this.progress = undefined;
+          this.speed = undefined;
+        });
+    },
     download_blackbox_quic(index) {
       const root = useRootStore();
       const file = this.list.files[index];
-      const fieldflags = transformBlackboxFieldFlags(file.field_flags);
-
-      const start = performance.now();
-      return serial
-        .commandProgress(
-          QuicCmd.Blackbox,
-          (v: number) => {
-            const delta = (performance.now() - start) / 1000;
-            this.progress = v / file.size;
-            this.speed = v / delta;
-          },
-          QuicBlackbox.Get,
-          index
-        )
-        .then((p) => {
-          const fields = Object.keys(BlackboxFields)
-            .filter((val, key) => {
-              return (fieldflags & (1 << key)) > 0;
-            })
-            .map((i) => BlackboxFields[i]);
 
+      return this.fetch_blackbox(index)
+        .then((entries) => {
           const f = {
             ...file,
-            fields,
-            entries: p.payload,
+            fields: blackboxFieldDefs(file.field_flags),
+            entries,
           };
 
           const encoded = encodeURIComponent(JSON.stringify(f));
@@ -222,38 +403,24 @@ export const useBlackboxStore = defineStore("blackbox", {
         .catch((err) => {
           root.append_alert({
             type: "danger",
-            msg: "Blackbox download failed",
+            msg: downloadError(this.resume_index),
           });
           throw err;
-        })
-        .finally(() => {
-          this.progress = undefined;
-          this.speed = undefined;
         });
     },
     download_blackbox_btfl(index) {
       const root = useRootStore();
       const file = this.list.files[index];
 
-      const start = performance.now();
-      return serial
-        .commandProgress(
-          QuicCmd.Blackbox,
-          (v: number) => {
-            const delta = (performance.now() - start) / 1000;
-            this.progress = v / file.size;
-            this.speed = v / delta;
-          },
-          QuicBlackbox.Get,
-          index
-        )
-        .then((p) => {
+      return this.fetch_blackbox(index)
+        .then((entries) => {
           const profile = useProfileStore();
           const writer = new Blackbox(file);
           writer.writeHeaders(profile as unknown as profile_t);
-          for (const v of p.payload) {
+          for (const v of entries) {
             writer.writeValue(v);
           }
+          writer.writeLogEnd();
           return writer.toUrl();
         })
         .then((url) => {
@@ -266,13 +433,9 @@ export const useBlackboxStore = defineStore("blackbox", {
         .catch((err) => {
           root.append_alert({
             type: "danger",
-            msg: "Blackbox download failed",
+            msg: downloadError(this.resume_index),
           });
           throw err;
-        })
-        .finally(() => {
-          this.progress = undefined;
-          this.speed = undefined;
         });
     },
   },
@@ -0,0 +1,123 @@
+import { Log } from "@/log";
+import type { BlackboxFile } from "../blackbox";
+import { QuicBlackbox, QuicCmd } from "../serial/quic";
+import type { Serial } from "../serial/serial";
+
+export interface BlackboxList {
+  // in kb
+  flash_size: number;
+  files: BlackboxFile[];
+}
+
+export interface StorageProgress {
+  // bytes of the file read so far
+  offset: number;
+  size: number;
+  // bytes per second since this attempt started
+  speed: number;
+}
+
+export type StorageProgressCallback = (p: StorageProgress) => void;
+
+// bytes asked for per range request, small enough that a lost chunk is
+// cheap to fetch again
+export const BLACKBOX_CHUNK_SIZE = 16 * 1024;
+
+const CHUNK_RETRIES = 2;
+const CHUNK_TIMEOUT = 5000;
+
+// a download that can be picked up again after a failed chunk, it belongs
+// to one file and is useless once the flash was erased or written to
+export class BlackboxDownload {
+  public entries: any[] = [];
+  public offset = 0;
+  public done = false;
+
+  constructor(
+    public readonly index: number,
+    public readonly file: BlackboxFile
+  ) {}
+
+  matches(index: number, file: BlackboxFile) {
+    return (
+      this.index == index &&
+      this.file.start == file.start &&
+      this.file.size == file.size
+    );
+  }
+}
+
+// onboard flash logs over quic. firmware with range support is read in
+// chunks that can be resumed, older firmware sends the whole file at once
+export class BlackboxStorage {
+  constructor(private serial: Serial) {}
+
+  get chunked() {
+    return this.serial.capabilities.blackboxRange;
+  }
+
+  async list(): Promise<BlackboxList> {
+    const p = await this.serial.command(QuicCmd.Blackbox, QuicBlackbox.List);
+    return p.payload[0];
+  }
+
+  async erase() {
+    await this.serial.command(QuicCmd.Blackbox, QuicBlackbox.Reset);
+  }
+
+  // resumes where dl stopped, the entries read so far are kept on failure
+  async download(dl: BlackboxDownload, progress?: StorageProgressCallback) {
+    if (dl.done) {
+      return dl.entries;
+    }
+
+    const start = performance.now();
+    const from = dl.offset;
+    const report = (offset: number) => {
+      const delta = (performance.now() - start) / 1000;
+      progress?.({
+        offset,
+        size: dl.file.size,
+        speed: delta > 0 ? (offset - from) / delta : 0,
+      });
+    };
+
+    if (!this.chunked) {
+      const p = await this.serial.commandProgress(
+        QuicCmd.Blackbox,
+        (v: number) => report(v),
+        QuicBlackbox.Get,
+        dl.index
+      );
+      dl.entries = p.payload;
+      dl.offset = dl.file.size;
+      dl.done = true;
+      return dl.entries;
+    }
+
+    if (from) {
+      Log.info("blackbox", "resuming file", dl.index, "at", from);
+    }
+    report(dl.offset);
+    while (dl.offset < dl.file.size) {
+      const p = await this.serial.commandWith(
+        QuicCmd.Blackbox,
+        { retries: CHUNK_RETRIES, timeout: CHUNK_TIMEOUT },
+        QuicBlackbox.GetRange,
+        dl.index,
+        dl.offset,
+        BLACKBOX_CHUNK_SIZE
+      );
+      const { offset, entries } = p.payload[0];
+      if (offset <= dl.offset) {
+        // nothing left the firmware considers a whole entry
+        break;
+      }
+      dl.entries.push(...entries);
+      dl.offset = offset;
+      report(dl.offset);
+    }
+    dl.done = true;
+    return dl.entries;
+  }
+}
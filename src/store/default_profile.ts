@@ -1,8 +1,11 @@
 import { defineStore } from "pinia";
-import semver from "semver";
+import { Log } from "@/log";
 import { QuicVal } from "./serial/quic";
 import { serial } from "./serial/serial";
 import { decodeSemver } from "./util";
+import { cacheGet, cacheSet, deviceId } from "./util/cache";
+import { useInfoStore } from "./info";
+import { hasFeature, resolveSchema, type ProfileSchema } from "./util/schema";
 
 export const useDefaultProfileStore = defineStore("default_profile", {
   state: () => ({
@@ -48,18 +51,38 @@ export const useDefaultProfileStore = defineStore("default_profile", {
     },
   }),
   getters: {
-    has_legacy_stickrates(state) {
-      return semver.lte(decodeSemver(state.meta.version), "v0.1.0");
+    // describes the firmware itself, the default profile carries its version
+    schema(state): ProfileSchema {
+      return resolveSchema(decodeSemver(state.meta.version));
     },
-    has_legacy_osd(state) {
-      return semver.lte(decodeSemver(state.meta.version), "v0.1.0");
+    has_legacy_stickrates(): boolean {
+      return hasFeature(this.schema, "legacy_stickrates");
+    },
+    has_legacy_osd(): boolean {
+      return hasFeature(this.schema, "legacy_osd");
     },
   },
   actions: {
     fetch_default_profile() {
+      const id = deviceId(useInfoStore());
       return serial.get(QuicVal.DefaultProfile).then((profile) => {
         profile.meta.name = profile.meta.name.replace(/\0/g, "");
         this.$patch(profile);
+        if (id) {
+          cacheSet("default_profile/" + id, profile);
+        }
+      });
+    },
+    // like the target, the cache is only a fallback for display
+    fetch_default_profile_cached() {
+      const id = deviceId(useInfoStore());
+      return this.fetch_default_profile().catch((err) => {
+        const profile = id && cacheGet("default_profile/" + id);
+        if (!profile) {
+          throw err;
+        }
+        Log.warn("default_profile", "showing cached defaults", err);
+        this.$patch(profile);
       });
     },
   },
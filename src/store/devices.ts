@@ -0,0 +1,62 @@
+import { defineStore } from "pinia";
+import { useInfoStore } from "./info";
+import { useProfileStore } from "./profile";
+
+const DEVICES_STORAGE_KEY = "devices";
+const DEVICES_MAX = 16;
+
+export interface DeviceSnapshot {
+  id: string;
+  name: string;
+  target_name: string;
+  git_version: string;
+  datetime: number;
+  profile: any;
+}
+
+function loadDevices(): DeviceSnapshot[] {
+  try {
+    return JSON.parse(localStorage.getItem(DEVICES_STORAGE_KEY) || "[]");
+  } catch {
+    return [];
+  }
+}
+
+export const useDevicesStore = defineStore("devices", {
+  state: () => ({
+    current: undefined as string | undefined,
+    snapshots: loadDevices(),
+  }),
+  getters: {
+    others(state) {
+      return state.snapshots.filter((s) => s.id != state.current);
+    },
+  },
+  actions: {
+    capture() {
+      const info = useInfoStore();
+      const profile = useProfileStore();
+
+      const name = profile.meta.name.replace(/\0/g, "");
+      const snapshot: DeviceSnapshot = {
+        id: `${info.target_name}/${name}`,
+        name,
+        target_name: info.target_name,
+        git_version: info.git_version,
+        datetime: Math.floor(Date.now() / 1000),
+        profile: JSON.parse(JSON.stringify(profile.$state)),
+      };
+
+      this.current = snapshot.id;
+      this.snapshots = [
+        snapshot,
+        ...this.snapshots.filter((s) => s.id != snapshot.id),
+      ].slice(0, DEVICES_MAX);
+      localStorage.setItem(DEVICES_STORAGE_KEY, JSON.stringify(this.snapshots));
+    },
+    forget(id: string) {
+      this.snapshots = this.snapshots.filter((s) => s.id != id);
+      localStorage.setItem(DEVICES_STORAGE_KEY, JSON.stringify(this.snapshots));
+    },
+  },
+});
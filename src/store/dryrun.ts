@@ -0,0 +1,53 @@
+import { serial, FirmwareError } from "./serial/serial";
+import { QuicCmd, QuicVal } from "./serial/quic";
+import { useProfileStore } from "./profile";
+import { diffObjects, type DiffEntry } from "./util/diff";
+import { blockingViolations, type ProfileViolation } from "./util/validate";
+
+export interface DryRunResult {
+  // firmware when it checked the value itself, local otherwise
+  source: "firmware" | "local";
+  changes: DiffEntry[];
+  violations: ProfileViolation[];
+}
+
+// local checks only know the profile constraints, ranges the firmware
+// does not publish are left to it
+function validateLocal(id: QuicVal, value: any): ProfileViolation[] {
+  if (id == QuicVal.Profile) {
+    return blockingViolations(useProfileStore().validate(value));
+  }
+  return [];
+}
+
+// what writing value would change, without writing it
+export async function setValueDryRun(
+  id: QuicVal,
+  value: any
+): Promise<DryRunResult> {
+  const current = await serial.get(id);
+  const violations = validateLocal(id, value);
+
+  let stored = value;
+  let source: DryRunResult["source"] = "local";
+  if (!violations.length && serial.supports(QuicCmd.Validate)) {
+    try {
+      stored = await serial.setDryRun(id, value);
+      source = "firmware";
+    } catch (err: any) {
+      if (!(err instanceof FirmwareError)) {
+        throw err;
+      }
+      violations.push({ path: "", value, message: err.message });
+      source = "firmware";
+    }
+  }
+
+  return {
+    source,
+    changes: diffObjects(current, stored).filter(
+      (c) => c.path != "meta.datetime"
+    ),
+    violations,
+  };
+}
@@ -0,0 +1,135 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { serial } from "./serial/serial";
+import { FourWay, type EscInfo } from "./serial/fourway";
+import {
+  EscTelemetryStream,
+  type EscTelemetry,
+} from "./serial/esctelemetry";
+import { WebSerial } from "./serial/webserial";
+import { useRootStore } from "./root";
+import { useSerialStore } from "./serial";
+import { useStateStore } from "./state";
+
+const TELEMETRY_BAUDRATE = 115200;
+
+let fourway: FourWay | null = null;
+let telemetryStream: EscTelemetryStream | null = null;
+
+export const useEscStore = defineStore("esc", {
+  state: () => ({
+    active: false,
+    loading: false,
+    escs: [] as EscInfo[],
+    telemetry_active: false,
+    telemetry: [] as EscTelemetry[],
+    telemetry_errors: 0,
+  }),
+  actions: {
+    async connect_fourway() {
+      const root = useRootStore();
+      const state = useStateStore();
+      if (state.is_armed) {
+        root.append_alert({
+          type: "danger",
+          msg: "ESC passthrough is not allowed while armed!",
+        });
+        return;
+      }
+
+      this.loading = true;
+      useSerialStore().disconnect();
+      try {
+        fourway = await FourWay.open(serial);
+        this.escs = await fourway.enumerate();
+        this.active = true;
+      } catch (err) {
+        Log.error("esc", err);
+        root.append_alert({
+          type: "danger",
+          msg: "ESC passthrough failed",
+        });
+        await this.disconnect_fourway();
+      } finally {
+        this.loading = false;
+      }
+    },
+    async read_settings(index: number) {
+      const esc = this.escs.find((e) => e.index == index);
+      if (!fourway || !esc) {
+        return;
+      }
+      await fourway.select(index);
+      esc.settings = await fourway.readSettings(esc);
+      return esc.settings;
+    },
+    async write_settings(index: number, raw: Uint8Array) {
+      const root = useRootStore();
+      const esc = this.escs.find((e) => e.index == index);
+      if (!fourway || !esc) {
+        return;
+      }
+
+      this.loading = true;
+      try {
+        await fourway.writeSettings(esc, raw);
+        root.append_alert({
+          type: "success",
+          msg: "ESC settings written!",
+        });
+      } catch (err) {
+        Log.error("esc", err);
+        root.append_alert({
+          type: "danger",
+          msg: "Writing ESC settings failed",
+        });
+      } finally {
+        this.loading = false;
+      }
+    },
+    // quic has no command forwarding esc telemetry, so the telemetry wire
+    // is tapped with a separate usb uart instead of read through the flight
+    // controller. the quic connection stays free for the motor test
+    async start_telemetry(escCount = 4) {
+      await this.stop_telemetry();
+
+      const port = await WebSerial.requestPort();
+      await port.open({ baudRate: TELEMETRY_BAUDRATE });
+      telemetryStream = new EscTelemetryStream(
+        {
+          readable: port.readable!,
+          writable: port.writable!,
+          close: () => port.close(),
+        },
+        escCount
+      );
+      telemetryStream.subscribe((frame) => {
+        this.telemetry[frame.esc] = frame;
+        this.telemetry_errors = telemetryStream?.errors || 0;
+      });
+      telemetryStream.start();
+      this.telemetry_active = true;
+    },
+    async stop_telemetry() {
+      const stream = telemetryStream;
+      telemetryStream = null;
+      this.telemetry_active = false;
+      this.telemetry = [];
+      await stream?.stop().catch((err) => Log.warn("esc", err));
+    },
+    // the flight controller leaves 4way on exit, reconnect afterwards
+    async disconnect_fourway() {
+      const active = fourway;
+      fourway = null;
+      this.active = false;
+      this.escs = [];
+
+      if (active) {
+        await active.close();
+      } else {
+        await serial.close();
+      }
+      return useSerialStore().toggle_connection();
+    },
+  },
+});
@@ -0,0 +1,154 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { useBindStore } from "./bind";
+import { useRootStore } from "./root";
+import { useSerialStore } from "./serial";
+import { useStateStore } from "./state";
+import { asyncDelay } from "./util";
+
+const FAILSAFE_TIMEOUT = 30_000;
+const FAILSAFE_POLL_INTERVAL = 250;
+
+export enum FailsafeTestPhase {
+  Idle = "idle",
+  WaitingLoss = "waiting_loss",
+  WaitingRecovery = "waiting_recovery",
+}
+
+export interface FailsafeStatus {
+  receiving: boolean;
+  failsafe: boolean;
+  armed: boolean;
+  rssi: number;
+}
+
+export interface FailsafeTestResult {
+  timestamp: number;
+  entered: boolean;
+  recovered: boolean;
+  // ms from the link dropping until it came back
+  duration: number;
+  // the board must never report armed while in failsafe
+  armed_in_failsafe: boolean;
+}
+
+class FailsafeArmedError extends Error {
+  constructor() {
+    super("board reported armed while in failsafe");
+  }
+}
+
+export const useFailsafeStore = defineStore("failsafe", {
+  state: () => ({
+    phase: FailsafeTestPhase.Idle,
+    props_off: false,
+    result: null as FailsafeTestResult | null,
+  }),
+  getters: {
+    status(): FailsafeStatus {
+      const bind = useBindStore();
+      const state = useStateStore();
+      return {
+        receiving: !bind.status.failsafe,
+        failsafe: bind.status.failsafe,
+        armed: state.is_armed,
+        rssi: bind.status.rssi,
+      };
+    },
+    // motors may twitch when the link comes back, only test on the bench
+    can_test(): boolean {
+      const serial = useSerialStore();
+      return (
+        serial.is_connected &&
+        this.props_off &&
+        !this.status.armed &&
+        this.status.receiving &&
+        this.phase == FailsafeTestPhase.Idle
+      );
+    },
+  },
+  actions: {
+    async wait_for(fn: (s: FailsafeStatus) => boolean, deadline: number) {
+      const state = useStateStore();
+      while (!fn(this.status)) {
+        if (this.phase == FailsafeTestPhase.Idle) {
+          throw new Error("cancelled");
+        }
+        if (this.status.armed && this.status.failsafe) {
+          throw new FailsafeArmedError();
+        }
+        if (Date.now() > deadline) {
+          return false;
+        }
+        await asyncDelay(FAILSAFE_POLL_INTERVAL);
+        await state.fetch_state();
+      }
+      return true;
+    },
+    // the firmware has no command to force failsafe, the user switches the
+    // transmitter off and we watch the board react to the real link loss
+    async run_test() {
+      const root = useRootStore();
+      const state = useStateStore();
+
+      await state.fetch_state();
+      if (!this.props_off) {
+        throw new Error("confirm the props are off first");
+      }
+      if (this.status.armed) {
+        throw new Error("disarm before testing failsafe");
+      }
+      if (!this.status.receiving) {
+        throw new Error("receiver has no link, already in failsafe");
+      }
+
+      const result: FailsafeTestResult = {
+        timestamp: Math.floor(Date.now() / 1000),
+        entered: false,
+        recovered: false,
+        duration: 0,
+        armed_in_failsafe: false,
+      };
+      try {
+        this.phase = FailsafeTestPhase.WaitingLoss;
+        result.entered = await this.wait_for(
+          (s) => s.failsafe,
+          Date.now() + FAILSAFE_TIMEOUT
+        );
+        if (!result.entered) {
+          throw new Error("failsafe was not detected");
+        }
+
+        const lost = Date.now();
+        this.phase = FailsafeTestPhase.WaitingRecovery;
+        result.recovered = await this.wait_for(
+          (s) => s.receiving,
+          lost + FAILSAFE_TIMEOUT
+        );
+        result.duration = Date.now() - lost;
+        if (!result.recovered) {
+          throw new Error("receiver did not recover");
+        }
+
+        root.append_alert({ type: "success", msg: "Failsafe test passed!" });
+      } catch (err) {
+        if (err instanceof FailsafeArmedError) {
+          result.armed_in_failsafe = true;
+        }
+        Log.warn("failsafe", err);
+        root.append_alert({
+          type: "danger",
+          msg: "Failsafe test failed! " + err,
+        });
+      } finally {
+        this.result = result;
+        this.phase = FailsafeTestPhase.Idle;
+        this.props_off = false;
+      }
+      return result;
+    },
+    cancel_test() {
+      this.phase = FailsafeTestPhase.Idle;
+    },
+  },
+});
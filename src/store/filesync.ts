@@ -0,0 +1,96 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { serial } from "./serial/serial";
+import { QuicVal } from "./serial/quic";
+import { useAuditStore } from "./audit";
+import { useProfileStore } from "./profile";
+import { diffObjects, setPath } from "./util/diff";
+import { FileWatcher } from "./util/filewatch";
+import { parseProfileText, profileFormat } from "./util/profilefile";
+import { blockingViolations, ProfileValidationError } from "./util/validate";
+
+let watcher: FileWatcher | undefined;
+
+// fields the board owns, a stale copy in the file must not roll them back
+function isSyncedPath(path: string) {
+  return !path.startsWith("meta.") && path != "semver";
+}
+
+export const useFileSyncStore = defineStore("filesync", {
+  state: () => ({
+    active: false,
+    name: "",
+    last_sync: 0,
+    last_changes: [] as string[],
+    error: "",
+  }),
+  actions: {
+    async start() {
+      const [handle] = await (window as any).showOpenFilePicker({
+        types: [
+          {
+            description: "Profile",
+            accept: {
+              "text/yaml": [".yaml", ".yml"],
+              "application/json": [".json"],
+            },
+          },
+        ],
+        excludeAcceptAllOption: true,
+        multiple: false,
+      });
+
+      this.stop();
+      watcher = new FileWatcher(handle, (text) => this.sync(text));
+      this.name = watcher.name;
+      this.active = true;
+      this.error = "";
+      await watcher.start();
+    },
+    stop() {
+      watcher?.stop();
+      watcher = undefined;
+      this.active = false;
+    },
+    // only fields that differ from the board are written, so edits made in
+    // the configurator to fields the file leaves out survive a sync
+    async sync(text: string) {
+      const profile = useProfileStore();
+      try {
+        const file = parseProfileText(text, profileFormat(this.name));
+        if (!file || typeof file !== "object") {
+          throw new Error("file does not contain a profile");
+        }
+
+        const current = await serial.get(QuicVal.Profile);
+        const changes = diffObjects(current, file).filter(
+          (e) => e.rhs !== undefined && isSyncedPath(e.path)
+        );
+        if (!changes.length) {
+          this.error = "";
+          return;
+        }
+        for (const e of changes) {
+          setPath(current, e.path, e.rhs);
+        }
+
+        const violations = blockingViolations(profile.validate(current));
+        if (violations.length) {
+          throw new ProfileValidationError(violations);
+        }
+
+        const paths = changes.map((e) => e.path);
+        Log.info("filesync", "pushing", paths);
+        await useAuditStore().with_source("file-sync", () =>
+          profile.apply_profile(current)
+        );
+        this.last_sync = Math.floor(Date.now() / 1000);
+        this.last_changes = paths;
+        this.error = "";
+      } catch (err: any) {
+        Log.warn("filesync", "sync failed", err);
+        this.error = err.message || String(err);
+      }
+    },
+  },
+});
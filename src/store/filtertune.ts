@@ -0,0 +1,87 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { useAuditStore } from "./audit";
+import { useBlackboxStore } from "./blackbox";
+import { useProfileStore } from "./profile";
+import type { profile_filter_t } from "./types";
+import { asyncDelay } from "./util";
+import { cacheGet, cacheSet } from "./util/cache";
+import {
+  applyFilterSuggestion,
+  gyroSpectrum,
+  suggestFilters,
+  type CraftSpec,
+  type FilterSuggestion,
+  type GyroSpectrum,
+} from "./util/filtertune";
+
+const CRAFT_CACHE_KEY = "filter-tune/craft";
+
+const CAPTURE_DURATION = 3000;
+const MIN_CAPTURE_SAMPLES = 64;
+
+export const useFilterTuneStore = defineStore("filtertune", {
+  state: () => ({
+    craft: cacheGet<CraftSpec>(CRAFT_CACHE_KEY) || {
+      motor_kv: 2300,
+      prop_inch: 5,
+      cells: 4,
+    },
+    capturing: false,
+    spectrum: null as GyroSpectrum | null,
+    suggestion: null as FilterSuggestion | null,
+  }),
+  actions: {
+    set_craft(craft: CraftSpec) {
+      this.craft = craft;
+      cacheSet(CRAFT_CACHE_KEY, craft);
+    },
+    // needs the blackbox streaming raw gyro, e.g. while hovering tethered
+    async capture(duration = CAPTURE_DURATION) {
+      const samples: number[][] = [];
+      const times: number[] = [];
+      const unsubscribe = useBlackboxStore().subscribe_frames((f) => {
+        if (f.gyro_raw) {
+          samples.push(f.gyro_raw);
+          times.push(f.time);
+        }
+      });
+
+      this.capturing = true;
+      try {
+        await asyncDelay(duration);
+      } finally {
+        unsubscribe();
+        this.capturing = false;
+      }
+
+      if (samples.length < MIN_CAPTURE_SAMPLES) {
+        throw new Error("not enough gyro samples, is the blackbox streaming?");
+      }
+
+      // frame time is in us
+      const span = (times[times.length - 1] - times[0]) / 1e6;
+      const sample_rate = (samples.length - 1) / span;
+      Log.info("filtertune", "captured", samples.length, "at", sample_rate);
+
+      this.spectrum = gyroSpectrum(samples, sample_rate);
+      this.suggestion = suggestFilters(this.spectrum, this.craft);
+      return this.suggestion;
+    },
+    async apply_suggestion() {
+      const profile = useProfileStore();
+      if (!this.suggestion) {
+        return;
+      }
+
+      profile.filter = applyFilterSuggestion(
+        profile.filter as profile_filter_t,
+        this.suggestion
+      );
+      await useAuditStore().with_source("filter-tune", () =>
+        profile.apply_profile(profile.$state)
+      );
+      this.suggestion = null;
+    },
+  },
+});
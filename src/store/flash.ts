@@ -2,6 +2,7 @@ import YAML from "yaml";
 import { defineStore } from "pinia";
 import { github } from "./util/github";
 import { CBOR } from "./serial/cbor";
+import { firmware } from "./flash/firmware";
 
 export interface RuntimeTarget {
   name: string;
@@ -31,7 +32,7 @@ export const useFlashStore = defineStore("flash", {
         });
     },
     fetchReleases() {
-      return github.fetchReleases().then((r) => (this.releases = r));
+      return firmware.fetchReleases(true).then((r) => (this.releases = r));
     },
     fetchBranches() {
       return github.fetchBranches().then((b) => (this.branches = b));
@@ -54,7 +55,7 @@ export const useFlashStore = defineStore("flash", {
           break;
       }
     },
-    fetchRuntimeConfig(target: string) {
+    fetchTargetConfig(target: string) {
       return fetch(TARGET_URL + target + ".yaml")
         .then((res) => {
           if (!res.ok) {
@@ -62,8 +63,12 @@ export const useFlashStore = defineStore("flash", {
           }
           return res.text();
         })
-        .then((res) => YAML.parse(res))
-        .then((target) => CBOR.encode(target));
+        .then((res) => YAML.parse(res));
+    },
+    fetchRuntimeConfig(target: string) {
+      return this.fetchTargetConfig(target).then((target) =>
+        CBOR.encode(target)
+      );
     },
   },
 });
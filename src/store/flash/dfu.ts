@@ -1,6 +1,6 @@
 import { Log } from "@/log";
 import type { FlashProgressCallback } from "./flash";
-import type { IntelHEX } from "./ihex";
+import { FLASH_BASE, type IntelHEX } from "./ihex";
 import { asyncDelay } from "../util";
 
 enum DFURequest {
@@ -485,11 +485,15 @@ export class DFU {
 
     Log.info("flash", "Executing local chip erase", erase_pages);
 
+    const erase_total = erase_pages.reduce(
+      (p, c) => p + flash_layout.sectors[c.sector].page_size,
+      0
+    );
     let erase_progress = 0;
 
     for (const erase_page of erase_pages) {
-      erase_progress++;
-      this.progress("erase", erase_progress, erase_pages.length);
+      erase_progress += flash_layout.sectors[erase_page.sector].page_size;
+      this.progress("erase", erase_progress, erase_total);
 
       const page_addr =
         erase_page.page * flash_layout.sectors[erase_page.sector].page_size +
@@ -593,7 +597,7 @@ export class DFU {
 
         this.progress("write", bytes_flashed_total, bytes_total);
 
-        this.controlTransferOut(DFURequest.DNLOAD, wBlockNum++, 0, [
+        await this.controlTransferOut(DFURequest.DNLOAD, wBlockNum++, 0, [
           ...data_to_flash,
         ]);
 
@@ -678,7 +682,7 @@ export class DFU {
 
   private async leave(hex?: IntelHEX) {
     Log.info("flash", "Leaving dfu...");
-    const address = hex?.segments[0]?.address || 0x08000000;
+    const address = hex?.segments[0]?.address || FLASH_BASE;
 
     await this.clearStatus();
     await this.loadAddress(address);
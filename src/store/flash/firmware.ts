@@ -0,0 +1,192 @@
+import semver from "semver";
+import { Log } from "@/log";
+import { github } from "../util/github";
+import type { target_info_t } from "../types";
+
+const CACHE_NAME = "firmware";
+
+export class ChecksumMismatchError extends Error {
+  constructor(
+    public asset: string,
+    public expected: string,
+    public actual: string
+  ) {
+    super(`checksum mismatch for ${asset}`);
+  }
+}
+
+export class UnverifiedFirmwareError extends Error {
+  constructor(public asset: string) {
+    super(`no checksum published for ${asset}`);
+  }
+}
+
+export interface FetchAssetOptions {
+  // only after the user explicitly agreed to flash an unverified image
+  allowUnverified?: boolean;
+}
+
+export async function sha256(data: Uint8Array) {
+  const digest = await crypto.subtle.digest("SHA-256", data);
+  return Array.from(new Uint8Array(digest))
+    .map((b) => b.toString(16).padStart(2, "0"))
+    .join("");
+}
+
+// runtime targets ship one image per mcu, legacy releases one per target
+export function matchAsset(assets: any[], info: target_info_t) {
+  const images = assets
+    .filter((a) => a.name.endsWith(".hex"))
+    .sort((a, b) => a.name.length - b.name.length);
+
+  const name = info.target_name.toLowerCase();
+  const byName = images.find(
+    (a) => a.name.toLowerCase() == `quicksilver.${name}.hex`
+  );
+  if (byName) {
+    return byName;
+  }
+  const mcu = info.mcu.toLowerCase();
+  return images.find((a) => a.name.toLowerCase().includes(mcu));
+}
+
+export class FirmwareManager {
+  private releases?: { [tag: string]: any[] };
+
+  public async fetchReleases(force = false) {
+    if (!this.releases || force) {
+      this.releases = await github.fetchReleases();
+    }
+    return this.releases!;
+  }
+
+  public async listVersions(prerelease = false) {
+    const releases = await this.fetchReleases();
+    return Object.keys(releases)
+      .filter((v) => semver.valid(v))
+      .filter((v) => prerelease || !semver.prerelease(v))
+      .sort((a, b) => semver.rcompare(a, b));
+  }
+
+  public async findAsset(version: string, info: target_info_t) {
+    const releases = await this.fetchReleases();
+    const assets = releases[version];
+    if (!assets) {
+      throw new Error("release " + version + " not found");
+    }
+    const asset = matchAsset(assets, info);
+    if (!asset) {
+      throw new Error(`no firmware for ${info.target_name} in ${version}`);
+    }
+    return asset;
+  }
+
+  public async fetch(
+    version: string,
+    info: target_info_t,
+    opts: FetchAssetOptions = {}
+  ) {
+    const asset = await this.findAsset(version, info);
+    return this.fetchAsset(asset, this.releases![version], opts);
+  }
+
+  public async fetchAsset(
+    asset: any,
+    siblings: any[] = [],
+    opts: FetchAssetOptions = {}
+  ) {
+    const expected = await this.expectedChecksum(asset, siblings);
+    if (!expected) {
+      if (!opts.allowUnverified) {
+        throw new UnverifiedFirmwareError(asset.name);
+      }
+      Log.warn("flash", "flashing unverified", asset.name);
+    }
+
+    const cached = await this.readCache(asset);
+    if (cached) {
+      const actual = await sha256(cached);
+      if (!expected || actual == expected) {
+        Log.info("flash", "using cached", asset.name);
+        return new TextDecoder().decode(cached);
+      }
+      Log.warn("flash", "dropping stale cache entry", asset.name);
+      await this.deleteCache(asset);
+    }
+
+    const res = await github.fetchAsset(asset);
+    if (!res.ok) {
+      throw new Error("download of " + asset.name + " failed");
+    }
+    const data = new Uint8Array(await res.arrayBuffer());
+    if (expected) {
+      const actual = await sha256(data);
+      if (actual != expected) {
+        throw new ChecksumMismatchError(asset.name, expected, actual);
+      }
+    }
+
+    await this.writeCache(asset, data);
+    return new TextDecoder().decode(data);
+  }
+
+  public async clearCache() {
+    if (typeof caches !== "undefined") {
+      await caches.delete(CACHE_NAME);
+    }
+  }
+
+  // github reports "sha256:<hex>" digests on newer assets,
+  // older releases may carry a <name>.sha256 file next to the image
+  private async expectedChecksum(asset: any, siblings: any[]) {
+    if (typeof asset.digest == "string" && asset.digest.startsWith("sha256:")) {
+      return asset.digest.slice(7).toLowerCase();
+    }
+
+    const sum = siblings.find((a) => a.name == asset.name + ".sha256");
+    if (!sum) {
+      return undefined;
+    }
+    const res = await github.fetchAsset(sum);
+    if (!res.ok) {
+      return undefined;
+    }
+    const [hash] = (await res.text()).trim().split(/\s+/);
+    return hash.toLowerCase();
+  }
+
+  private cacheKey(asset: any) {
+    return asset.browser_download_url || String(asset.id);
+  }
+
+  private async readCache(asset: any) {
+    if (typeof caches === "undefined") {
+      return undefined;
+    }
+    const cache = await caches.open(CACHE_NAME);
+    const res = await cache.match(this.cacheKey(asset));
+    if (!res) {
+      return undefined;
+    }
+    return new Uint8Array(await res.arrayBuffer());
+  }
+
+  private async writeCache(asset: any, data: Uint8Array) {
+    if (typeof caches === "undefined") {
+      return;
+    }
+    try {
+      const cache = await caches.open(CACHE_NAME);
+      await cache.put(this.cacheKey(asset), new Response(data));
+    } catch (err) {
+      Log.warn("flash", "caching firmware failed", err);
+    }
+  }
+
+  private async deleteCache(asset: any) {
+    const cache = await caches.open(CACHE_NAME);
+    await cache.delete(this.cacheKey(asset));
+  }
+}
+
+export const firmware = new FirmwareManager();
@@ -1,19 +1,92 @@
 import { DFU } from "./dfu";
 import { IntelHEX } from "./ihex";
+import { Log } from "@/log";
 
 const USB_DEVICE_FILTER: USBDeviceFilter[] = [
   { vendorId: 0x0483, productId: 0xdf11 },
   { vendorId: 0x2e3c, productId: 0xdf11 },
 ];
 
+export const BOOTLOADER_TIMEOUT = 10_000;
+
+export class BootloaderError extends Error {
+  constructor(public cause?: any) {
+    super(
+      "board did not enter the bootloader, " +
+        "hold the boot button while plugging it in and flash again"
+    );
+  }
+}
+
+// the board left the firmware, but webusb only lists devices the user
+// granted before and a chooser needs a fresh click
+export class DfuNotGrantedError extends Error {
+  constructor(public cause?: any) {
+    super(
+      "the board is in the bootloader but its dfu device was not " +
+        "selected, flash again and select it"
+    );
+  }
+}
+
+export interface FlashOptions {
+  device?: USBDevice;
+  // jumps a board running firmware into dfu and resolves the new device
+  enterBootloader?: (timeout: number) => Promise<USBDevice>;
+  timeout?: number;
+  onProgress?: FlashProgressCallback;
+}
+
+export function isDFUDevice(device: USBDevice) {
+  return USB_DEVICE_FILTER.some(
+    (f) => f.vendorId == device.vendorId && f.productId == device.productId
+  );
+}
+
+export function requestDFUDevice() {
+  return navigator.usb.requestDevice({
+    filters: USB_DEVICE_FILTER,
+  });
+}
+
+export type FlashPhase = "erase" | "write" | "verify";
+
+// current and total are in bytes for every dfu phase, eta in milliseconds
 export interface FlashProgress {
-  task: string;
+  task: FlashPhase | string;
   current: number;
   total: number;
+  eta?: number;
 }
 
 export type FlashProgressCallback = (p: FlashProgress) => void;
 
+export class FlashProgressTracker {
+  private started: { [task: string]: number } = {};
+
+  constructor(private cb: FlashProgressCallback) {}
+
+  public update(p: FlashProgress) {
+    const now = Date.now();
+    if (this.started[p.task] === undefined) {
+      this.started[p.task] = now;
+    }
+
+    let eta: number | undefined = undefined;
+    const elapsed = now - this.started[p.task];
+    if (p.current >= p.total) {
+      eta = 0;
+    } else if (p.current > 0 && elapsed > 0) {
+      eta = Math.round((elapsed / p.current) * (p.total - p.current));
+    }
+    this.cb({ ...p, eta });
+  }
+
+  public reset() {
+    this.started = {};
+  }
+}
+
 export class Flasher {
   private device?: USBDevice;
   private progressCallback?: FlashProgressCallback;
@@ -22,10 +95,21 @@ export class Flasher {
     this.progressCallback = cb;
   }
 
-  public async connect() {
-    this.device = await navigator.usb.requestDevice({
-      filters: USB_DEVICE_FILTER,
-    });
+  public static async detect() {
+    const devices = await navigator.usb.getDevices();
+    return devices.filter(isDFUDevice);
+  }
+
+  public static async pick() {
+    const [paired] = await Flasher.detect();
+    if (paired) {
+      return paired;
+    }
+    return requestDFUDevice();
+  }
+
+  public async connect(device?: USBDevice) {
+    this.device = device || (await Flasher.pick());
   }
 
   public async flash(hex: IntelHEX) {
@@ -34,14 +118,40 @@ export class Flasher {
     }
 
     const dfu = new DFU(this.device);
-    dfu.onProgress((p) => {
+    const tracker = new FlashProgressTracker((p) => {
       if (this.progressCallback) {
         this.progressCallback(p);
       }
     });
+    dfu.onProgress((p) => tracker.update(p));
 
     await dfu.open();
-    await dfu.flash(hex);
-    await dfu.close();
+    try {
+      await dfu.flash(hex);
+    } finally {
+      await dfu.close();
+    }
+  }
+}
+
+export async function flashFirmware(image: IntelHEX, opts: FlashOptions = {}) {
+  let device = opts.device;
+  if (!device && opts.enterBootloader) {
+    try {
+      device = await opts.enterBootloader(opts.timeout || BOOTLOADER_TIMEOUT);
+    } catch (err) {
+      Log.warn("flash", "bootloader entry failed", err);
+      if (err instanceof DfuNotGrantedError) {
+        throw err;
+      }
+      throw new BootloaderError(err);
+    }
+  }
+
+  const flasher = new Flasher();
+  if (opts.onProgress) {
+    flasher.onProgress(opts.onProgress);
   }
+  await flasher.connect(device);
+  await flasher.flash(image);
 }
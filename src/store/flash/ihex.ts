@@ -9,6 +9,8 @@ enum Record {
   START_LINEAR_ADDR = 5,
 }
 
+export const FLASH_BASE = 0x08000000;
+
 const CONFIG_MAGIC = new Uint8Array([0x01, 0x00, 0xaa, 0x12]);
 
 export const ConfigOffsets = {
@@ -84,6 +86,16 @@ export class IntelHEX {
     }
   }
 
+  // raw .bin images carry no addresses, assume they start at the flash base
+  public static fromBinary(data: Uint8Array, address = FLASH_BASE): IntelHEX {
+    if (!data.byteLength) {
+      throw new Error("empty firmware image");
+    }
+    const result = new IntelHEX(address, 0);
+    result.segments.push({ address, data: data.slice() });
+    return result;
+  }
+
   public static parse(data: string): IntelHEX {
     let eofReached = false;
     let highAddr = 0;
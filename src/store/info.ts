@@ -2,14 +2,49 @@ import { useStateStore } from "./state";
 import semver from "semver";
 import { decodeSemver } from "@/store/util";
 import { defineStore } from "pinia";
-import type { target_info_t } from "./types";
+import type { target_info_t, target_t } from "./types";
 import { $enum } from "ts-enum-util";
 import { useConstantStore } from "./constants";
+import { useSerialStore } from "./serial";
+import { useFlashStore } from "./flash";
+import { useTargetStore } from "./target";
+import { cacheGet, cacheSet, deviceKey } from "./util/cache";
+import { serial } from "./serial/serial";
+import type { QuicVal } from "./serial/quic";
+
+export interface target_info_extended_t {
+  manufacturer?: string;
+  runtime_target?: string;
+  default_gyro_orientation?: number;
+  quirks: string[];
+}
 
 export interface local_target_info_t extends target_info_t {
   quic_protocol_semver: string;
   rx_protocol?: number;
   gyro_name: string;
+  extended?: target_info_extended_t;
+  supported_values?: QuicVal[];
+}
+
+function targetQuirks(target: target_t): string[] {
+  const quirks: string[] = [];
+  if (!target.brushless) {
+    quirks.push("brushed motors");
+  }
+  if (!target.flash && !target.sdcard) {
+    quirks.push("no blackbox storage");
+  }
+  if (!target.osd) {
+    quirks.push("no analog osd");
+  }
+  if (!target.vbat) {
+    quirks.push("no voltage sensor");
+  }
+  if (!target.ibat) {
+    quirks.push("no current sensor");
+  }
+  return quirks;
 }
 
 export const useInfoStore = defineStore("info", {
@@ -29,6 +64,9 @@ export const useInfoStore = defineStore("info", {
     rx_protocol: 0,
     rx_protocols: [],
     features: 0,
+
+    extended: undefined,
+    supported_values: undefined,
   }),
   getters: {
     has_feature(state) {
@@ -39,6 +77,14 @@ export const useInfoStore = defineStore("info", {
         return state.features & feature;
       };
     },
+    has_value(state) {
+      return (value: QuicVal) => {
+        if (state.supported_values == undefined) {
+          return true;
+        }
+        return state.supported_values.includes(value);
+      };
+    },
     quicVersionGt(state) {
       return (version) => {
         return semver.gt(state.quic_protocol_semver, version);
@@ -51,7 +97,12 @@ export const useInfoStore = defineStore("info", {
     },
     is_read_only(state) {
       const fwstate = useStateStore();
-      return state.quic_protocol_version < 5 || fwstate.failloop > 0;
+      const serial = useSerialStore();
+      return (
+        state.quic_protocol_version < 5 ||
+        fwstate.failloop > 0 ||
+        !serial.writes_enabled
+      );
     },
   },
   actions: {
@@ -64,5 +115,40 @@ export const useInfoStore = defineStore("info", {
       const constants = useConstantStore();
       this.gyro_name = $enum(constants.GyroType).getKeys()[this.gyro_id];
     },
+    async fetch_supported_values() {
+      this.supported_values = await serial.listValues();
+    },
+    async fetch_extended() {
+      const key = "extended/" + deviceKey(this.$state);
+      const cached = cacheGet(key);
+      if (cached) {
+        this.extended = cached;
+        return;
+      }
+
+      const flash = useFlashStore();
+      const target = useTargetStore();
+      if (flash.targets.length == 0) {
+        await flash.fetchTargets();
+      }
+
+      const name = (target.name || this.target_name).toLowerCase();
+      const entry = flash.targets.find(
+        (t) => t.target.toLowerCase() == name || t.name.toLowerCase() == name
+      );
+
+      const extended: target_info_extended_t = {
+        quirks: targetQuirks(target.$state),
+      };
+      if (entry) {
+        const config = await flash.fetchTargetConfig(entry.target);
+        extended.manufacturer = flash.manufacturers[entry.manufacturer]?.name;
+        extended.runtime_target = entry.target;
+        extended.default_gyro_orientation = config.gyro_orientation;
+      }
+
+      this.extended = extended;
+      cacheSet(key, extended);
+    },
   },
 });
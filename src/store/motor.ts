@@ -4,6 +4,12 @@ import { Log } from "@/log";
 import { defineStore } from "pinia";
 import { useRootStore } from "./root";
 import { useProfileStore } from "./profile";
+import { useStateStore } from "./state";
+
+// stop spinning motors if the test has not been touched for this long
+const MOTOR_TEST_TIMEOUT = 15_000;
+
+let testTimer: any = null;
 
 export const useMotorStore = defineStore("motor", {
   state: () => ({
@@ -97,8 +103,28 @@ export const useMotorStore = defineStore("motor", {
           this.loading = false;
         });
     },
+    motor_interlock_engaged() {
+      const root = useRootStore();
+      const state = useStateStore();
+
+      let msg: string | undefined = undefined;
+      if (state.is_armed) {
+        msg = "Motor test is not allowed while armed!";
+      } else if (state.failloop > 0) {
+        msg = "Motor test is not allowed during a failloop!";
+      }
+      if (msg) {
+        root.append_alert({ type: "danger", msg });
+        return true;
+      }
+      return false;
+    },
     async motor_test_toggle() {
       await this.fetch_motor_test();
+      if (!this.test.active && this.motor_interlock_engaged()) {
+        return;
+      }
+      clearTimeout(testTimer);
       return serial
         .command(
           QuicCmd.Motor,
@@ -108,12 +134,37 @@ export const useMotorStore = defineStore("motor", {
           this.test.active = this.test.active ? 0 : 1;
         });
     },
-    motor_test_set_value(value) {
+    motor_test_set_value(value: number[]) {
+      const spinning = value.some((v) => v > 0);
+      if (spinning && this.motor_interlock_engaged()) {
+        return Promise.resolve();
+      }
+
+      clearTimeout(testTimer);
+      if (spinning) {
+        testTimer = setTimeout(() => {
+          Log.warn("motor", "motor test timed out, stopping motors");
+          this.motor_test_stop_all();
+        }, MOTOR_TEST_TIMEOUT);
+      }
+
       return serial
         .command(QuicCmd.Motor, QuicMotor.TestSetValue, value)
         .then((p) => {
           this.test.value = p.payload[0];
         });
     },
+    motor_test_spin(index: number, throttle: number) {
+      const value = [...this.test.value];
+      value[index] = throttle;
+      return this.motor_test_set_value(value);
+    },
+    motor_test_stop_all() {
+      clearTimeout(testTimer);
+      if (!this.test.active) {
+        return Promise.resolve();
+      }
+      return this.motor_test_set_value(this.test.value.map(() => 0));
+    },
   },
 });
@@ -2,18 +2,32 @@ import { serial } from "./serial/serial";
 import { QuicCmd, QuicOSD, QuicVal } from "./serial/quic";
 import { defineStore } from "pinia";
 import { OSD } from "./util/osd";
-import { useInfoStore } from "./info";
+import { Log } from "@/log";
+
+const OSD_WRITE_ATTEMPTS = 2;
+
+function charEqual(a: ArrayLike<number>, b: ArrayLike<number>) {
+  if (!a || a.length < b.length) {
+    return false;
+  }
+  for (let i = 0; i < b.length; i++) {
+    if (a[i] != b[i]) {
+      return false;
+    }
+  }
+  return true;
+}
 
 export const useOSDStore = defineStore("osd", {
   state: () => ({
     font_raw: undefined as number[][] | undefined,
     font_bitmap: undefined as ImageBitmap | undefined,
     font_bitmap_inverted: undefined as ImageBitmap | undefined,
+    upload_progress: undefined as number | undefined,
   }),
   actions: {
     async fetch_sd_osd_font() {
-      const info = useInfoStore();
-      if (!info.quicVersionGte("0.2.0")) {
+      if (!serial.supports(QuicCmd.OSD)) {
         return serial.get(QuicVal.OSDFont).then((font) => {
           this.font_raw = font;
           this.font_bitmap = OSD.unpackFontBitmap(font);
@@ -31,14 +45,31 @@ export const useOSDStore = defineStore("osd", {
       this.font_bitmap_inverted = OSD.unpackFontBitmap(font, true);
     },
     async apply_font(font: Uint8Array[]) {
-      const info = useInfoStore();
-      if (!info.quicVersionGte("0.2.0")) {
+      if (!serial.supports(QuicCmd.OSD)) {
         return serial.set(QuicVal.OSDFont, ...font);
       }
 
-      for (let i = 0; i < 256; i++) {
-        await serial.command(QuicCmd.OSD, QuicOSD.WriteChar, i, font[i]);
+      this.upload_progress = 0;
+      try {
+        for (let i = 0; i < OSD.FONT_CHARS; i++) {
+          await this.write_char(i, font[i]);
+          this.upload_progress = (i + 1) / OSD.FONT_CHARS;
+        }
+      } finally {
+        this.upload_progress = undefined;
+      }
+    },
+    async write_char(index: number, char: Uint8Array) {
+      for (let attempt = 0; attempt < OSD_WRITE_ATTEMPTS; attempt++) {
+        await serial.command(QuicCmd.OSD, QuicOSD.WriteChar, index, char);
+
+        const res = await serial.command(QuicCmd.OSD, QuicOSD.ReadChar, index);
+        if (charEqual(res.payload[0], char)) {
+          return;
+        }
+        Log.warn("osd", `char ${index} verify mismatch`);
       }
+      throw new Error(`Font verify failed at char ${index}`);
     },
     fetch_hd_osd_font() {
       return new Promise((resolve, reject) => {
@@ -6,8 +6,69 @@ import { Log } from "@/log";
 import semver from "semver";
 import { decodeSemver } from "./util";
 import { useRootStore } from "./root";
-import type { target_t } from "./types";
 import { useTargetStore } from "./target";
+import { useDevicesStore } from "./devices";
+import { useInfoStore } from "./info";
+import { runMigrations } from "./util/migrations";
+import {
+  blockingViolations,
+  ProfileValidationError,
+  validateProfile,
+  type ValidationContext,
+} from "./util/validate";
+import {
+  applyMergePatch,
+  cloneDeep,
+  diffObjects,
+  flattenObject,
+  getPath,
+  setPath,
+} from "./util/diff";
+import { encodeCSV } from "./util/csv";
+import { fieldUnit } from "./util/fields";
+import { profileHash } from "./util/hash";
+import { knownTargets, portingTable, portProfile } from "./util/porting";
+import { rateCurves } from "./util/rates";
+import { importBetaflightDiff } from "./util/bfdiff";
+import {
+  applySchemaDefaults,
+  hasFeature,
+  resolveSchema,
+  type ProfileSchema,
+  type SchemaFeature,
+} from "./util/schema";
+import {
+  applyCliDiff,
+  diffProfile,
+  formatCliDiff,
+  formatProfileDiff,
+  parseCliDiff,
+  parseCliHeader,
+} from "./util/profilediff";
+import {
+  applyPidPreset,
+  findPidPreset,
+  type CraftClass,
+} from "./util/pidpresets";
+
+export const ProfileSections = {
+  rates: { title: "Rates", paths: ["rate"] },
+  pids: { title: "PIDs", paths: ["pid"] },
+  filters: { title: "Filters", paths: ["filter"] },
+  osd: { title: "OSD", paths: ["osd"] },
+  voltage: { title: "Voltage", paths: ["voltage"] },
+  blackbox: { title: "Blackbox", paths: ["blackbox"] },
+};
+
+export type ProfileSection = keyof typeof ProfileSections;
+
+// board specific values measured on the craft rather than tuned
+const CalibrationPaths = [
+  "receiver.stick_calibration_limits",
+  "voltage.vbat_scale",
+  "voltage.ibat_scale",
+  "motor.gyro_orientation",
+];
 
 export function mergeDeep(target, source) {
   for (const [key, val] of Object.entries(source)) {
@@ -36,66 +97,24 @@ function ensureMinVersion(version): number {
   return version;
 }
 
-function migrateProfileVersion(
-  profile,
-  target: target_t,
-  profileVersion: string,
-  firmwareVersion: string
-) {
-  if (semver.eq(profileVersion, "v0.1.0")) {
-    const silverware = {
-      mode: 0,
-      rate: [
-        profile.rate.silverware?.max_rate || [860, 860, 500],
-        profile.rate.silverware?.acro_expo || [0.8, 0.8, 0.6],
-        profile.rate.silverware?.angle_expo || [0.55, 0, 0.55],
-      ],
-    };
-    const betaflight = {
-      mode: 1,
-      rate: [
-        profile.rate.betaflight?.rc_rate || [1.3, 1.3, 1.3],
-        profile.rate.betaflight?.super_rate || [0.7, 0.7, 0.7],
-        profile.rate.betaflight?.expo || [0.4, 0.4, 0.4],
-      ],
-    };
-
-    profile.rate.profile = 0;
-
-    if (profile.rate.mode == 0) {
-      profile.rate.rates = [silverware, betaflight];
-    } else {
-      profile.rate.rates = [betaflight, silverware];
-    }
-  }
-
-  if (
-    semver.lt(profileVersion, "v0.2.2") &&
-    semver.gte(firmwareVersion, "v0.2.2")
-  ) {
-    const serial_ports = target.serial_ports.filter((p) => p.index != 0);
-    for (const key of Object.keys(profile.serial)) {
-      if (profile.serial[key] == 0) {
-        continue;
-      }
-      if (profile.serial[key] <= serial_ports.length) {
-        profile.serial[key] = serial_ports[profile.serial[key] - 1].index;
-      } else {
-        profile.serial[key] = profile.serial[key] - serial_ports.length + 100;
-      }
-    }
-  }
-
+function cleanupProfile(profile) {
   if (profile.meta.name) {
     profile.meta.name = profile.meta.name.replace(/\0/g, "");
   }
   if (profile.osd?.callsign) {
     profile.osd.callsign = profile.osd.callsign.replace(/\0/g, "");
   }
-
   return profile;
 }
 
+function validationContext(): ValidationContext {
+  const pins = useTargetStore().motor_pin_names;
+  return {
+    motorPinCount: pins.length || undefined,
+    schema: useDefaultProfileStore().schema,
+  };
+}
+
 function migrateProfile(profile) {
   const target = useTargetStore();
   const default_profile = useDefaultProfileStore();
@@ -103,18 +122,21 @@ function migrateProfile(profile) {
   const firmwareVersion = ensureMinVersion(default_profile?.meta?.version);
   const profileVersion = ensureMinVersion(profile?.meta?.version);
 
-  let p = JSON.parse(JSON.stringify(profile));
+  let p = cloneDeep(profile);
   if (!p.meta) {
     p.meta = {};
   }
   if (firmwareVersion != profileVersion) {
-    p = migrateProfileVersion(
-      p,
-      target.$state,
-      decodeSemver(profileVersion),
-      decodeSemver(firmwareVersion)
-    );
+    p = runMigrations(p, {
+      target: target.$state,
+      info: useInfoStore().$state,
+      from: decodeSemver(profileVersion),
+      to: decodeSemver(firmwareVersion),
+    });
+    p = applySchemaDefaults(p, default_profile.schema);
+    p.meta.version = firmwareVersion;
   }
+  p = cleanupProfile(p);
 
   p.meta.datetime = Math.floor(Date.now() / 1000);
 
@@ -190,6 +212,55 @@ export const useProfileStore = defineStore("profile", {
     current_stick_rate: (state) => {
       return state.pid.stick_rates[state.pid.stick_profile];
     },
+    // sampled curves of the active rate profile, with the sticks deadband
+    rate_curves(state) {
+      return (steps?: number) => {
+        const rate = state.rate.rates[state.rate.profile];
+        if (!rate) {
+          return [];
+        }
+        return rateCurves(rate, {
+          steps,
+          deadband: state.rate.sticks_deadband,
+        });
+      };
+    },
+    diff_sections(state) {
+      return (source, sections: ProfileSection[]) => {
+        const lhs = migrateProfile(state);
+        const rhs = migrateProfile(source);
+        return sections
+          .flatMap((s) => ProfileSections[s].paths)
+          .flatMap((path) =>
+            diffObjects(getPath(lhs, path), getPath(rhs, path), path)
+          );
+      };
+    },
+    csv(state) {
+      const default_profile = useDefaultProfileStore();
+      const rows = flattenObject(state)
+        .filter(([path]) => path != "semver")
+        .map(([path, value]) => [
+          path,
+          value,
+          fieldUnit(path),
+          getPath(default_profile.$state, path),
+        ]);
+      return encodeCSV(["path", "value", "unit", "default"], rows);
+    },
+    default_diff(state) {
+      const default_profile = useDefaultProfileStore();
+      return diffProfile(default_profile.$state, state);
+    },
+    violations(state) {
+      return validateProfile(state, validationContext());
+    },
+    schema(state): ProfileSchema {
+      return resolveSchema(state.semver);
+    },
+    has_schema_feature() {
+      return (feature: SchemaFeature) => hasFeature(this.schema, feature);
+    },
     profileVersionGt(state) {
       return (version) => {
         return semver.gt(state.semver, version);
@@ -210,6 +281,14 @@ export const useProfileStore = defineStore("profile", {
         pid_rates: rates,
       };
     },
+    load_pid_preset(craft: CraftClass) {
+      const rate = applyPidPreset(findPidPreset(craft), {
+        voltage: this.voltage,
+        motor: this.motor,
+      });
+      this.set_current_pid_rate(rate);
+      return rate;
+    },
     set_current_stick_rate(rate) {
       const rates = [...this.pid.stick_rates];
       rates[this.pid.stick_profile] = rate;
@@ -232,10 +311,88 @@ export const useProfileStore = defineStore("profile", {
     },
 
     reset() {
-      const default_profile = useDefaultProfileStore();
-      return this.apply_profile(default_profile.$state);
+      return this.reset_to_defaults();
     },
+    // the profile set writes the defaults to flash, resolves false when
+    // applying them failed
+    async reset_to_defaults(keep_calibration = false) {
+      const defaults = await serial.get(QuicVal.DefaultProfile);
+      if (keep_calibration) {
+        const current = await serial.get(QuicVal.Profile);
+        for (const path of CalibrationPaths) {
+          const val = getPath(current, path);
+          if (val !== undefined) {
+            setPath(defaults, path, val);
+          }
+        }
+      }
+      return this.apply_profile(defaults);
+    },
+
+    // fetched fresh so the diff reflects the board, not unsaved edits
+    async fetch_default_diff() {
+      const [defaults, current] = await Promise.all([
+        serial.get(QuicVal.DefaultProfile),
+        serial.get(QuicVal.Profile),
+      ]);
+      const entries = diffProfile(defaults, current);
+      return {
+        entries,
+        text: formatProfileDiff(entries, fieldUnit),
+      };
+    },
+    async fetch_cli_diff() {
+      const info = useInfoStore();
+      const [defaults, current] = await Promise.all([
+        serial.get(QuicVal.DefaultProfile),
+        serial.get(QuicVal.Profile),
+      ]);
+      const name = current.meta.name.replace(/\0/g, "");
+      const entries = [
+        { path: "meta.name", default: "", current: name },
+        ...diffProfile(defaults, current),
+      ];
+      return formatCliDiff(entries, [
+        "quicksilver diff",
+        `target ${info.target_name}`,
+        `version ${info.git_version}`,
+      ]);
+    },
+    async import_cli_diff(text: string) {
+      const entries = parseCliDiff(text);
+      const { target } = parseCliHeader(text);
+      const info = useInfoStore();
+      if (target && target != info.target_name) {
+        Log.warn("profile", "diff is for", target);
+        useRootStore().append_alert({
+          type: "warning",
+          msg: `Diff was made on ${target}, this board is ${info.target_name}`,
+        });
+      }
 
+      const defaults = await serial.get(QuicVal.DefaultProfile);
+      return this.apply_profile(applyCliDiff(defaults, entries));
+    },
+    // adapts a profile from another board to this one, the result is
+    // returned for review rather than applied
+    async port_profile(profile, source?: string) {
+      const defaults = await serial.get(QuicVal.DefaultProfile);
+      const from = source ? knownTargets()[source] : undefined;
+      const to = portingTable(useTargetStore().$state);
+      return portProfile(migrateProfile(profile), from, to, defaults);
+    },
+    // returned for review, nothing is written yet
+    async import_betaflight_diff(text: string) {
+      const info = useInfoStore();
+      const current = migrateProfile(await serial.get(QuicVal.Profile));
+      const vtx = info.has_value(QuicVal.VtxSettings)
+        ? await serial.get(QuicVal.VtxSettings)
+        : undefined;
+      return importBetaflightDiff(text, current, vtx);
+    },
+    async fetch_hash() {
+      return profileHash(await serial.get(QuicVal.Profile));
+    },
     fetch_profile() {
       return serial.get(QuicVal.Profile).then((p) => this.set_profile(p));
     },
@@ -247,24 +404,62 @@ export const useProfileStore = defineStore("profile", {
 
       return this.apply_profile(p);
     },
+    copy_sections(source, sections: ProfileSection[]) {
+      const rhs = migrateProfile(source);
+      const patch = {};
+      for (const path of sections.flatMap((s) => ProfileSections[s].paths)) {
+        setPath(patch, path, getPath(rhs, path));
+      }
+      return this.apply_patch(patch);
+    },
+    // patched onto our copy so unsaved edits in other sections are kept,
+    // it holds the whole profile read from the board so fields this
+    // configurator does not know about pass through untouched
+    apply_patch(patch) {
+      const current = migrateProfile(this.$state);
+      return this.apply_profile(applyMergePatch(current, patch));
+    },
+    validate(profile) {
+      return validateProfile(migrateProfile(profile), validationContext());
+    },
     apply_profile(profile) {
       const root = useRootStore();
 
       const p = migrateProfile(profile);
 
+      const violations = validateProfile(p, validationContext());
+      const blocking = blockingViolations(violations);
+      if (blocking.length) {
+        const err = new ProfileValidationError(blocking);
+        Log.warn("profile", "validation failed", blocking);
+        root.append_alert({
+          type: "danger",
+          msg: "Apply failed! " + err.message,
+        });
+        return Promise.reject(err);
+      }
+      if (violations.length) {
+        const err = new ProfileValidationError(violations);
+        Log.warn("profile", "unusual values", violations);
+        root.append_alert({ type: "warning", msg: err.message });
+      }
+
       return serial
         .set(QuicVal.Profile, p)
         .then((p) => this.set_profile(p))
+        .then(() => useDevicesStore().capture())
         .then(() =>
           root.append_alert({ type: "success", msg: "Profile applied!" })
         )
         .then(() => root.reset_needs_apply())
+        .then(() => true)
         .catch((err) => {
           Log.error(err);
           root.append_alert({
             type: "danger",
             msg: "Apply failed! " + err,
           });
+          return false;
         });
     },
   },
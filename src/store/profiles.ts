@@ -0,0 +1,105 @@
+import { defineStore } from "pinia";
+import { serial } from "./serial/serial";
+import { QuicVal } from "./serial/quic";
+import { useInfoStore } from "./info";
+import { useProfileStore } from "./profile";
+import { cloneDeep } from "./util/diff";
+import { decodeJSON, encodeJSON } from "./util/profilefile";
+
+// the firmware holds a single profile, extra banks are kept by the
+// configurator per target and swapped in on activation
+export const PROFILE_SLOT_COUNT = 4;
+
+const SLOTS_STORAGE_KEY = "profile-slots";
+
+export interface ProfileSlot {
+  index: number;
+  name: string;
+  datetime: number;
+  profile: any;
+}
+
+type SlotTable = { [target: string]: (ProfileSlot | null)[] };
+
+function loadSlots(): SlotTable {
+  try {
+    return decodeJSON(localStorage.getItem(SLOTS_STORAGE_KEY) || "{}");
+  } catch {
+    return {};
+  }
+}
+
+function checkIndex(index: number) {
+  if (!Number.isInteger(index) || index < 0 || index >= PROFILE_SLOT_COUNT) {
+    throw new Error("invalid profile slot " + index);
+  }
+}
+
+export const useProfilesStore = defineStore("profiles", {
+  state: () => ({
+    table: loadSlots(),
+    active: undefined as number | undefined,
+  }),
+  getters: {
+    slots(state): (ProfileSlot | null)[] {
+      const info = useInfoStore();
+      const slots = state.table[info.target_name] || [];
+      return Array.from({ length: PROFILE_SLOT_COUNT }, (_, i) => {
+        return slots[i] || null;
+      });
+    },
+  },
+  actions: {
+    persist() {
+      localStorage.setItem(SLOTS_STORAGE_KEY, encodeJSON(this.table));
+    },
+    set_slot(index: number, slot: ProfileSlot | null) {
+      checkIndex(index);
+      const info = useInfoStore();
+      const slots = [...this.slots];
+      slots[index] = slot;
+      this.table = { ...this.table, [info.target_name]: slots };
+      this.persist();
+    },
+    read_slot(index: number) {
+      checkIndex(index);
+      return this.slots[index];
+    },
+    async write_slot(index: number, name?: string) {
+      const profile = await serial.get(QuicVal.Profile);
+      const slot: ProfileSlot = {
+        index,
+        name: name || profile.meta.name.replace(/\0/g, ""),
+        datetime: Math.floor(Date.now() / 1000),
+        profile,
+      };
+      this.set_slot(index, slot);
+      this.active = index;
+      return slot;
+    },
+    async activate_slot(index: number) {
+      const slot = this.read_slot(index);
+      if (!slot) {
+        throw new Error("profile slot " + index + " is empty");
+      }
+      await useProfileStore().apply_profile(slot.profile);
+      this.active = index;
+    },
+    copy_slot(from: number, to: number) {
+      const slot = this.read_slot(from);
+      if (!slot) {
+        throw new Error("profile slot " + from + " is empty");
+      }
+      this.set_slot(to, {
+        ...cloneDeep(slot),
+        index: to,
+      });
+    },
+    clear_slot(index: number) {
+      this.set_slot(index, null);
+      if (this.active == index) {
+        this.active = undefined;
+      }
+    },
+  },
+});
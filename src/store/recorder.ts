@@ -0,0 +1,233 @@
+import { defineStore } from "pinia";
+import { Log } from "@/log";
+import { useBlackboxStore } from "./blackbox";
+import { useInfoStore } from "./info";
+import { useProfileStore } from "./profile";
+import { useStateStore } from "./state";
+import type { profile_t } from "./types";
+import type { BlackboxFrame } from "./blackbox";
+import { recordingToBlackbox } from "./util/blackbox";
+import { BlackboxCSVEncoder, recordingToCSV } from "./util/blackboxcsv";
+import { cacheGet, cacheSet } from "./util/cache";
+import { RingBuffer } from "./util/ringbuffer";
+import {
+  BlackboxRecorder,
+  directorySink,
+  encodeRecording,
+  parseBlackboxFile,
+  recordingEncoder,
+  recordingHeader,
+  type RecordedPart,
+  type RecordingSource,
+} from "./util/recorder";
+
+export enum RecordingFormat {
+  QUIC = "quic",
+  CSV = "csv",
+}
+
+export enum ExportFormat {
+  CSV = "csv",
+  BBL = "bbl",
+}
+
+// stats are copied off the recorder at this interval instead of per frame
+const STATS_INTERVAL = 500;
+
+const HISTORY_CACHE_KEY = "recorder/history-seconds";
+const DEFAULT_HISTORY_SECONDS = 10;
+
+// caps the history buffer, the time window trims it well before that at
+// any sane sample rate
+const MAX_HISTORY_RATE = 8000;
+
+let recorder: BlackboxRecorder | undefined;
+let unsubscribe: (() => void) | undefined;
+let statsTimer: any;
+
+let history: RingBuffer<BlackboxFrame> | undefined;
+let historyFlags = 0;
+let historyTime = 0;
+
+function historyBuffer(seconds: number) {
+  return new RingBuffer<BlackboxFrame>(
+    Math.max(1, seconds * MAX_HISTORY_RATE)
+  );
+}
+
+function recordingSource(): RecordingSource {
+  const info = useInfoStore();
+  const profile = useProfileStore();
+  return {
+    firmware: {
+      target_name: info.target_name,
+      git_version: info.git_version,
+      quic_protocol_semver: info.quic_protocol_semver,
+    },
+    field_flags: profile.blackbox.field_flags,
+    sample_rate_hz: profile.blackbox.sample_rate_hz,
+    looptime: useStateStore().looptime_autodetect,
+    profile: profile.$state,
+  };
+}
+
+function recordingName() {
+  const name = useProfileStore().meta.name.replace(/\0/g, "") || "blackbox";
+  const date = new Date().toISOString().replace(/[:.]/g, "-").substring(0, 19);
+  return `${name}_${date}`;
+}
+
+export const useRecorderStore = defineStore("recorder", {
+  state: () => ({
+    active: false,
+    format: RecordingFormat.QUIC,
+    // MB and minutes as entered, 0 disables the limit
+    max_size: 64,
+    max_duration: 10,
+    parts: [] as RecordedPart[],
+    frames: 0,
+    bytes: 0,
+    error: "",
+    // seconds of blackbox kept in memory while connected, 0 disables it
+    history_seconds:
+      cacheGet<number>(HISTORY_CACHE_KEY) ?? DEFAULT_HISTORY_SECONDS,
+  }),
+  actions: {
+    async start() {
+      const dir = await (window as any).showDirectoryPicker({
+        mode: "readwrite",
+      });
+
+      await this.stop();
+      recorder = new BlackboxRecorder(directorySink(dir), recordingSource, {
+        name: recordingName(),
+        encoder:
+          this.format == RecordingFormat.CSV
+            ? new BlackboxCSVEncoder()
+            : undefined,
+        max_bytes: this.max_size * 1024 * 1024,
+        max_duration: this.max_duration * 60 * 1000,
+      });
+      unsubscribe = useBlackboxStore().subscribe_frames((f) =>
+        recorder?.write(f)
+      );
+      statsTimer = setInterval(() => this.update_stats(), STATS_INTERVAL);
+
+      this.active = true;
+      this.error = "";
+      this.update_stats();
+      Log.info("recorder", "recording to", dir.name);
+    },
+    async stop() {
+      unsubscribe?.();
+      unsubscribe = undefined;
+      clearInterval(statsTimer);
+
+      await recorder?.stop();
+      this.update_stats();
+      recorder = undefined;
+      this.active = false;
+    },
+    // parts of one recording share a csv encoder so their time column
+    // lines up, betaflight logs are written one per part
+    async convert(files: File[], format: ExportFormat) {
+      const profile = useProfileStore();
+      const parsed = await Promise.all(
+        files.map(async (file) => ({
+          name: file.name.replace(/\.[^.]*$/, ""),
+          recording: parseBlackboxFile(await file.text()),
+        }))
+      );
+      parsed.sort(
+        (a, b) =>
+          a.recording.header.start - b.recording.header.start ||
+          a.recording.header.part - b.recording.header.part
+      );
+
+      const encoders = new Map<number, BlackboxCSVEncoder>();
+      return parsed.map(({ name, recording }) => {
+        if (format == ExportFormat.BBL) {
+          const writer = recordingToBlackbox(
+            recording,
+            profile.$state as profile_t
+          );
+          return { name: name + ".bbl", blob: writer.toBlob() };
+        }
+
+        const start = recording.header.start;
+        if (!start || !encoders.has(start)) {
+          encoders.set(start, new BlackboxCSVEncoder());
+        }
+        const csv = recordingToCSV(recording, encoders.get(start));
+        return {
+          name: name + ".csv",
+          blob: new Blob([csv], { type: "text/csv" }),
+        };
+      });
+    },
+    set_history_seconds(seconds: number) {
+      this.history_seconds = Math.max(0, seconds);
+      cacheSet(HISTORY_CACHE_KEY, this.history_seconds);
+      if (history) {
+        history = historyBuffer(this.history_seconds);
+      }
+    },
+    // keeps the last history_seconds of frames around so something that
+    // just happened can still be saved, the buffer is dropped whenever the
+    // frames stop lining up
+    watch_history() {
+      const profile = useProfileStore();
+      history = historyBuffer(this.history_seconds);
+      historyFlags = profile.blackbox.field_flags;
+      historyTime = 0;
+
+      const unsubscribe = useBlackboxStore().subscribe_frames((frame) => {
+        if (!history || !this.history_seconds) {
+          return;
+        }
+
+        const flags = profile.blackbox.field_flags;
+        if (flags != historyFlags || frame.time < historyTime) {
+          history.clear();
+          historyFlags = flags;
+        }
+
+        history.push(frame);
+        historyTime = frame.time;
+        const window = this.history_seconds * 1e6;
+        while (frame.time - (history.peek()?.time ?? frame.time) > window) {
+          history.shift();
+        }
+      });
+      return () => {
+        unsubscribe();
+        history = undefined;
+      };
+    },
+    save_history() {
+      if (!history?.length) {
+        throw new Error("no blackbox data received yet");
+      }
+
+      const header = recordingHeader(recordingSource(), 0, Date.now());
+      const encoder =
+        this.format == RecordingFormat.CSV
+          ? new BlackboxCSVEncoder()
+          : recordingEncoder;
+      const text = encodeRecording(header, history.toArray(), encoder);
+      return {
+        name: recordingName() + encoder.extension,
+        blob: new Blob([text], { type: "text/plain" }),
+      };
+    },
+    update_stats() {
+      if (!recorder) {
+        return;
+      }
+      this.parts = recorder.parts.map((p) => ({ ...p }));
+      this.frames = recorder.frames;
+      this.bytes = recorder.bytes;
+      this.error = recorder.error ? String(recorder.error) : "";
+    },
+  },
+});
@@ -2,6 +2,12 @@ import type { pid_rate_preset_t } from "./types";
 import { defineStore } from "pinia";
 import { serial } from "./serial/serial";
 import { QuicCmd, QuicVal } from "./serial/quic";
+import {
+  calibrateAccel,
+  calibrateIMU,
+  type AccelCalProgress,
+  type CalibrationProgress,
+} from "./serial/calibration";
 
 export const useRootStore = defineStore("root", {
   state: () => ({
@@ -11,6 +17,9 @@ export const useRootStore = defineStore("root", {
     alerts: [] as any[],
 
     pid_rate_presets: [] as pid_rate_preset_t[],
+
+    imu_calibration: undefined as CalibrationProgress | undefined,
+    accel_calibration: undefined as AccelCalProgress | undefined,
   }),
   actions: {
     append_alert(alert) {
@@ -48,7 +57,34 @@ export const useRootStore = defineStore("root", {
         .then((p) => (this.pid_rate_presets = p));
     },
     cal_imu() {
-      return serial.command(QuicCmd.CalImu);
+      return calibrateIMU(serial, (p) => (this.imu_calibration = p))
+        .then(() =>
+          this.append_alert({
+            type: "success",
+            msg: "IMU calibration successful!",
+          })
+        )
+        .catch(() =>
+          this.append_alert({
+            type: "danger",
+            msg: "IMU calibration failed",
+          })
+        );
+    },
+    cal_accel() {
+      return calibrateAccel(serial, (p) => (this.accel_calibration = p))
+        .then(() =>
+          this.append_alert({
+            type: "success",
+            msg: "Accelerometer calibration successful!",
+          })
+        )
+        .catch((err) =>
+          this.append_alert({
+            type: "danger",
+            msg: "Accelerometer calibration failed, " + err.message,
+          })
+        );
     },
     cal_sticks() {
       return serial.command(QuicCmd.CalSticks);
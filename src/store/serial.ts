@@ -3,12 +3,20 @@ import { useProfileStore } from "./profile";
 import { useDefaultProfileStore } from "./default_profile";
 import { usePerfStore } from "./perf";
 import { useBindStore } from "./bind";
+import { useAuditStore } from "./audit";
+import { useBackupsStore } from "./backups";
+import { useFileSyncStore } from "./filesync";
+import { useRecorderStore } from "./recorder";
 import { Log } from "@/log";
 import router from "@/router";
 import { defineStore } from "pinia";
+import { markRaw } from "vue";
 import { useRootStore } from "./root";
-import { QuicCmd } from "./serial/quic";
-import { serial } from "./serial/serial";
+import {
+  serial,
+  type ConnectOptions,
+  type QueueStats,
+} from "./serial/serial";
 import { settings } from "./serial/settings";
 import { useInfoStore } from "./info";
 import { useMotorStore } from "./motor";
@@ -17,8 +25,45 @@ import { useBlackboxStore } from "./blackbox";
 import { useTargetStore } from "./target";
 import { asyncDelay } from "./util";
 import { WebSerial } from "./serial/webserial";
+import { useDevicesStore } from "./devices";
+import { MockTarget } from "./serial/mock";
+import { WebSocketPort } from "./serial/websocket";
+import { UdpPort } from "./serial/udp";
+import { BluetoothPort } from "./serial/bluetooth";
+import { Keepalive } from "./serial/keepalive";
+import {
+  discoverDfuDevices,
+  discoverPorts,
+  type DiscoveredDevice,
+} from "./serial/discover";
+import { PortWatcher } from "./serial/hotplug";
+import {
+  BoardChangedError,
+  ReconnectSupervisor,
+  sameBoard,
+} from "./serial/reconnect";
+import { ForeignFirmwareError } from "./serial/msp";
+import { PortBusyError } from "./serial/portlock";
+import { DfuNotGrantedError } from "./flash/flash";
+import {
+  BatteryLevel,
+  BatteryMonitor,
+  DEFAULT_BATTERY_THRESHOLDS,
+  type BatteryReading,
+  type BatteryThresholds,
+} from "./serial/battery";
+import type { LatencyStats } from "./serial/latency";
+import { QuicEvent } from "./serial/events";
+
+const useMockTarget = new URLSearchParams(location.search).has("mock");
+const sitlTarget = new URLSearchParams(location.search).get("sitl");
+const udpTarget = new URLSearchParams(location.search).get("udp");
 
 let interval: any = null;
+let keepalive: Keepalive | null = null;
+let subscriptions: (() => void)[] = [];
+let portWatcher: PortWatcher | null = null;
+let battery: BatteryMonitor | null = null;
 let intervalCounter = 0;
 
 function stopInterval() {
@@ -36,12 +81,103 @@ function startInterval(fn: any) {
   }, settings.serial.updateInterval);
 }
 
+let lastPort: any = null;
+
+// prefer the port we lost, a re-enumerated board may show up as a new one.
+// another port may hold another board though, which is refused
+async function reopenPort() {
+  const store = useSerialStore();
+  const previous = { ...useInfoStore().$state };
+  const ports = await WebSerial.getPorts();
+  const [best] = await discoverPorts({ probe: false }).catch(() => []);
+  const port = ports.includes(lastPort) || !best ? lastPort : best.port;
+  const info = await serial.connectPort(
+    port,
+    (err) => store.on_serial_error(err),
+    store.connect_options
+  );
+  if (!sameBoard(previous, info)) {
+    await serial.close();
+    throw new BoardChangedError(previous, info);
+  }
+  lastPort = port;
+  return info;
+}
+
+const supervisor = new ReconnectSupervisor(reopenPort, () => serial.close());
+supervisor.register((info) => {
+  serial.writeProtected = !useSerialStore().writes_enabled;
+  useInfoStore().set_info(info);
+  return useMotorStore().fetch_motor_test();
+});
+
 export const useSerialStore = defineStore("serial", {
   state: () => ({
     is_connected: false,
     is_connecting: false,
+
+    safe_mode: localStorage.getItem("safe-mode") == "true",
+    writes_enabled: true,
+
+    latency: undefined as LatencyStats | undefined,
+    queue: undefined as QueueStats | undefined,
+    unsaved: false,
+    reconnecting: false,
+    battery: undefined as BatteryReading | undefined,
+    available: [] as DiscoveredDevice[],
+    selected_port: 0,
+
+    connect_options: JSON.parse(
+      localStorage.getItem("connect-options") || "{}"
+    ) as ConnectOptions,
+    battery_thresholds: {
+      ...DEFAULT_BATTERY_THRESHOLDS,
+      ...JSON.parse(localStorage.getItem("battery-thresholds") || "{}"),
+    } as BatteryThresholds,
   }),
   actions: {
+    set_safe_mode(val: boolean) {
+      localStorage.setItem("safe-mode", val ? "true" : "false");
+      this.safe_mode = val;
+    },
+    set_connect_options(opts: ConnectOptions) {
+      localStorage.setItem("connect-options", JSON.stringify(opts));
+      this.connect_options = opts;
+    },
+    set_battery_thresholds(thresholds: BatteryThresholds) {
+      localStorage.setItem("battery-thresholds", JSON.stringify(thresholds));
+      this.battery_thresholds = thresholds;
+      if (battery) {
+        battery.thresholds = thresholds;
+      }
+    },
+    watch_battery() {
+      const root = useRootStore();
+
+      battery?.stop();
+      battery = new BatteryMonitor(
+        serial,
+        this.battery_thresholds,
+        useProfileStore().voltage?.lipo_cell_count || 0
+      );
+      subscriptions.push(
+        battery.subscribe((r) => (this.battery = r)),
+        battery.onAlert(({ level, reading }) => {
+          if (level != BatteryLevel.Warning && level != BatteryLevel.Critical) {
+            return;
+          }
+          root.append_alert({
+            type: level == BatteryLevel.Critical ? "danger" : "warning",
+            msg: `Battery ${level}, ${reading.cell_voltage.toFixed(2)}V/cell`,
+          });
+        })
+      );
+      battery.start();
+    },
+    enable_writes() {
+      serial.writeProtected = false;
+      this.writes_enabled = true;
+    },
     async poll_serial(counter: number) {
       if (!this.is_connected) {
         return;
@@ -52,6 +188,8 @@ export const useSerialStore = defineStore("serial", {
       const state = useStateStore();
       const vtx = useVTXStore();
 
+      this.latency = serial.latency.stats();
+      this.queue = serial.queueStats();
       await state.fetch_state();
       if (counter % 4) {
         if (router.currentRoute.value.fullPath == "/receiver") {
@@ -66,6 +204,7 @@ export const useSerialStore = defineStore("serial", {
       }
     },
     async soft_reboot() {
+      const writes_enabled = this.writes_enabled;
       await this.disconnect();
 
       this.is_connecting = true;
@@ -85,27 +224,23 @@ export const useSerialStore = defineStore("serial", {
         await asyncDelay(100);
       }
 
+      const onError = (err) => this.on_serial_error(err);
+      const [best] = await discoverPorts({ probe: false });
       await this.connect(
-        serial.connectFirstPort((err) => {
-          Log.error("serial", err);
-          this.disconnect();
-          return serial.close();
-        })
+        best
+          ? serial.connectPort(best.port, onError, this.connect_options)
+          : serial.connectFirstPort(onError, this.connect_options)
       );
+      if (this.is_connected && writes_enabled) {
+        this.enable_writes();
+      }
     },
     serial_passthrough({ port, baudrate, half_duplex, stop_bits }) {
       const root = useRootStore();
 
       return serial
-        .command(
-          QuicCmd.Serial,
-          0,
-          port,
-          baudrate,
-          half_duplex ? 1 : 0,
-          stop_bits
-        )
-        .then(() => serial.close())
+        .passthrough({ port, baudrate, half_duplex, stop_bits })
+        .then((stream) => stream.close())
         .then(() => this.toggle_connection())
         .then(() => {
           root.append_alert({
@@ -121,31 +256,76 @@ export const useSerialStore = defineStore("serial", {
           });
         });
     },
+    persist() {
+      const root = useRootStore();
+
+      return serial
+        .persist()
+        .then(() =>
+          root.append_alert({
+            type: "success",
+            msg: "Settings saved to flash!",
+          })
+        )
+        .catch((err) => {
+          Log.error("serial", err);
+          root.append_alert({
+            type: "danger",
+            msg: "Saving settings failed",
+          });
+        });
+    },
     hard_reboot() {
       const root = useRootStore();
 
       return serial
-        .hardReboot()
-        .then((target) => {
+        .resetToBootloader()
+        .then((res) => {
           root.append_alert({
             type: "success",
             msg: "Reset to bootloader successful!",
           });
-          return target;
+          return res;
         })
         .catch((err) => {
           Log.error("serial", err);
-          root.append_alert({
-            type: "danger",
-            msg: "Reset to bootloader failed",
-          });
+          root.append_alert(
+            err instanceof DfuNotGrantedError
+              ? {
+                  type: "warning",
+                  msg: "Board is in the bootloader, select it when flashing",
+                }
+              : { type: "danger", msg: "Reset to bootloader failed" }
+          );
           return undefined;
         });
     },
+    async enter_bootloader(timeout?: number) {
+      this.disconnect();
+      const res = await serial.resetToBootloader(timeout);
+      return res.device;
+    },
     disconnect() {
       const root = useRootStore();
 
       stopInterval();
+      keepalive?.stop();
+      keepalive = null;
+      supervisor.cancel();
+      battery?.stop();
+      battery = null;
+      this.battery = undefined;
+      lastPort = null;
+      for (const unsubscribe of subscriptions) {
+        unsubscribe();
+      }
+      subscriptions = [];
+      useFileSyncStore().stop();
+      // closing the part is what commits it to disk, and a later session
+      // may be another board with another header
+      useRecorderStore()
+        .stop()
+        .catch((err) => Log.warn("serial", err));
 
       this.is_connected = false;
       this.is_connecting = false;
@@ -157,6 +337,7 @@ export const useSerialStore = defineStore("serial", {
     },
     async connect(infoPromise: Promise<any>) {
       const bb = useBlackboxStore();
+      const devices = useDevicesStore();
       const default_profile = useDefaultProfileStore();
       const info = useInfoStore();
       const motor = useMotorStore();
@@ -176,20 +357,62 @@ export const useSerialStore = defineStore("serial", {
         profile.$reset();
         target.$reset();
 
+        serial.writeProtected = this.safe_mode;
+        this.writes_enabled = !this.safe_mode;
+
         this.is_connected = true;
         info.set_info(i);
 
         if (info.quicVersionGte("0.2.0")) {
-          target.fetch();
+          target
+            .fetch_cached()
+            .then(() => info.fetch_extended())
+            .catch((err) => Log.warn("serial", err));
         }
 
-        default_profile.fetch_default_profile();
+        default_profile
+          .fetch_default_profile_cached()
+          .catch((err) => Log.warn("serial", err));
         root.fetch_pid_rate_presets();
-        profile.fetch_profile();
+        profile
+          .fetch_profile()
+          .then(() => {
+            if (battery) {
+              battery.cellCount = profile.voltage.lipo_cell_count || 0;
+            }
+          })
+          .then(() => devices.capture())
+          .then(() => info.fetch_supported_values())
+          .catch((err) => Log.warn("serial", err));
         vtx.update_vtx_settings();
 
         startInterval((c) => this.poll_serial(c));
 
+        keepalive = new Keepalive(serial, () => this.reconnect());
+        keepalive.start();
+        lastPort = serial.connectedPort;
+
+        this.unsaved = false;
+        subscriptions = [
+          serial.events.subscribe(QuicEvent.InfoChanged, ({ info: next }) => {
+            Log.info("serial", "target changed to", next.git_version);
+            info.set_info(next);
+            root.append_alert({
+              type: "warning",
+              msg: "Target firmware changed, please reconnect",
+            });
+          }),
+          serial.events.subscribe(
+            QuicEvent.DirtyChanged,
+            (dirty) => (this.unsaved = dirty)
+          ),
+          useBackupsStore().watch_writes(),
+          useAuditStore().watch_writes(),
+          useRecorderStore().watch_history(),
+        ];
+
+        this.watch_battery();
+
         if (router.currentRoute.value.fullPath != "/profile") {
           router.push("/profile");
         }
@@ -199,26 +422,161 @@ export const useSerialStore = defineStore("serial", {
         root.reset_needs_reboot();
         root.append_alert({
           type: "danger",
-          msg: "Connection to the board failed",
+          msg:
+            err instanceof ForeignFirmwareError || err instanceof PortBusyError
+              ? "Connection to the board failed, " + err.message
+              : "Connection to the board failed",
         });
       } finally {
         this.is_connecting = false;
       }
     },
+    on_serial_error(err) {
+      Log.error("serial", err);
+      if (this.is_connected && lastPort) {
+        return this.reconnect();
+      }
+      this.disconnect();
+      return serial.close();
+    },
+    async reconnect() {
+      const root = useRootStore();
+      if (this.reconnecting) {
+        return;
+      }
+
+      this.reconnecting = true;
+      stopInterval();
+      keepalive?.stop();
+      try {
+        await supervisor.reconnect();
+        startInterval((c) => this.poll_serial(c));
+        keepalive?.start();
+        root.append_alert({
+          type: "success",
+          msg: "Reconnected to the board",
+        });
+      } catch (err) {
+        Log.error("serial", err);
+        root.append_alert({
+          type: "danger",
+          msg:
+            err instanceof BoardChangedError
+              ? "A different board was found, connect again to load it"
+              : "Connection to the board lost",
+        });
+        this.disconnect();
+        await serial.close();
+      } finally {
+        this.reconnecting = false;
+      }
+    },
+    async watch_ports() {
+      const root = useRootStore();
+
+      portWatcher?.stop();
+      portWatcher = new PortWatcher(
+        (port) => {
+          this.refresh_available();
+          if (
+            this.is_connected ||
+            this.is_connecting ||
+            useMockTarget ||
+            sitlTarget ||
+            udpTarget ||
+            router.currentRoute.value.name == "flash"
+          ) {
+            return;
+          }
+          this.is_connecting = true;
+          this.connect(
+            serial.connectPort(
+              port,
+              (err) => this.on_serial_error(err),
+              this.connect_options
+            )
+          );
+        },
+        (port) => {
+          this.refresh_available();
+          if (!this.is_connected || !serial.isConnectedTo(port)) {
+            return;
+          }
+          root.append_alert({
+            type: "danger",
+            msg: "Flight controller disconnected",
+          });
+          this.reconnect();
+        }
+      );
+      await portWatcher.start();
+      return this.refresh_available();
+    },
+    // ports and dfu devices are raw so vue never proxies the handles
+    async refresh_available() {
+      const [ports, dfu] = await Promise.all([
+        discoverPorts({ probe: false }).catch(() => []),
+        discoverDfuDevices().catch(() => []),
+      ]);
+      const selected = this.available[this.selected_port];
+      this.available = [...ports, ...dfu].map((d) => markRaw(d));
+      this.selected_port = Math.max(
+        0,
+        this.available.findIndex((d) => d.name == selected?.name)
+      );
+    },
+    unwatch_ports() {
+      portWatcher?.stop();
+      portWatcher = null;
+    },
+    async connect_bluetooth() {
+      const onError = (err) => this.on_serial_error(err);
+
+      const port = await BluetoothPort.request();
+      this.is_connecting = true;
+      return this.connect(serial.connectPort(port, onError));
+    },
     async toggle_connection() {
       if (this.is_connected) {
         this.disconnect();
         return serial.close();
       }
 
+      const onError = (err) => this.on_serial_error(err);
+
       this.is_connecting = true;
-      return this.connect(
-        serial.connect((err) => {
-          Log.error("serial", err);
-          this.disconnect();
-          return serial.close();
-        })
-      );
+      if (useMockTarget) {
+        return this.connect(serial.connectPort(new MockTarget(), onError));
+      }
+      if (sitlTarget) {
+        const port = new WebSocketPort(sitlTarget);
+        return this.connect(serial.connectPort(port, onError));
+      }
+      if (udpTarget) {
+        const [host, port] = udpTarget.split(":");
+        const udp = new UdpPort(host, parseInt(port));
+        return this.connect(serial.connectPort(udp, onError));
+      }
+
+      // a board in the bootloader can only be flashed
+      const selected = this.available[this.selected_port];
+      if (selected?.mode == "dfu") {
+        this.is_connecting = false;
+        return router.push({ name: "flash" });
+      }
+      if (this.available.length > 1 && selected?.port) {
+        return this.connect(
+          serial.connectPort(selected.port, onError, this.connect_options)
+        );
+      }
+
+      const [best] = await discoverPorts().catch(() => []);
+      if (best?.info) {
+        return this.connect(
+          serial.connectPort(best.port, onError, this.connect_options)
+        );
+      }
+      return this.connect(serial.connect(onError, this.connect_options));
     },
   },
 });
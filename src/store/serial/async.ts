@@ -5,11 +5,23 @@ export class AsyncSemaphore {
 
   constructor(private permits: number) {}
 
+  get waiting() {
+    return this.promises.length;
+  }
+
   signal() {
     this.permits += 1;
     if (this.promises.length > 0) this.promises.pop()!();
   }
 
+  release() {
+    const promises = this.promises;
+    this.promises = [];
+    for (const r of promises) {
+      r();
+    }
+  }
+
   async wait() {
     this.permits -= 1;
     if (this.permits < 0 || this.promises.length > 0)
@@ -17,11 +29,73 @@ export class AsyncSemaphore {
   }
 }
 
+export class AsyncChannel<T> {
+  private _buffer: T[] = [];
+  private _handlers: ((v: T) => void)[] = [];
+  private _scheduled = false;
+  private _dropped = 0;
+  private _closed = false;
+
+  constructor(private size: number) {}
+
+  get dropped() {
+    return this._dropped;
+  }
+
+  push(val: T) {
+    if (this._closed) {
+      return;
+    }
+    if (this._buffer.length >= this.size) {
+      this._buffer.shift();
+      this._dropped++;
+    }
+    this._buffer.push(val);
+
+    if (!this._scheduled) {
+      this._scheduled = true;
+      setTimeout(() => this._drain());
+    }
+  }
+
+  subscribe(fn: (v: T) => void) {
+    this._handlers.push(fn);
+    return () => {
+      this._handlers = this._handlers.filter((h) => h != fn);
+    };
+  }
+
+  // drops anything still waiting for the next drain, no handler is called
+  // once this returns
+  close() {
+    this._closed = true;
+    this._buffer = [];
+    this._handlers = [];
+  }
+
+  private _drain() {
+    this._scheduled = false;
+
+    const buffer = this._buffer;
+    this._buffer = [];
+    for (const v of buffer) {
+      for (const fn of this._handlers) {
+        try {
+          fn(v);
+        } catch (err) {
+          console.warn(err);
+        }
+      }
+    }
+  }
+}
+
 const QUEUE_BUFFER_SIZE = settings.serial.bufferSize;
 
 interface AsyncResolver {
   id: number;
   fn: (Uint8Array) => void;
+  reject: (any) => void;
   size: number;
 }
 
@@ -68,22 +142,54 @@ export class AsyncQueue {
     this._abort.abort("close");
     await this._done;
     this.readable.cancel();
+
+    for (const r of this._resolvers) {
+      r.reject("close");
+    }
+    this._resolvers = [];
+  }
+
+  // fails the reads still waiting for data, the buffer is kept
+  cancelReads(reason: any) {
+    for (const r of this._resolvers) {
+      r.reject(reason);
+    }
+    this._resolvers = [];
+  }
+
+  // hands what is buffered and everything read after it to a stream, the
+  // queue must not be read from anywhere else afterwards
+  stream(): ReadableStream<Uint8Array> {
+    return new ReadableStream<Uint8Array>({
+      pull: async (controller) => {
+        try {
+          controller.enqueue(await this.readAvailable());
+        } catch (err) {
+          if (err == "close") {
+            controller.close();
+          } else {
+            controller.error(err);
+          }
+        }
+      },
+      cancel: () => this.close(),
+    });
   }
 
   private async write(
     array: Uint8Array,
     controller?: WritableStreamDefaultController
   ) {
-    for (const v of array) {
-      const next = (this._head + 1) % QUEUE_BUFFER_SIZE;
-      if (next == this._tail) {
-        controller?.error("queue full");
-        throw new Error("queue full");
-      }
-      this._buffer[this._head] = v;
-      this._head = next;
+    if (this._read_len + array.length >= QUEUE_BUFFER_SIZE) {
+      controller?.error("queue full");
+      throw new Error("queue full");
     }
 
+    const first = Math.min(array.length, QUEUE_BUFFER_SIZE - this._head);
+    this._buffer.set(array.subarray(0, first), this._head);
+    this._buffer.set(array.subarray(first), 0);
+    this._head = (this._head + array.length) % QUEUE_BUFFER_SIZE;
+
     if (this._resolvers.length) {
       const resolver = this._resolvers[0];
       if (this._read_len >= resolver.size) {
@@ -96,10 +202,11 @@ export class AsyncQueue {
   private _defer(size: number, timeout?: number): Promise<Uint8Array> {
     const id = this._resolverId++;
     const promises = [
-      new Promise<Uint8Array>((resolve) => {
+      new Promise<Uint8Array>((resolve, reject) => {
         this._resolvers.push({
           id,
           fn: resolve,
+          reject,
           size,
         });
       }),
@@ -119,10 +226,23 @@ export class AsyncQueue {
   }
 
   async pop(timeout: number | undefined): Promise<number> {
+    const v = this.tryPop();
+    if (v !== undefined) {
+      return v;
+    }
     const res = await this.read(1, timeout);
     return res[0];
   }
 
+  tryPop(): number | undefined {
+    if (this._head == this._tail || this._resolvers.length) {
+      return undefined;
+    }
+    const v = this._buffer[this._tail];
+    this._tail = (this._tail + 1) % QUEUE_BUFFER_SIZE;
+    return v;
+  }
+
   async read(size: number, timeout: number | undefined): Promise<Uint8Array> {
     if (size == 0) {
       return new Uint8Array(size);
@@ -133,12 +253,25 @@ export class AsyncQueue {
     return this._read(size);
   }
 
+  // everything buffered, waits for at least one byte
+  async readAvailable(): Promise<Uint8Array> {
+    if (this._read_len) {
+      return this._read(this._read_len);
+    }
+    const first = await this._defer(1);
+    const rest = this._read(this._read_len);
+    const res = new Uint8Array(first.length + rest.length);
+    res.set(first);
+    res.set(rest, first.length);
+    return res;
+  }
+
   private _read(size: number) {
     const buffer = new Uint8Array(size);
-    for (let i = 0; i < size; i++) {
-      buffer[i] = this._buffer[this._tail];
-      this._tail = (this._tail + 1) % QUEUE_BUFFER_SIZE;
-    }
+    const first = Math.min(size, QUEUE_BUFFER_SIZE - this._tail);
+    buffer.set(this._buffer.subarray(this._tail, this._tail + first));
+    buffer.set(this._buffer.subarray(0, size - first), first);
+    this._tail = (this._tail + size) % QUEUE_BUFFER_SIZE;
     return buffer;
   }
 }
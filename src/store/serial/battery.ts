@@ -0,0 +1,155 @@
+import { Log } from "@/log";
+import { AsyncChannel } from "./async";
+import { QuicVal } from "./quic";
+import type { Serial } from "./serial";
+
+const BATTERY_POLL_INTERVAL = 500;
+const BATTERY_HYSTERESIS = 0.05;
+
+// below this the board is most likely running from usb only
+const BATTERY_PRESENT_VOLTAGE = 2.0;
+const CELL_MAX_VOLTAGE = 4.35;
+
+export enum BatteryLevel {
+  None = "none",
+  Ok = "ok",
+  Warning = "warning",
+  Critical = "critical",
+}
+
+// per cell voltages
+export interface BatteryThresholds {
+  warning: number;
+  critical: number;
+}
+
+export const DEFAULT_BATTERY_THRESHOLDS: BatteryThresholds = {
+  warning: 3.5,
+  critical: 3.3,
+};
+
+export interface BatteryReading {
+  vbat: number;
+  cells: number;
+  cell_voltage: number;
+  current: number; // mA
+  level: BatteryLevel;
+  time: number;
+}
+
+export interface BatteryAlert {
+  previous: BatteryLevel;
+  level: BatteryLevel;
+  reading: BatteryReading;
+}
+
+export function estimateCells(vbat: number) {
+  if (vbat < BATTERY_PRESENT_VOLTAGE) {
+    return 0;
+  }
+  return Math.ceil(vbat / CELL_MAX_VOLTAGE);
+}
+
+export function batteryLevel(
+  cell_voltage: number,
+  thresholds: BatteryThresholds,
+  previous = BatteryLevel.Ok
+) {
+  // only recover once the voltage climbed clear of the threshold
+  const margin = (level: BatteryLevel) =>
+    previous == level ? BATTERY_HYSTERESIS : 0;
+
+  if (cell_voltage < thresholds.critical + margin(BatteryLevel.Critical)) {
+    return BatteryLevel.Critical;
+  }
+  if (cell_voltage < thresholds.warning + margin(BatteryLevel.Warning)) {
+    return BatteryLevel.Warning;
+  }
+  return BatteryLevel.Ok;
+}
+
+export class BatteryMonitor {
+  private readings = new AsyncChannel<BatteryReading>(4);
+  private alerts = new AsyncChannel<BatteryAlert>(4);
+  private timer: any = null;
+  private inflight = false;
+  private level = BatteryLevel.None;
+  private detected = 0;
+
+  public latest?: BatteryReading;
+
+  constructor(
+    private serial: Serial,
+    public thresholds = DEFAULT_BATTERY_THRESHOLDS,
+    // configured cell count, 0 detects it from the voltage
+    public cellCount = 0,
+    private interval = BATTERY_POLL_INTERVAL
+  ) {}
+
+  public subscribe(fn: (r: BatteryReading) => void) {
+    return this.readings.subscribe(fn);
+  }
+
+  public onAlert(fn: (a: BatteryAlert) => void) {
+    return this.alerts.subscribe(fn);
+  }
+
+  public start() {
+    this.stop();
+    this.timer = setInterval(() => this.poll(), this.interval);
+  }
+
+  public stop() {
+    clearInterval(this.timer);
+    this.timer = null;
+    this.level = BatteryLevel.None;
+    this.detected = 0;
+  }
+
+  public update(vbat: number, current: number): BatteryReading {
+    // detect once per plug in, a sagging pack would look like fewer cells
+    if (vbat < BATTERY_PRESENT_VOLTAGE) {
+      this.detected = 0;
+    } else if (!this.detected) {
+      this.detected = estimateCells(vbat);
+    }
+    const count = this.detected ? this.cellCount || this.detected : 0;
+    const cell_voltage = count ? vbat / count : 0;
+    const level = count
+      ? batteryLevel(cell_voltage, this.thresholds, this.level)
+      : BatteryLevel.None;
+
+    const reading = {
+      vbat,
+      cells: count,
+      cell_voltage,
+      current,
+      level,
+      time: Date.now(),
+    };
+    if (level != this.level) {
+      this.alerts.push({ previous: this.level, level, reading });
+      this.level = level;
+    }
+    this.latest = reading;
+    this.readings.push(reading);
+    return reading;
+  }
+
+  private async poll() {
+    if (this.inflight || !this.serial.connectedPort) {
+      return;
+    }
+
+    this.inflight = true;
+    try {
+      const state = await this.serial.get(QuicVal.State);
+      const vbat = state.vbattfilt || state.vbat_filtered || 0;
+      this.update(vbat, state.ibat_filtered || 0);
+    } catch (err) {
+      Log.warn("battery", err);
+    } finally {
+      this.inflight = false;
+    }
+  }
+}
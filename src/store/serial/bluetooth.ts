@@ -0,0 +1,117 @@
+import type { Transport } from "./transport";
+
+const NUS_SERVICE = "6e400001-b5a3-f393-e0a9-e50e24dcca9e";
+const NUS_RX_CHARACTERISTIC = "6e400002-b5a3-f393-e0a9-e50e24dcca9e";
+const NUS_TX_CHARACTERISTIC = "6e400003-b5a3-f393-e0a9-e50e24dcca9e";
+
+// web bluetooth does not expose the negotiated mtu, stay within the
+// minimum att payload unless told otherwise
+const BLE_DEFAULT_CHUNK_SIZE = 20;
+
+export function bluetoothAvailable() {
+  return !!(navigator as any).bluetooth;
+}
+
+// talks to a nordic uart service style bridge
+export class BluetoothPort implements Transport {
+  public readable?: ReadableStream<Uint8Array>;
+  public writable?: WritableStream<Uint8Array>;
+
+  private device?: any;
+  private rx?: any;
+  private tx?: any;
+  private controller?: ReadableStreamDefaultController<Uint8Array>;
+
+  constructor(private chunkSize = BLE_DEFAULT_CHUNK_SIZE) {
+    this.onNotify = this.onNotify.bind(this);
+    this.onDisconnect = this.onDisconnect.bind(this);
+  }
+
+  public static async request(chunkSize?: number) {
+    const port = new BluetoothPort(chunkSize);
+    port.device = await (navigator as any).bluetooth.requestDevice({
+      filters: [{ services: [NUS_SERVICE] }],
+    });
+    return port;
+  }
+
+  public getInfo() {
+    return { name: this.device?.name };
+  }
+
+  public describe() {
+    return "bluetooth " + (this.device?.name || "unknown");
+  }
+
+  public async open(_opts?: any) {
+    if (!this.device) {
+      throw new Error("no bluetooth device selected");
+    }
+
+    const server = await this.device.gatt.connect();
+    const service = await server.getPrimaryService(NUS_SERVICE);
+    this.rx = await service.getCharacteristic(NUS_RX_CHARACTERISTIC);
+    this.tx = await service.getCharacteristic(NUS_TX_CHARACTERISTIC);
+
+    this.readable = new ReadableStream<Uint8Array>({
+      start: (controller) => {
+        this.controller = controller;
+      },
+    });
+    this.writable = new WritableStream<Uint8Array>({
+      write: (chunk) => this.write(chunk),
+    });
+
+    this.tx.addEventListener("characteristicvaluechanged", this.onNotify);
+    this.device.addEventListener("gattserverdisconnected", this.onDisconnect);
+    await this.tx.startNotifications();
+  }
+
+  public async close() {
+    this.tx?.removeEventListener("characteristicvaluechanged", this.onNotify);
+    this.device?.removeEventListener(
+      "gattserverdisconnected",
+      this.onDisconnect
+    );
+    if (this.device?.gatt.connected) {
+      this.device.gatt.disconnect();
+    }
+
+    try {
+      this.controller?.close();
+    } catch {
+      // already closed by the reader
+    }
+    this.controller = undefined;
+    this.readable = undefined;
+    this.writable = undefined;
+    this.rx = undefined;
+    this.tx = undefined;
+  }
+
+  private async write(chunk: Uint8Array) {
+    for (let i = 0; i < chunk.length; i += this.chunkSize) {
+      const part = chunk.slice(i, i + this.chunkSize);
+      if (this.rx.writeValueWithoutResponse) {
+        await this.rx.writeValueWithoutResponse(part);
+      } else {
+        await this.rx.writeValue(part);
+      }
+    }
+  }
+
+  private onNotify(event: any) {
+    const value: DataView = event.target.value;
+    this.controller?.enqueue(
+      new Uint8Array(value.buffer, value.byteOffset, value.byteLength).slice()
+    );
+  }
+
+  private onDisconnect() {
+    try {
+      this.controller?.error(new Error("bluetooth device disconnected"));
+    } catch {
+      // already closed
+    }
+  }
+}
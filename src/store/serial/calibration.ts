@@ -0,0 +1,196 @@
+import { QuicEvent } from "./events";
+import { QuicCmd, QuicVal } from "./quic";
+import { asyncDelay } from "../util";
+import type { Serial } from "./serial";
+
+export enum CalibrationState {
+  Running = "running",
+  Done = "done",
+  Failed = "failed",
+}
+
+export interface CalibrationProgress {
+  state: CalibrationState;
+  percent: number;
+  message?: string;
+}
+
+// rough duration of the firmware gyro/accel sampling, used when the
+// firmware does not report its own progress
+const CAL_IMU_ESTIMATE_MS = 3000;
+const CAL_IMU_TIMEOUT_MS = 30_000;
+
+export async function calibrateIMU(
+  serial: Serial,
+  onProgress: (p: CalibrationProgress) => void,
+  signal?: AbortSignal
+) {
+  const start = performance.now();
+  let percent = 0;
+  let message: string | undefined = undefined;
+
+  const report = (state: CalibrationState) =>
+    onProgress({ state, percent, message });
+
+  const unsubscribe = serial.events.subscribe(QuicEvent.Log, (msg: string) => {
+    message = msg;
+    const match = /(\d+)\s*%/.exec(msg);
+    if (match) {
+      percent = Math.max(percent, Math.min(100, parseInt(match[1])));
+    }
+    report(CalibrationState.Running);
+  });
+
+  const timer = setInterval(() => {
+    const elapsed = performance.now() - start;
+    const estimate = Math.floor((elapsed / CAL_IMU_ESTIMATE_MS) * 100);
+    percent = Math.max(percent, Math.min(99, estimate));
+    report(CalibrationState.Running);
+  }, 100);
+
+  report(CalibrationState.Running);
+  try {
+    await serial.commandWith(QuicCmd.CalImu, {
+      timeout: CAL_IMU_TIMEOUT_MS,
+      signal,
+    });
+    percent = 100;
+    report(CalibrationState.Done);
+  } catch (err: any) {
+    message = err?.message || String(err);
+    report(CalibrationState.Failed);
+    throw err;
+  } finally {
+    clearInterval(timer);
+    unsubscribe();
+  }
+}
+
+export enum AccelCalStep {
+  Level = "level",
+  Sampling = "sampling",
+  Verifying = "verifying",
+  Done = "done",
+  Failed = "failed",
+}
+
+export interface AccelCalProgress {
+  step: AccelCalStep;
+  percent: number;
+  message?: string;
+  residual?: number[];
+}
+
+// all in g, the craft only has to be roughly level before calibrating
+const ACCEL_LEVEL_TOLERANCE = 0.25;
+const ACCEL_STILL_TOLERANCE = 0.02;
+const ACCEL_RESIDUAL_LIMIT = 0.05;
+const ACCEL_LEVEL_TIMEOUT_MS = 15_000;
+const ACCEL_SAMPLES = 10;
+const ACCEL_SAMPLE_INTERVAL_MS = 50;
+
+export function accelStats(samples: number[][]) {
+  const mean = [0, 1, 2].map(
+    (i) => samples.reduce((p, s) => p + s[i], 0) / samples.length
+  );
+  const stddev = [0, 1, 2].map((i) =>
+    Math.sqrt(
+      samples.reduce((p, s) => p + (s[i] - mean[i]) ** 2, 0) / samples.length
+    )
+  );
+  return { mean, stddev };
+}
+
+// a level, calibrated craft reads (0, 0, 1g)
+export function accelResidual(mean: number[]) {
+  return [mean[0], mean[1], mean[2] - 1];
+}
+
+export function validateAccel(mean: number[], limit = ACCEL_RESIDUAL_LIMIT) {
+  const residual = accelResidual(mean);
+  const axis = residual.findIndex((r) => Math.abs(r) > limit);
+  if (axis < 0) {
+    return undefined;
+  }
+  return (
+    `${"xyz"[axis]} axis off by ${residual[axis].toFixed(3)}g, ` +
+    "make sure the craft is level and still"
+  );
+}
+
+async function sampleAccel(serial: Serial, signal?: AbortSignal) {
+  const samples: number[][] = [];
+  while (samples.length < ACCEL_SAMPLES) {
+    if (signal?.aborted) {
+      throw new Error("calibration aborted");
+    }
+    const state = await serial.get(QuicVal.State);
+    if (state?.accel) {
+      samples.push([...state.accel]);
+    }
+    await asyncDelay(ACCEL_SAMPLE_INTERVAL_MS);
+  }
+  return accelStats(samples);
+}
+
+export async function calibrateAccel(
+  serial: Serial,
+  onProgress: (p: AccelCalProgress) => void,
+  signal?: AbortSignal
+) {
+  const report = (p: AccelCalProgress) => {
+    onProgress(p);
+    return p;
+  };
+
+  try {
+    const deadline = performance.now() + ACCEL_LEVEL_TIMEOUT_MS;
+    for (;;) {
+      const { mean, stddev } = await sampleAccel(serial, signal);
+      const still = stddev.every((s) => s < ACCEL_STILL_TOLERANCE);
+      const level =
+        Math.abs(mean[0]) < ACCEL_LEVEL_TOLERANCE &&
+        Math.abs(mean[1]) < ACCEL_LEVEL_TOLERANCE &&
+        mean[2] > 1 - ACCEL_LEVEL_TOLERANCE;
+      if (still && level) {
+        break;
+      }
+      if (performance.now() > deadline) {
+        throw new Error("craft is not level and still");
+      }
+      report({
+        step: AccelCalStep.Level,
+        percent: 0,
+        message: still
+          ? "Place the craft on a level surface"
+          : "Keep the craft still",
+      });
+    }
+
+    let percent = 0;
+    await calibrateIMU(
+      serial,
+      (p) => {
+        percent = Math.min(90, Math.floor(p.percent * 0.9));
+        report({ step: AccelCalStep.Sampling, percent, message: p.message });
+      },
+      signal
+    );
+
+    report({ step: AccelCalStep.Verifying, percent: 95 });
+    const { mean } = await sampleAccel(serial, signal);
+    const residual = accelResidual(mean);
+    const error = validateAccel(mean);
+    if (error) {
+      throw new Error(error);
+    }
+    return report({ step: AccelCalStep.Done, percent: 100, residual });
+  } catch (err: any) {
+    report({
+      step: AccelCalStep.Failed,
+      percent: 0,
+      message: err?.message || String(err),
+    });
+    throw err;
+  }
+}
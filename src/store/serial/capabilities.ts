@@ -0,0 +1,60 @@
+import semver from "semver";
+import { decodeSemver } from "../util";
+import { compressionAvailable } from "./compress";
+import { target_feature_t } from "../types";
+import { QuicCmd, QuicVal } from "./quic";
+
+export interface Capabilities {
+  version: string;
+  streaming: boolean;
+  crc: boolean;
+  compression: boolean;
+  blackboxRange: boolean;
+  maxPayload: number;
+  commands: QuicCmd[];
+  values?: QuicVal[];
+}
+
+const QUIC_MAX_PAYLOAD = 0xffff;
+
+const allCommands = (): QuicCmd[] => {
+  const commands: QuicCmd[] = [];
+  for (let cmd = QuicCmd.Get; cmd < QuicCmd.Max; cmd++) {
+    commands.push(cmd);
+  }
+  return commands;
+};
+
+export const defaultCapabilities = (): Capabilities => ({
+  version: "v0.0.0",
+  streaming: true,
+  crc: false,
+  compression: false,
+  blackboxRange: false,
+  maxPayload: QUIC_MAX_PAYLOAD,
+  commands: allCommands().filter((cmd) => cmd != QuicCmd.Validate),
+});
+
+export function negotiateCapabilities(info: any): Capabilities {
+  const version = decodeSemver(info.quic_protocol_version || 0);
+
+  let commands = allCommands();
+  if (semver.lt(version, "0.2.0")) {
+    commands = commands.filter((cmd) => cmd != QuicCmd.OSD);
+  }
+  if (!(info.features & target_feature_t.FEATURE_QUIC_DRY_RUN)) {
+    commands = commands.filter((cmd) => cmd != QuicCmd.Validate);
+  }
+
+  return {
+    version,
+    streaming: info.quic_protocol_version > 1,
+    crc: !!(info.features & target_feature_t.FEATURE_QUIC_CRC),
+    compression:
+      !!(info.features & target_feature_t.FEATURE_QUIC_COMPRESSION) &&
+      compressionAvailable(),
+    blackboxRange: !!(info.features & target_feature_t.FEATURE_BLACKBOX_RANGE),
+    maxPayload: QUIC_MAX_PAYLOAD,
+    commands,
+  };
+}
@@ -47,6 +47,12 @@ for (let i = 0; i < 256; i++) {
   mult10[i] = +("1e" + Math.floor(45.15 - i * 0.30103));
 }
 
+// tags this side has no meaning for are carried through untouched, so a
+// value read from newer firmware is written back exactly as it came
+export class CBORTag {
+  constructor(public tag: number, public value: any) {}
+}
+
 class Encoder {
   private buf = new ArrayWriter();
 
@@ -63,7 +69,12 @@ class Encoder {
         break;
 
       case "object":
-        if (val instanceof Uint8Array) {
+        if (val === null) {
+          this.encodeHeader(MajorType.FLOAT, 22);
+        } else if (val instanceof CBORTag) {
+          this.encodeRaw(MajorType.TAG, val.tag, sizeForValue(val.tag));
+          this.encodeVal(val.value);
+        } else if (val instanceof Uint8Array) {
           this.encodeByteString(val);
         } else if (Array.isArray(val)) {
           this.encodeArray(val);
@@ -216,6 +227,11 @@ class Decoder {
         return res;
       }
 
+      case MajorType.TAG: {
+        const tag = this.decodeRaw(max);
+        return new CBORTag(tag, this.decode());
+      }
+
       case MajorType.FLOAT:
         return this.decodeFloat(max);
 
@@ -248,16 +264,12 @@ class Decoder {
   }
 
   private decodeEntriesLeft(max: number): () => number {
-    let count = 0;
     if (max != SizeType.INDEFINITE) {
-      count = this.decodeRaw(max);
+      const count = this.decodeRaw(max);
+      return () => count;
     }
 
     return () => {
-      if (count) {
-        return count;
-      }
-
       if (this.buf.remaining() <= 0) {
         return 0;
       }
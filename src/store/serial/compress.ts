@@ -0,0 +1,24 @@
+const CompressionFormat = "deflate";
+
+export function compressionAvailable() {
+  return (
+    typeof (globalThis as any).CompressionStream !== "undefined" &&
+    typeof (globalThis as any).DecompressionStream !== "undefined"
+  );
+}
+
+async function pipe(data: Uint8Array, stream: any): Promise<Uint8Array> {
+  const blob = new Blob([data]);
+  const res = new Response(blob.stream().pipeThrough(stream));
+  return new Uint8Array(await res.arrayBuffer());
+}
+
+export function deflate(data: Uint8Array): Promise<Uint8Array> {
+  const Stream = (globalThis as any).CompressionStream;
+  return pipe(data, new Stream(CompressionFormat));
+}
+
+export function inflate(data: Uint8Array): Promise<Uint8Array> {
+  const Stream = (globalThis as any).DecompressionStream;
+  return pipe(data, new Stream(CompressionFormat));
+}
@@ -0,0 +1,127 @@
+import { Log } from "@/log";
+import { Serial, SERIAL_FILTERS } from "./serial";
+import { WebSerial } from "./webserial";
+import type { Transport } from "./transport";
+import { isDFUDevice } from "../flash/flash";
+
+export type DeviceMode = "app" | "dfu";
+
+export interface DiscoveredPort {
+  port: Transport;
+  usbVendorId?: number;
+  usbProductId?: number;
+  info?: any;
+  score: number;
+  mode: DeviceMode;
+  name: string;
+  productName?: string;
+  manufacturerName?: string;
+  serialNumber?: string;
+  device?: USBDevice;
+}
+
+// dfu devices have no serial port to open, only the usb handle
+export type DiscoveredDevice = Omit<DiscoveredPort, "port"> & {
+  port?: Transport;
+};
+
+export interface DiscoverOptions {
+  probe?: boolean;
+  timeout?: number;
+}
+
+export function isKnownPort(info: any) {
+  return SERIAL_FILTERS.some(
+    (f) =>
+      f.usbVendorId == info.usbVendorId && f.usbProductId == info.usbProductId
+  );
+}
+
+export function describeDevice(entry: DiscoveredDevice) {
+  const target = entry.info?.target_name;
+  const product = entry.productName || "Quicksilver";
+  const label = target ? `Quicksilver ${target}` : product;
+  const serial = entry.serialNumber ? ` #${entry.serialNumber}` : "";
+  return `${label}${serial} (${entry.mode == "dfu" ? "DFU" : "app"} mode)`;
+}
+
+// web serial hides usb strings, borrow them from webusb for devices the
+// user also granted there, matching on vid:pid
+async function usbDevices(): Promise<USBDevice[]> {
+  if (typeof navigator === "undefined" || !navigator.usb) {
+    return [];
+  }
+  return navigator.usb.getDevices().catch(() => []);
+}
+
+function withUsbStrings<T extends DiscoveredDevice>(
+  entry: T,
+  devices: USBDevice[]
+) {
+  const device = devices.find(
+    (d) =>
+      d.vendorId == entry.usbVendorId && d.productId == entry.usbProductId
+  );
+  if (device) {
+    entry.productName = device.productName;
+    entry.manufacturerName = device.manufacturerName;
+    entry.serialNumber = device.serialNumber;
+  }
+  entry.name = describeDevice(entry);
+  return entry;
+}
+
+// ranks the ports we have been granted access to, a port answering
+// a quic info request beats one that only matches a known VID/PID
+export async function discoverPorts(
+  opts: DiscoverOptions = {}
+): Promise<DiscoveredPort[]> {
+  const probe = opts.probe ?? true;
+
+  const devices = await usbDevices();
+  const found: DiscoveredPort[] = [];
+  for (const port of await WebSerial.getPorts()) {
+    const usb = port.getInfo ? port.getInfo() : {};
+    const entry: DiscoveredPort = {
+      port,
+      usbVendorId: usb.usbVendorId,
+      usbProductId: usb.usbProductId,
+      score: 0,
+      mode: "app",
+      name: "",
+    };
+    if (isKnownPort(usb)) {
+      entry.score += 1;
+    }
+
+    if (probe && entry.score) {
+      entry.info = await new Serial().detect(port, opts.timeout);
+      if (entry.info) {
+        entry.score += 2;
+      }
+    }
+    if (entry.score) {
+      withUsbStrings(entry, devices);
+      Log.info("serial", "discovered", entry.name, "score", entry.score);
+      found.push(entry);
+    }
+  }
+
+  return found.sort((a, b) => b.score - a.score);
+}
+
+// boards sitting in the bootloader only show up on webusb
+export async function discoverDfuDevices(): Promise<DiscoveredDevice[]> {
+  const devices = await usbDevices();
+  return devices.filter(isDFUDevice).map((device) => {
+    const entry: DiscoveredDevice = {
+      usbVendorId: device.vendorId,
+      usbProductId: device.productId,
+      score: 0,
+      mode: "dfu",
+      name: "",
+      device,
+    };
+    return withUsbStrings(entry, [device]);
+  });
+}
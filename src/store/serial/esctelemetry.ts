@@ -0,0 +1,152 @@
+import { Log } from "@/log";
+import { AsyncChannel } from "./async";
+import type { PassthroughStream } from "./serial";
+
+// kiss / blheli32 telemetry: temp, voltage, current, consumption, erpm, crc
+export const ESC_TELEMETRY_FRAME_SIZE = 10;
+
+const TELEMETRY_BUFFER_SIZE = 64;
+
+export interface EscTelemetry {
+  esc: number;
+  temperature: number; // celsius
+  voltage: number; // volt
+  current: number; // ampere
+  consumption: number; // mAh
+  erpm: number;
+  timestamp: number;
+}
+
+export function crc8Kiss(data: ArrayLike<number>, length = data.length) {
+  let crc = 0;
+  for (let i = 0; i < length; i++) {
+    crc ^= data[i];
+    for (let j = 0; j < 8; j++) {
+      crc = crc & 0x80 ? ((crc << 1) ^ 0x07) & 0xff : (crc << 1) & 0xff;
+    }
+  }
+  return crc;
+}
+
+export function decodeEscTelemetry(
+  frame: ArrayLike<number>,
+  esc = 0
+): EscTelemetry | undefined {
+  if (frame.length < ESC_TELEMETRY_FRAME_SIZE) {
+    return undefined;
+  }
+  if (crc8Kiss(frame, ESC_TELEMETRY_FRAME_SIZE - 1) != frame[9]) {
+    return undefined;
+  }
+  return {
+    esc,
+    temperature: frame[0],
+    voltage: ((frame[1] << 8) | frame[2]) / 100,
+    current: ((frame[3] << 8) | frame[4]) / 100,
+    consumption: (frame[5] << 8) | frame[6],
+    erpm: ((frame[7] << 8) | frame[8]) * 100,
+    timestamp: Date.now(),
+  };
+}
+
+export function erpmToRpm(erpm: number, motorPoles: number) {
+  return Math.round(erpm / (motorPoles / 2));
+}
+
+// the flight controller polls its escs in order, so frames arrive round
+// robin. the tapped wire carries no esc index and the requests are not
+// visible from here, so attribution relies on that order. bytes dropped
+// while resyncing after a bad crc are counted as the slots they took, a
+// frame an esc never sent still shifts every later reading
+export class EscTelemetryDecoder {
+  private buf: number[] = [];
+  private next = 0;
+  private dropped = 0;
+
+  public errors = 0;
+
+  constructor(private escCount = 4) {}
+
+  public push(chunk: ArrayLike<number>): EscTelemetry[] {
+    for (let i = 0; i < chunk.length; i++) {
+      this.buf.push(chunk[i]);
+    }
+
+    const frames: EscTelemetry[] = [];
+    while (this.buf.length >= ESC_TELEMETRY_FRAME_SIZE) {
+      const frame = decodeEscTelemetry(this.buf);
+      if (!frame) {
+        this.buf.shift();
+        this.dropped++;
+        this.errors++;
+        continue;
+      }
+      const lost = Math.round(this.dropped / ESC_TELEMETRY_FRAME_SIZE);
+      this.next = (this.next + lost) % this.escCount;
+      this.dropped = 0;
+
+      frame.esc = this.next;
+      this.buf.splice(0, ESC_TELEMETRY_FRAME_SIZE);
+      this.next = (this.next + 1) % this.escCount;
+      frames.push(frame);
+    }
+    return frames;
+  }
+
+  public reset() {
+    this.buf = [];
+    this.next = 0;
+    this.dropped = 0;
+  }
+}
+
+// typed telemetry stream read from a serial passthrough of the esc
+// telemetry wire, latest frame per esc is kept for polling uis
+export class EscTelemetryStream {
+  private channel = new AsyncChannel<EscTelemetry>(TELEMETRY_BUFFER_SIZE);
+  private decoder: EscTelemetryDecoder;
+  private reader?: ReadableStreamDefaultReader<Uint8Array>;
+
+  public latest: EscTelemetry[] = [];
+
+  constructor(
+    private stream: PassthroughStream,
+    escCount = 4
+  ) {
+    this.decoder = new EscTelemetryDecoder(escCount);
+  }
+
+  public get errors() {
+    return this.decoder.errors;
+  }
+
+  public subscribe(fn: (t: EscTelemetry) => void) {
+    return this.channel.subscribe(fn);
+  }
+
+  public start() {
+    this.reader = this.stream.readable.getReader();
+    this.readLoop().catch((err) => Log.warn("esc", "telemetry", err));
+  }
+
+  public async stop() {
+    const reader = this.reader;
+    this.reader = undefined;
+    await reader?.cancel().catch(() => undefined);
+    reader?.releaseLock();
+    await this.stream.close();
+  }
+
+  private async readLoop() {
+    while (this.reader) {
+      const { value, done } = await this.reader.read();
+      if (done || !value) {
+        break;
+      }
+      for (const frame of this.decoder.push(value)) {
+        this.latest[frame.esc] = frame;
+        this.channel.push(frame);
+      }
+    }
+  }
+}
@@ -0,0 +1,72 @@
+import { AsyncChannel } from "./async";
+
+export enum QuicEvent {
+  Log,
+  Blackbox,
+  Disconnect,
+  Error,
+  Desync,
+  InfoChanged,
+  DirtyChanged,
+  Diagnostic,
+  ValueSet,
+}
+
+export type EventHandler = (payload: any) => void;
+
+export type Subscription = (() => void) & { readonly dropped: number };
+
+const DEFAULT_BUFFER_SIZE = 256;
+
+export class EventBus {
+  private subscribers = new Map<QuicEvent, Set<AsyncChannel<any>>>();
+
+  subscribe(
+    type: QuicEvent,
+    fn: EventHandler,
+    size = DEFAULT_BUFFER_SIZE
+  ): Subscription {
+    const channel = new AsyncChannel<any>(size);
+    channel.subscribe(fn);
+
+    if (!this.subscribers.has(type)) {
+      this.subscribers.set(type, new Set());
+    }
+    this.subscribers.get(type)!.add(channel);
+
+    const unsubscribe = () => {
+      this.subscribers.get(type)?.delete(channel);
+      channel.close();
+    };
+    return Object.defineProperty(unsubscribe, "dropped", {
+      get: () => channel.dropped,
+    }) as Subscription;
+  }
+
+  emit(type: QuicEvent, payload?: any) {
+    const channels = this.subscribers.get(type);
+    if (!channels) {
+      return;
+    }
+    for (const channel of channels) {
+      channel.push(payload);
+    }
+  }
+
+  dropped(type: QuicEvent) {
+    let dropped = 0;
+    for (const channel of this.subscribers.get(type) || []) {
+      dropped += channel.dropped;
+    }
+    return dropped;
+  }
+
+  clear() {
+    for (const channels of this.subscribers.values()) {
+      for (const channel of channels) {
+        channel.close();
+      }
+    }
+    this.subscribers.clear();
+  }
+}
@@ -0,0 +1,295 @@
+import { Log } from "@/log";
+import { crc16 } from "../util";
+import { QuicCmd, QuicMotor } from "./quic";
+import type { PassthroughStream, Serial } from "./serial";
+
+const FOURWAY_TIMEOUT = 2000;
+
+const FOURWAY_PC_SYNC = 0x2f;
+const FOURWAY_FC_SYNC = 0x2e;
+
+export enum FourWayCmd {
+  TestAlive = 0x30,
+  GetProtocolVersion = 0x31,
+  GetName = 0x32,
+  GetVersion = 0x33,
+  Exit = 0x34,
+  DeviceReset = 0x35,
+  InitFlash = 0x37,
+  EraseAll = 0x38,
+  PageErase = 0x39,
+  Read = 0x3a,
+  Write = 0x3b,
+  ReadEEprom = 0x3d,
+  WriteEEprom = 0x3e,
+  SetMode = 0x3f,
+}
+
+export enum FourWayAck {
+  Ok = 0x00,
+  UnknownError = 0x01,
+  InvalidCmd = 0x02,
+  InvalidCrc = 0x03,
+  VerifyError = 0x04,
+  InvalidChannel = 0x08,
+  InvalidParam = 0x09,
+  GeneralError = 0x0f,
+}
+
+export enum FourWayMode {
+  SiLC = 0,
+  SiLBLB = 1,
+  AtmBLB = 2,
+  AtmSK = 3,
+  ARMBLB = 4,
+}
+
+export class FourWayError extends Error {
+  constructor(
+    public cmd: FourWayCmd,
+    public ack: FourWayAck
+  ) {
+    super(`4way ${FourWayCmd[cmd]} failed: ${FourWayAck[ack] || ack}`);
+  }
+}
+
+export interface FourWayResponse {
+  cmd: FourWayCmd;
+  address: number;
+  params: Uint8Array;
+  ack: FourWayAck;
+}
+
+export interface EscInfo {
+  index: number;
+  signature: number;
+  mode: FourWayMode;
+  settings?: EscSettings;
+}
+
+export interface EscSettings {
+  MAIN_REVISION: number;
+  SUB_REVISION: number;
+  LAYOUT_REVISION: number;
+  LAYOUT: string;
+  MCU: string;
+  NAME: string;
+  raw: Uint8Array;
+}
+
+// where the blheli settings block lives for each bootloader flavour
+const SETTINGS_LAYOUT = {
+  [FourWayMode.SiLC]: { address: 0x1a00, size: 0x70, eeprom: false },
+  [FourWayMode.SiLBLB]: { address: 0x1a00, size: 0x70, eeprom: false },
+  [FourWayMode.AtmBLB]: { address: 0x0000, size: 0x70, eeprom: true },
+  [FourWayMode.AtmSK]: { address: 0x0000, size: 0x70, eeprom: true },
+  [FourWayMode.ARMBLB]: { address: 0x7c00, size: 0xb0, eeprom: false },
+};
+
+const SILABS_PAGE_SIZE = 0x200;
+
+export function encodeFourWay(
+  cmd: FourWayCmd,
+  address = 0,
+  params: number[] = [0]
+) {
+  if (!params.length || params.length > 256) {
+    throw new Error("invalid 4way param length " + params.length);
+  }
+  const frame = [
+    FOURWAY_PC_SYNC,
+    cmd,
+    (address >> 8) & 0xff,
+    address & 0xff,
+    params.length & 0xff,
+    ...params,
+  ];
+  const crc = crc16(frame);
+  return Uint8Array.from([...frame, crc >> 8, crc & 0xff]);
+}
+
+// returns the response and the bytes left over, or undefined if incomplete
+export function decodeFourWay(
+  buf: number[]
+): [FourWayResponse, number[]] | undefined {
+  const start = buf.indexOf(FOURWAY_FC_SYNC);
+  if (start < 0 || buf.length - start < 5) {
+    return undefined;
+  }
+  buf = buf.slice(start);
+
+  const len = buf[4] || 256;
+  const size = 5 + len + 3;
+  if (buf.length < size) {
+    return undefined;
+  }
+
+  const crc = crc16(buf.slice(0, size - 2));
+  if (crc != ((buf[size - 2] << 8) | buf[size - 1])) {
+    throw new Error("4way crc mismatch");
+  }
+  return [
+    {
+      cmd: buf[1],
+      address: (buf[2] << 8) | buf[3],
+      params: Uint8Array.from(buf.slice(5, 5 + len)),
+      ack: buf[5 + len],
+    },
+    buf.slice(size),
+  ];
+}
+
+function decodeString(data: Uint8Array) {
+  return String.fromCharCode(...data.filter((c) => c >= 0x20 && c < 0x7f));
+}
+
+export function decodeEscSettings(raw: Uint8Array): EscSettings {
+  return {
+    MAIN_REVISION: raw[0],
+    SUB_REVISION: raw[1],
+    LAYOUT_REVISION: raw[2],
+    LAYOUT: decodeString(raw.subarray(0x40, 0x50)),
+    MCU: decodeString(raw.subarray(0x50, 0x60)),
+    NAME: decodeString(raw.subarray(0x60, 0x70)),
+    raw,
+  };
+}
+
+// blheli 4-way interface spoken through the flight controller, the
+// quic connection is detached once the firmware switched into 4way
+export class FourWay {
+  private reader: ReadableStreamDefaultReader<Uint8Array>;
+  private writer: WritableStreamDefaultWriter<Uint8Array>;
+  private buf: number[] = [];
+
+  constructor(
+    private stream: PassthroughStream,
+    public escCount: number
+  ) {
+    this.reader = stream.readable.getReader();
+    this.writer = stream.writable.getWriter();
+  }
+
+  public static async open(serial: Serial) {
+    const res = await serial.command(QuicCmd.Motor, QuicMotor.Esc4WayIf);
+    const fourway = new FourWay(await serial.detach(), res.payload[0] || 0);
+
+    const version = await fourway.command(FourWayCmd.GetProtocolVersion);
+    Log.info("4way", "protocol", version.params[0], "escs", fourway.escCount);
+    return fourway;
+  }
+
+  public async command(cmd: FourWayCmd, address = 0, params?: number[]) {
+    await this.writer.write(encodeFourWay(cmd, address, params));
+    for (;;) {
+      const res = decodeFourWay(this.buf);
+      if (res) {
+        const [frame, rest] = res;
+        this.buf = rest;
+        if (frame.cmd != cmd) {
+          continue;
+        }
+        if (frame.ack != FourWayAck.Ok) {
+          throw new FourWayError(cmd, frame.ack);
+        }
+        return frame;
+      }
+      this.buf = [...this.buf, ...(await this.read())];
+    }
+  }
+
+  public async enumerate() {
+    const escs: EscInfo[] = [];
+    for (let i = 0; i < this.escCount; i++) {
+      try {
+        const esc = await this.select(i);
+        esc.settings = await this.readSettings(esc);
+        escs.push(esc);
+      } catch (err) {
+        Log.warn("4way", "esc", i, "not responding", err);
+      }
+    }
+    return escs;
+  }
+
+  public async select(index: number): Promise<EscInfo> {
+    const res = await this.command(FourWayCmd.InitFlash, 0, [index]);
+    return {
+      index,
+      signature: (res.params[1] << 8) | res.params[0],
+      mode: res.params[3],
+    };
+  }
+
+  public async readSettings(esc: EscInfo) {
+    const layout = SETTINGS_LAYOUT[esc.mode];
+    if (!layout) {
+      throw new Error("unsupported 4way mode " + esc.mode);
+    }
+    const cmd = layout.eeprom ? FourWayCmd.ReadEEprom : FourWayCmd.Read;
+    const res = await this.command(cmd, layout.address, [layout.size]);
+    return decodeEscSettings(res.params.slice(0, layout.size));
+  }
+
+  public async writeSettings(esc: EscInfo, raw: Uint8Array) {
+    const layout = SETTINGS_LAYOUT[esc.mode];
+    if (!layout || raw.length != layout.size) {
+      throw new Error("invalid settings for 4way mode " + esc.mode);
+    }
+
+    await this.select(esc.index);
+    if (layout.eeprom) {
+      await this.command(FourWayCmd.WriteEEprom, layout.address, [...raw]);
+    } else {
+      if (esc.mode != FourWayMode.ARMBLB) {
+        const page = Math.floor(layout.address / SILABS_PAGE_SIZE);
+        await this.command(FourWayCmd.PageErase, 0, [page]);
+      }
+      await this.command(FourWayCmd.Write, layout.address, [...raw]);
+    }
+
+    const check = await this.readSettings(esc);
+    if (check.raw.some((b, i) => b != raw[i])) {
+      throw new FourWayError(FourWayCmd.Write, FourWayAck.VerifyError);
+    }
+    esc.settings = check;
+    return check;
+  }
+
+  public async reset(index: number) {
+    await this.command(FourWayCmd.DeviceReset, 0, [index]);
+  }
+
+  public async close() {
+    try {
+      await this.command(FourWayCmd.Exit);
+    } catch (err) {
+      Log.warn("4way", "exit failed", err);
+    }
+    this.reader.releaseLock();
+    this.writer.releaseLock();
+    await this.stream.close();
+  }
+
+  private async read() {
+    let timer: any;
+    const timeout = new Promise<never>((_, reject) => {
+      timer = setTimeout(
+        () => reject(new Error("4way timeout")),
+        FOURWAY_TIMEOUT
+      );
+    });
+    try {
+      const { value, done } = await Promise.race([
+        this.reader.read(),
+        timeout,
+      ]);
+      if (done) {
+        throw new Error("4way stream closed");
+      }
+      return value;
+    } finally {
+      clearTimeout(timer);
+    }
+  }
+}
@@ -0,0 +1,93 @@
+import { Log } from "@/log";
+import { isKnownPort } from "./discover";
+import { WebSerial } from "./webserial";
+
+const HOTPLUG_POLL_INTERVAL = 1000;
+
+const events: any = WebSerial;
+
+export type PortHandler = (port: any) => void;
+
+// the polyfill has no connect/disconnect events, fall back to diffing
+// getPorts() on an interval there
+export class PortWatcher {
+  private timer?: any;
+  private known = new Set<any>();
+
+  constructor(
+    private onConnect: PortHandler,
+    private onDisconnect: PortHandler,
+    private interval = HOTPLUG_POLL_INTERVAL
+  ) {
+    this.handleConnect = this.handleConnect.bind(this);
+    this.handleDisconnect = this.handleDisconnect.bind(this);
+  }
+
+  async start() {
+    this.stop();
+
+    this.known = new Set(await this.ports());
+    if (events.addEventListener) {
+      events.addEventListener("connect", this.handleConnect);
+      events.addEventListener("disconnect", this.handleDisconnect);
+    } else {
+      this.timer = setInterval(() => this.poll(), this.interval);
+    }
+  }
+
+  stop() {
+    clearInterval(this.timer);
+    this.timer = undefined;
+    events.removeEventListener?.("connect", this.handleConnect);
+    events.removeEventListener?.("disconnect", this.handleDisconnect);
+  }
+
+  private async ports() {
+    const ports = await WebSerial.getPorts();
+    return ports.filter((p) => isKnownPort(p.getInfo?.() ?? {}));
+  }
+
+  private async poll() {
+    try {
+      const ports = await this.ports();
+      for (const port of ports) {
+        if (!this.known.has(port)) {
+          this.connected(port);
+        }
+      }
+      for (const port of this.known) {
+        if (!ports.includes(port)) {
+          this.disconnected(port);
+        }
+      }
+    } catch (err) {
+      Log.warn("serial", "port poll failed", err);
+    }
+  }
+
+  private handleConnect(event: Event) {
+    const port: any = event.target;
+    if (isKnownPort(port.getInfo?.() ?? {})) {
+      this.connected(port);
+    }
+  }
+
+  private handleDisconnect(event: Event) {
+    const port: any = event.target;
+    if (this.known.has(port) || isKnownPort(port.getInfo?.() ?? {})) {
+      this.disconnected(port);
+    }
+  }
+
+  private connected(port: any) {
+    this.known.add(port);
+    Log.info("serial", "port connected", port.getInfo?.());
+    this.onConnect(port);
+  }
+
+  private disconnected(port: any) {
+    this.known.delete(port);
+    Log.info("serial", "port disconnected", port.getInfo?.());
+    this.onDisconnect(port);
+  }
+}
@@ -0,0 +1,50 @@
+import { Log } from "@/log";
+import type { Serial } from "./serial";
+
+const KEEPALIVE_INTERVAL = 1000;
+const KEEPALIVE_MAX_FAILURES = 3;
+
+export class Keepalive {
+  private timer?: any;
+  private failures = 0;
+  private busy = false;
+
+  constructor(
+    private serial: Serial,
+    private onLost: () => void,
+    private interval = KEEPALIVE_INTERVAL
+  ) {}
+
+  start() {
+    this.stop();
+    this.timer = setInterval(() => this.tick(), this.interval);
+  }
+
+  stop() {
+    clearInterval(this.timer);
+    this.timer = undefined;
+    this.failures = 0;
+  }
+
+  private async tick() {
+    const idle = performance.now() - this.serial.lastActivity;
+    if (this.busy || idle < this.interval) {
+      return;
+    }
+
+    this.busy = true;
+    try {
+      await this.serial.ping(this.interval);
+      this.failures = 0;
+    } catch (err) {
+      this.failures++;
+      Log.warn("serial", "keepalive failed", this.failures, err);
+      if (this.failures >= KEEPALIVE_MAX_FAILURES) {
+        this.stop();
+        this.onLost();
+      }
+    } finally {
+      this.busy = false;
+    }
+  }
+}
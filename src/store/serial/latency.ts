@@ -0,0 +1,38 @@
+export interface LatencyStats {
+  last: number;
+  min: number;
+  max: number;
+  avg: number;
+  samples: number;
+}
+
+export class LatencyTracker {
+  private samples: number[] = [];
+
+  constructor(private size = 32) {}
+
+  record(ms: number) {
+    if (this.samples.length >= this.size) {
+      this.samples.shift();
+    }
+    this.samples.push(ms);
+  }
+
+  reset() {
+    this.samples = [];
+  }
+
+  stats(): LatencyStats | undefined {
+    if (!this.samples.length) {
+      return undefined;
+    }
+    const sum = this.samples.reduce((a, b) => a + b, 0);
+    return {
+      last: this.samples[this.samples.length - 1],
+      min: Math.min(...this.samples),
+      max: Math.max(...this.samples),
+      avg: sum / this.samples.length,
+      samples: this.samples.length,
+    };
+  }
+}
@@ -0,0 +1,179 @@
+import { CBOR } from "./cbor";
+import {
+  QuicCmd,
+  QuicFlag,
+  QuicVal,
+  QUIC_HEADER_LEN,
+  QUIC_MAGIC,
+  encodeHeader,
+  parseHeader,
+} from "./quic";
+import { concatUint8Array, encodeSemver } from "../util";
+import type { Transport } from "./transport";
+
+const MOCK_MAX_PAYLOAD = 0xffff;
+
+export type MockHandler = (values: any[]) => any[] | Promise<any[]>;
+
+const defaultInfo = () => ({
+  target_name: "mock",
+  mcu: "sim",
+  git_version: "mock",
+  features: 0,
+  rx_protocols: [],
+  quic_protocol_version: encodeSemver("0.2.0"),
+  motor_pins: [],
+  usart_ports: [],
+  gyro_id: 0,
+});
+
+export class MockTarget implements Transport {
+  public values = new Map<QuicVal, any>([
+    [QuicVal.Info, defaultInfo()],
+    [QuicVal.State, {}],
+  ]);
+  public errors = new Map<QuicCmd, string>();
+  public handlers = new Map<QuicCmd, MockHandler>();
+  public streamChunkSize = 0;
+
+  public readable?: ReadableStream<Uint8Array>;
+  public writable?: WritableStream<Uint8Array>;
+
+  private controller?: ReadableStreamDefaultController<Uint8Array>;
+  private buffer = new Uint8Array();
+  private upload?: Uint8Array;
+
+  public getInfo() {
+    return {};
+  }
+
+  public describe() {
+    return "mock";
+  }
+
+  public async open(_opts?: any) {
+    this.readable = new ReadableStream<Uint8Array>({
+      start: (controller) => {
+        this.controller = controller;
+      },
+    });
+    this.writable = new WritableStream<Uint8Array>({
+      write: (chunk) => this.receive(chunk),
+    });
+  }
+
+  public async close() {
+    try {
+      this.controller?.close();
+    } catch {
+      // already closed by the reader
+    }
+    this.controller = undefined;
+    this.readable = undefined;
+    this.writable = undefined;
+  }
+
+  public log(msg: string) {
+    this.emit(QuicCmd.Log, QuicFlag.None, CBOR.encode(msg));
+  }
+
+  public blackbox(payload: any) {
+    this.emit(QuicCmd.Blackbox, QuicFlag.None, CBOR.encode(payload));
+  }
+
+  private async receive(chunk: Uint8Array) {
+    this.buffer = concatUint8Array(this.buffer, chunk);
+
+    for (;;) {
+      const start = this.buffer.indexOf(QUIC_MAGIC);
+      if (start < 0) {
+        this.buffer = new Uint8Array();
+        return;
+      }
+      this.buffer = this.buffer.slice(start);
+      if (this.buffer.length < QUIC_HEADER_LEN) {
+        return;
+      }
+
+      const { cmd, flag, len } = parseHeader(this.buffer);
+      if (this.buffer.length < QUIC_HEADER_LEN + len) {
+        return;
+      }
+
+      const payload = this.buffer.slice(QUIC_HEADER_LEN, QUIC_HEADER_LEN + len);
+      this.buffer = this.buffer.slice(QUIC_HEADER_LEN + len);
+
+      if (flag & QuicFlag.Streaming) {
+        const prev = this.upload || new Uint8Array();
+        this.upload = concatUint8Array(prev, payload);
+        if (len) {
+          continue;
+        }
+        const upload = this.upload;
+        this.upload = undefined;
+        await this.handle(cmd, upload.length ? CBOR.decode(upload) : []);
+        continue;
+      }
+      await this.handle(cmd, len ? CBOR.decode(payload) : []);
+    }
+  }
+
+  private async handle(cmd: QuicCmd, values: any[]) {
+    const error = this.errors.get(cmd);
+    if (error) {
+      return this.respond(cmd, QuicFlag.Error, [error]);
+    }
+
+    const handler = this.handlers.get(cmd);
+    if (handler) {
+      return this.respond(cmd, QuicFlag.None, await handler(values));
+    }
+
+    switch (cmd) {
+      case QuicCmd.Get:
+        if (!this.values.has(values[0])) {
+          return this.respond(cmd, QuicFlag.Error, ["invalid value"]);
+        }
+        return this.respond(cmd, QuicFlag.None, [
+          values[0],
+          this.values.get(values[0]),
+        ]);
+
+      case QuicCmd.Set:
+        this.values.set(values[0], values[1]);
+        return this.respond(cmd, QuicFlag.None, [values[0], values[1]]);
+
+      case QuicCmd.Validate:
+        return this.respond(cmd, QuicFlag.None, [values[0], values[1]]);
+
+      default:
+        return this.respond(cmd, QuicFlag.None, []);
+    }
+  }
+
+  private respond(cmd: QuicCmd, flag: QuicFlag, values: any[]) {
+    let payload = new Uint8Array();
+    for (const v of values) {
+      payload = concatUint8Array(payload, CBOR.encode(v));
+    }
+
+    let chunkSize = this.streamChunkSize;
+    if (!chunkSize && payload.length > MOCK_MAX_PAYLOAD) {
+      chunkSize = MOCK_MAX_PAYLOAD;
+    }
+    if (!chunkSize || !payload.length || flag != QuicFlag.None) {
+      return this.emit(cmd, flag, payload);
+    }
+
+    for (let i = 0; i < payload.length; i += chunkSize) {
+      const chunk = payload.slice(i, i + chunkSize);
+      this.emit(cmd, QuicFlag.Streaming, chunk);
+    }
+    this.emit(cmd, QuicFlag.Streaming, new Uint8Array());
+  }
+
+  private emit(cmd: QuicCmd, flag: QuicFlag, payload: Uint8Array) {
+    const header = encodeHeader({ cmd, flag, len: payload.length });
+    this.controller?.enqueue(concatUint8Array(header, payload));
+  }
+}
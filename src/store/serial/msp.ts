@@ -0,0 +1,145 @@
+import { settings } from "./settings";
+import type { Transport } from "./transport";
+
+const MSP_TIMEOUT = 1000;
+
+enum MspCmd {
+  ApiVersion = 1,
+  FcVariant = 2,
+  FcVersion = 3,
+  BoardInfo = 4,
+}
+
+const FIRMWARE_VARIANTS = {
+  BTFL: "Betaflight",
+  INAV: "INAV",
+  EMUF: "EmuFlight",
+  CLFL: "Cleanflight",
+  BBFL: "Baseflight",
+};
+
+export interface MspInfo {
+  variant: string;
+  firmware: string;
+  version: string;
+  api: string;
+  board: string;
+}
+
+export class ForeignFirmwareError extends Error {
+  constructor(public readonly info: MspInfo) {
+    super(
+      `this is ${info.firmware} ${info.version} on ${info.board}, ` +
+        "not Quicksilver"
+    );
+  }
+}
+
+function encodeRequest(cmd: MspCmd) {
+  return Uint8Array.from([0x24, 0x4d, 0x3c, 0, cmd, cmd]);
+}
+
+// pulls complete $M> frames out of buf, returns the unconsumed rest
+function parseFrames(buf: number[], frames: Map<number, Uint8Array>) {
+  for (;;) {
+    const start = buf.findIndex(
+      (b, i) => b == 0x24 && buf[i + 1] == 0x4d && buf[i + 2] == 0x3e
+    );
+    if (start < 0) {
+      return [];
+    }
+    buf = buf.slice(start);
+    if (buf.length < 6) {
+      return buf;
+    }
+
+    const size = buf[3];
+    if (buf.length < 6 + size) {
+      return buf;
+    }
+
+    const cmd = buf[4];
+    let checksum = size ^ cmd;
+    for (let i = 0; i < size; i++) {
+      checksum ^= buf[5 + i];
+    }
+    if (checksum == buf[5 + size]) {
+      frames.set(cmd, Uint8Array.from(buf.slice(5, 5 + size)));
+    }
+    buf = buf.slice(6 + size);
+  }
+}
+
+function decodeBoard(payload?: Uint8Array) {
+  if (!payload || payload.length < 4) {
+    return "unknown board";
+  }
+  const identifier = String.fromCharCode(...payload.subarray(0, 4));
+  if (payload.length > 8) {
+    const len = payload[8];
+    const name = payload.subarray(9, 9 + len);
+    if (len && name.length == len) {
+      return String.fromCharCode(...name);
+    }
+  }
+  return identifier;
+}
+
+// betaflight and friends answer msp v1 on the same usb vcp, probing it
+// turns a confusing handshake timeout into a useful message
+export async function probeMsp(
+  port: Transport,
+  timeout = MSP_TIMEOUT
+): Promise<MspInfo | undefined> {
+  await port.open({
+    baudRate: settings.serial.baudRate,
+    bufferSize: settings.serial.bufferSize,
+  });
+
+  const reader = port.readable!.getReader();
+  const writer = port.writable!.getWriter();
+  const frames = new Map<number, Uint8Array>();
+  const wanted = [
+    MspCmd.ApiVersion,
+    MspCmd.FcVariant,
+    MspCmd.FcVersion,
+    MspCmd.BoardInfo,
+  ];
+
+  const timer = setTimeout(() => reader.cancel(), timeout);
+  try {
+    for (const cmd of wanted) {
+      await writer.write(encodeRequest(cmd));
+    }
+
+    let buf: number[] = [];
+    while (!wanted.every((cmd) => frames.has(cmd))) {
+      const { value, done } = await reader.read();
+      if (done) {
+        break;
+      }
+      buf = parseFrames([...buf, ...value], frames);
+    }
+  } finally {
+    clearTimeout(timer);
+    reader.releaseLock();
+    writer.releaseLock();
+    await port.close();
+  }
+
+  const variant = frames.get(MspCmd.FcVariant);
+  const version = frames.get(MspCmd.FcVersion);
+  if (!variant || !version) {
+    return undefined;
+  }
+
+  const api = frames.get(MspCmd.ApiVersion);
+  const name = String.fromCharCode(...variant);
+  return {
+    variant: name,
+    firmware: FIRMWARE_VARIANTS[name] || name,
+    version: `${version[0]}.${version[1]}.${version[2]}`,
+    api: api ? `${api[1]}.${api[2]}` : "unknown",
+    board: decodeBoard(frames.get(MspCmd.BoardInfo)),
+  };
+}
@@ -0,0 +1,84 @@
+import { Log } from "@/log";
+import type { Transport } from "./transport";
+
+const LOCK_PREFIX = "quic-port:";
+
+export class PortBusyError extends Error {
+  constructor(
+    public readonly holder: string,
+    public readonly cause?: any
+  ) {
+    super(`port is in use by ${holder}`);
+  }
+}
+
+export interface PortLock {
+  // resolves once the lock is free for the next open
+  release(): Promise<void>;
+}
+
+// web serial only tells us vid:pid, which every quicksilver board shares,
+// so the lock is keyed by the port object and only guards this window.
+// another window or program is left to the os refusing the open
+const windowId = Math.random().toString(36).substring(2);
+const portIds = new WeakMap<Transport, number>();
+let nextPortId = 1;
+
+export function lockName(port: Transport) {
+  let id = portIds.get(port);
+  if (id === undefined) {
+    id = nextPortId++;
+    portIds.set(port, id);
+  }
+  return `${LOCK_PREFIX}${windowId}:${id}`;
+}
+
+function locksAvailable() {
+  return typeof navigator !== "undefined" && !!navigator.locks;
+}
+
+// taken before the port is opened, a port this window already has open
+// fails the connect right away instead of waiting for it to let go
+export async function acquirePortLock(port: Transport): Promise<PortLock> {
+  if (!locksAvailable()) {
+    return { release: () => Promise.resolve() };
+  }
+
+  let unlock: () => void = () => undefined;
+  const held = new Promise<void>((resolve) => (unlock = resolve));
+  let done: Promise<void> = Promise.resolve();
+  const granted = await new Promise<boolean>((resolve) => {
+    done = navigator.locks
+      .request(
+        lockName(port),
+        { mode: "exclusive", ifAvailable: true },
+        (lock) => {
+          resolve(!!lock);
+          return lock ? held : undefined;
+        }
+      )
+      .catch((err) => {
+        Log.warn("serial", "port lock failed", err);
+        resolve(true);
+      });
+  });
+  if (!granted) {
+    throw new PortBusyError("this window");
+  }
+  return {
+    release: () => {
+      unlock();
+      return done;
+    },
+  };
+}
+
+// the os refuses the open while we hold the lock, so it is not this
+// window, identical boards cannot tell which one it is
+export function portBusyError(cause: any) {
+  return new PortBusyError("another window or program", cause);
+}
+
+export function isPortBusy(err: any) {
+  return err?.name == "InvalidStateError" || err?.name == "NetworkError";
+}
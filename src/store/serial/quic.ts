@@ -1,5 +1,6 @@
 export const QUIC_MAGIC = "#".charCodeAt(0);
 export const QUIC_HEADER_LEN = 4;
+export const QUIC_CRC_LEN = 2;
 
 export enum QuicCmd {
   Invalid,
@@ -12,6 +13,8 @@ export enum QuicCmd {
   CalSticks,
   Serial,
   OSD,
+  // like Set, but the firmware only answers what it would store
+  Validate,
   Max,
 }
 
@@ -35,6 +38,9 @@ export enum QuicBlackbox {
   Reset,
   List,
   Get,
+  // index, byte offset and length, answers whole entries and the offset
+  // to continue at
+  GetRange,
 }
 
 export enum QuicMotor {
@@ -55,6 +61,7 @@ export enum QuicFlag {
   Error,
   Streaming,
   Exit,
+  Compressed,
 }
 
 export interface QuicHeader {
@@ -66,3 +73,55 @@ export interface QuicHeader {
 export interface QuicPacket extends QuicHeader {
   payload: any;
 }
+
+export type QuicDirection = "tx" | "rx";
+
+export type PacketMiddleware = (
+  dir: QuicDirection,
+  hdr: QuicHeader,
+  payload: Uint8Array
+) => void;
+
+export function quicCmdName(cmd: QuicCmd): string {
+  return QuicCmd[cmd] ?? `Unknown(${cmd})`;
+}
+
+export function quicValName(val: QuicVal): string {
+  return QuicVal[val] ?? `Unknown(${val})`;
+}
+
+export function quicFlagName(flag: QuicFlag): string {
+  if (QuicFlag[flag]) {
+    return QuicFlag[flag];
+  }
+  const names: string[] = [];
+  for (const bit of [QuicFlag.Error, QuicFlag.Streaming, QuicFlag.Compressed]) {
+    if (flag & bit) {
+      names.push(QuicFlag[bit]);
+    }
+  }
+  return names.join("|");
+}
+
+export function encodeHeader(hdr: QuicHeader): Uint8Array {
+  return Uint8Array.from([
+    QUIC_MAGIC,
+    (hdr.flag << 5) | hdr.cmd,
+    (hdr.len >> 8) & 0xff,
+    hdr.len & 0xff,
+  ]);
+}
+
+export function parseHeader(data: Uint8Array): QuicHeader {
+  if (data.length < QUIC_HEADER_LEN) {
+    throw new Error("short header");
+  }
+  if (data[0] != QUIC_MAGIC) {
+    throw new Error("invalid magic " + data[0]);
+  }
+  return {
+    cmd: data[1] & (0xff >> 3),
+    flag: data[1] >> 5,
+    len: (data[2] << 8) | data[3],
+  };
+}
@@ -0,0 +1,85 @@
+import { Log } from "@/log";
+import { AsyncChannel } from "./async";
+import { QuicVal } from "./quic";
+import type { Serial } from "./serial";
+
+export const RC_PREVIEW_RATE = 20;
+
+export interface RcFrame {
+  channels: number[]; // filtered, -1..1 and 0..1 for throttle
+  raw?: number[];
+  time: number;
+  source: "state" | "blackbox";
+}
+
+// polls the state value at a fixed rate, but backs off while frames are
+// pushed from a faster source like the blackbox stream
+export class RcPreview {
+  private channel = new AsyncChannel<RcFrame>(8);
+  private timer: any = null;
+  private inflight = false;
+  private lastPush = 0;
+
+  constructor(
+    private serial: Serial,
+    private rate = RC_PREVIEW_RATE
+  ) {}
+
+  public get interval() {
+    return 1000 / this.rate;
+  }
+
+  public get running() {
+    return this.timer != null;
+  }
+
+  public subscribe(fn: (f: RcFrame) => void) {
+    return this.channel.subscribe(fn);
+  }
+
+  public setRate(rate: number) {
+    this.rate = Math.max(1, Math.min(100, rate));
+    if (this.running) {
+      this.start();
+    }
+  }
+
+  public push(frame: RcFrame) {
+    this.lastPush = performance.now();
+    this.channel.push(frame);
+  }
+
+  public start() {
+    this.stop();
+    this.timer = setInterval(() => this.poll(), this.interval);
+  }
+
+  public stop() {
+    clearInterval(this.timer);
+    this.timer = null;
+  }
+
+  private async poll() {
+    if (this.inflight || !this.serial.connectedPort) {
+      return;
+    }
+    if (performance.now() - this.lastPush < this.interval * 2) {
+      return;
+    }
+
+    this.inflight = true;
+    try {
+      const state = await this.serial.get(QuicVal.State);
+      this.channel.push({
+        channels: [...(state.rx_filtered || [])],
+        raw: state.rx ? [...state.rx] : undefined,
+        time: performance.now(),
+        source: "state",
+      });
+    } catch (err) {
+      Log.warn("rc", err);
+    } finally {
+      this.inflight = false;
+    }
+  }
+}
@@ -0,0 +1,96 @@
+import { Log } from "@/log";
+import { asyncDelay } from "../util";
+
+const RECONNECT_BASE_DELAY = 250;
+const RECONNECT_MAX_DELAY = 8000;
+const RECONNECT_MAX_ATTEMPTS = 6;
+
+// a different board answered on the port, its state must not be mixed
+// with what the previous session loaded
+export class BoardChangedError extends Error {
+  constructor(
+    public readonly previous: any,
+    public readonly info: any
+  ) {
+    super(`expected ${previous?.target_name}, found ${info?.target_name}`);
+  }
+}
+
+export function sameBoard(a: any, b: any) {
+  return (
+    a?.target_name == b?.target_name &&
+    a?.mcu == b?.mcu &&
+    JSON.stringify(a?.uid) == JSON.stringify(b?.uid)
+  );
+}
+
+export type ReplayHook = (info: any) => void | Promise<void>;
+
+export class ReconnectSupervisor {
+  private hooks = new Set<ReplayHook>();
+  private running?: Promise<any>;
+  private cancelled = false;
+
+  constructor(
+    private open: () => Promise<any>,
+    private close: () => Promise<void>,
+    private maxAttempts = RECONNECT_MAX_ATTEMPTS,
+    private baseDelay = RECONNECT_BASE_DELAY
+  ) {}
+
+  // hooks run after every successful reconnect to restore state the
+  // firmware forgot, eg. streaming rates
+  register(hook: ReplayHook) {
+    this.hooks.add(hook);
+    return () => {
+      this.hooks.delete(hook);
+    };
+  }
+
+  cancel() {
+    this.cancelled = true;
+  }
+
+  reconnect(): Promise<any> {
+    if (!this.running) {
+      this.running = this._reconnect().finally(
+        () => (this.running = undefined)
+      );
+    }
+    return this.running;
+  }
+
+  private async _reconnect() {
+    this.cancelled = false;
+    await this.close();
+
+    for (let attempt = 0; attempt < this.maxAttempts; attempt++) {
+      const delay = this.baseDelay * 2 ** attempt;
+      await asyncDelay(Math.min(delay, RECONNECT_MAX_DELAY));
+      if (this.cancelled) {
+        throw new Error("reconnect cancelled");
+      }
+
+      let info: any;
+      try {
+        info = await this.open();
+      } catch (err) {
+        if (err instanceof BoardChangedError) {
+          throw err;
+        }
+        Log.warn("serial", "reconnect attempt", attempt + 1, "failed", err);
+        continue;
+      }
+
+      for (const hook of this.hooks) {
+        try {
+          await hook(info);
+        } catch (err) {
+          Log.warn("serial", "reconnect replay failed", err);
+        }
+      }
+      return info;
+    }
+    throw new Error("reconnect failed");
+  }
+}
@@ -0,0 +1,62 @@
+export enum RxPhase {
+  None = "none",
+  Binding = "binding",
+  Bound = "bound",
+  Searching = "searching",
+  Detected = "detected",
+}
+
+export interface RxStatus {
+  phase: RxPhase;
+  protocol: string;
+  serialProtocol?: string;
+  rssi: number;
+  failsafe: boolean;
+  channels: number[];
+}
+
+// spi receivers report 0..2, unified serial 100+n while trying protocol n
+// and 200+n once it was detected
+export function decodeRxPhase(rx_status: number) {
+  if (rx_status >= 200 && rx_status < 300) {
+    return { phase: RxPhase.Detected, serialProtocol: rx_status - 200 };
+  }
+  if (rx_status >= 100 && rx_status < 200) {
+    return { phase: RxPhase.Searching, serialProtocol: rx_status - 100 };
+  }
+  const phases = [RxPhase.None, RxPhase.Binding, RxPhase.Bound];
+  return { phase: phases[rx_status] || RxPhase.None };
+}
+
+export function isReceiving(phase: RxPhase) {
+  return phase == RxPhase.Bound || phase == RxPhase.Detected;
+}
+
+// a serial receiver is detected as soon as it sends frames, which it
+// does without a transmitter too. only rssi tells there is a link
+export function hasLink(status: Pick<RxStatus, "phase" | "rssi">) {
+  if (status.phase == RxPhase.Detected) {
+    return status.rssi > 0;
+  }
+  return status.phase == RxPhase.Bound;
+}
+
+export function decodeRxStatus(
+  state: { rx_status: number; rx_rssi: number; rx: number[] },
+  protocolNames: string[],
+  protocol: number,
+  serialProtocolNames: string[]
+): RxStatus {
+  const { phase, serialProtocol } = decodeRxPhase(state.rx_status);
+  return {
+    phase,
+    protocol: protocolNames[protocol] || "UNKNOWN",
+    serialProtocol:
+      serialProtocol !== undefined
+        ? serialProtocolNames[serialProtocol]
+        : undefined,
+    rssi: state.rx_rssi,
+    failsafe: !isReceiving(phase),
+    channels: [...(state.rx || [])],
+  };
+}
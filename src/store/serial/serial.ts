@@ -1,89 +1,423 @@
 import {
+  QuicBlackbox,
   QuicCmd,
   QuicFlag,
+  QuicMotor,
+  QuicOSD,
   QuicVal,
+  QUIC_CRC_LEN,
   QUIC_HEADER_LEN,
   QUIC_MAGIC,
+  encodeHeader,
+  parseHeader,
+  type PacketMiddleware,
+  type QuicDirection,
   type QuicHeader,
   type QuicPacket,
 } from "./quic";
-import { ArrayWriter, concatUint8Array, stringToUint8Array } from "../util";
+import {
+  ArrayWriter,
+  asyncDelay,
+  concatUint8Array,
+  crc16,
+  stringToUint8Array,
+} from "../util";
 import { AsyncQueue, AsyncSemaphore } from "./async";
+import { EventBus, QuicEvent } from "./events";
+import { PacketTrace } from "./trace";
+import { deflate, inflate } from "./compress";
+import { LatencyTracker } from "./latency";
 import { Log } from "@/log";
 import { CBOR } from "./cbor";
 import { WebSerial } from "./webserial";
-import { settings } from "./settings";
+import {
+  DfuNotGrantedError,
+  isDFUDevice,
+  requestDFUDevice,
+} from "../flash/flash";
+import { ForeignFirmwareError, probeMsp } from "./msp";
+import { describeTransport, type Transport } from "./transport";
+import {
+  acquirePortLock,
+  isPortBusy,
+  portBusyError,
+  type PortLock,
+} from "./portlock";
+import { settings, type CommandPolicy } from "./settings";
+import {
+  defaultCapabilities,
+  negotiateCapabilities,
+  type Capabilities,
+} from "./capabilities";
 
 const SOFT_REBOOT_MAGIC = "S";
+const COMPRESSION_THRESHOLD = 256;
+const WRITE_CHUNK_SIZE = 1024;
+const PROBE_TIMEOUT = 1000;
+const DETECT_TIMEOUT = 1000;
+const HANDSHAKE_TIMEOUT = 10_000;
+const DTR_RESET_PULSE = 100;
+const INFO_TTL = 5000;
+
+// getting these has side effects or takes seconds, assume they exist
+const UNSAFE_PROBE_VALUES = [QuicVal.OSDFont, QuicVal.BLHeliSettings];
 const HARD_REBOOT_MAGIC = "R";
+const BOOTLOADER_TIMEOUT = 10_000;
+const BOOTLOADER_POLL_INTERVAL = 250;
 
-const SERIAL_FILTERS = [
+export const SERIAL_FILTERS = [
   { usbVendorId: 0x0483, usbProductId: 0x5740 }, // quicksilver@stm32
   { usbVendorId: 0x2e3c, usbProductId: 0x5740 }, // quicksilver@at32
 ];
 
 export type ProgressCallbackType = (number) => void;
 
+export type SetHook = (ids: QuicVal[]) => Promise<void> | void;
+
+export interface PassthroughOptions {
+  port: number;
+  baudrate: number;
+  half_duplex: boolean;
+  stop_bits: number;
+}
+
+export interface PassthroughStream {
+  readable: ReadableStream<Uint8Array>;
+  writable: WritableStream<Uint8Array>;
+  close: () => Promise<void>;
+}
+
+export interface BootloaderDevice {
+  target?: string;
+  device: USBDevice;
+}
+
+export interface InfoOptions {
+  maxAge?: number;
+  timeout?: number;
+}
+
+export interface InfoChange {
+  previous: any;
+  info: any;
+}
+
+function infoIdentity(info: any) {
+  return `${info?.target_name}@${info?.git_version}`;
+}
+
+export interface ConnectOptions {
+  baudRate?: number;
+  dataBits?: 7 | 8;
+  stopBits?: 1 | 2;
+  parity?: "none" | "even" | "odd";
+  flowControl?: "none" | "hardware";
+  dtrReset?: boolean;
+  timeout?: number;
+}
+
+export interface QueueStats {
+  depth: number;
+  peak: number;
+  rejected: number;
+}
+
+export interface CommandOptions {
+  timeout?: number;
+  retries?: number;
+  progress?: ProgressCallbackType;
+  signal?: AbortSignal;
+}
+
+interface PendingCommand {
+  cmd: QuicCmd;
+  progress: ProgressCallbackType;
+  timeout?: number;
+  timer?: any;
+  resolve: (p: QuicPacket) => void;
+  reject: (err: any) => void;
+}
+
 // eslint-disable-next-line @typescript-eslint/no-empty-function
 const noProgress = () => {};
 
+// a single corrupted frame, the reader drops it and resyncs
+export class FrameError extends Error {
+  constructor(public readonly cmd: QuicCmd, message: string) {
+    super(message);
+  }
+}
+
+export class ChecksumError extends FrameError {
+  constructor(cmd: QuicCmd) {
+    super(cmd, "checksum mismatch cmd: " + cmd);
+  }
+}
+
+export class DecodeError extends FrameError {
+  constructor(cmd: QuicCmd, cause: any) {
+    super(cmd, "decode failed cmd: " + cmd + ", " + cause);
+  }
+}
+
+export type DiagnosticKind = "checksum" | "decode" | "frame" | "desync";
+
+export interface Diagnostic {
+  kind: DiagnosticKind;
+  cmd?: QuicCmd;
+  message: string;
+}
+
+export class FirmwareError extends Error {
+  public readonly code: number;
+
+  constructor(public readonly cmd: QuicCmd, payload: any[]) {
+    const [code, message] =
+      typeof payload[0] == "number" ? payload : [0, payload[0]];
+    super(message);
+    this.code = code;
+  }
+}
+
+export class BusyError extends Error {
+  constructor(public readonly depth: number) {
+    super("busy, " + depth + " commands queued");
+  }
+}
+
+export class ClosedError extends Error {
+  constructor() {
+    super("closed");
+  }
+}
+
+function frameErrorKind(err: FrameError): DiagnosticKind {
+  if (err instanceof ChecksumError) {
+    return "checksum";
+  }
+  if (err instanceof DecodeError) {
+    return "decode";
+  }
+  return "frame";
+}
+
+function decodePayload(cmd: QuicCmd, buffer: Uint8Array) {
+  try {
+    return CBOR.decode(buffer);
+  } catch (err) {
+    throw new DecodeError(cmd, err);
+  }
+}
+
+// kept in ram after a set until the next profile set writes them out
+const SAVED_WITH_PROFILE = [QuicVal.BindInfo];
+
+function isRetryable(err: any) {
+  return err === "timeout" || err instanceof FrameError;
+}
+
+function isWriteCommand(cmd: QuicCmd, values: any[]) {
+  switch (cmd) {
+    case QuicCmd.Get:
+    case QuicCmd.Log:
+    case QuicCmd.Validate:
+      return false;
+    case QuicCmd.Motor:
+      return values[0] != QuicMotor.TestStatus;
+    case QuicCmd.OSD:
+      return values[0] != QuicOSD.ReadChar;
+    case QuicCmd.Blackbox:
+      return values[0] == QuicBlackbox.Reset;
+    default:
+      return true;
+  }
+}
+
 export class Serial {
-  private shouldRun = true;
+  public writeProtected = false;
+  public capabilities: Capabilities = defaultCapabilities();
+  public policies: { [cmd: number]: CommandPolicy } = {
+    ...settings.commands,
+  };
+
+  public readonly events = new EventBus();
+  public trace?: PacketTrace;
+  private middleware: PacketMiddleware[] = [];
+  private setHooks: SetHook[] = [];
+  private removeTrace?: () => void;
+  public readonly latency = new LatencyTracker();
+  public readonly diagnostics: { [kind in DiagnosticKind]: number } = {
+    checksum: 0,
+    decode: 0,
+    frame: 0,
+    desync: 0,
+  };
+  public lastActivity = 0;
+
+  private shouldRun = false;
   private reSync = true;
+  private crc = false;
+  private batch?: boolean;
 
   private waitingCommands = new AsyncSemaphore(1);
+  private queuePeak = 0;
+  private queueRejected = 0;
 
-  private port?: SerialPort;
+  private port?: Transport;
+  private portLock?: PortLock;
 
   private writer?: WritableStreamDefaultWriter<any>;
   private reader?: AsyncQueue;
+  private pending?: PendingCommand;
+  private closing?: Promise<void>;
+
+  private info?: { value: any; fetched: number };
+  private lastInfo?: any;
+  private unsaved = new Set<QuicVal>();
+
+  constructor() {
+    this.events.subscribe(QuicEvent.Log, (msg) =>
+      Log.info("serial", "[quic] " + msg)
+    );
+    this.events.subscribe(QuicEvent.Desync, (n) =>
+      Log.warn("serial", "[quic] desync recovered, discarded", n, "bytes")
+    );
+  }
+
+  public async connect(
+    errorCallback: any = console.warn,
+    opts: ConnectOptions = {}
+  ): Promise<any> {
+    const port = await WebSerial.requestPort({
+      filters: SERIAL_FILTERS,
+    });
+    return this.connectPort(port, errorCallback, opts);
+  }
+
+  public async connectFirstPort(
+    errorCallback: any = console.warn,
+    opts: ConnectOptions = {}
+  ): Promise<any> {
+    const ports = await WebSerial.getPorts();
+    if (!ports.length) {
+      throw new Error("no ports");
+    }
+    return this.connectPort(ports[0], errorCallback, opts);
+  }
 
-  public async connect(errorCallback: any = console.warn): Promise<any> {
+  public async connectPort(
+    port: Transport,
+    errorCallback: any = console.warn,
+    opts: ConnectOptions = {}
+  ): Promise<any> {
     try {
-      const port = await WebSerial.requestPort({
-        filters: SERIAL_FILTERS,
-      });
-      await this._connectPort(port, errorCallback);
-      return await this.get(QuicVal.Info, 10_000);
+      await this._connectPort(port, errorCallback, opts);
+      return await this.handshake(opts);
     } catch (err) {
       await this.close();
-      throw err;
+      throw await this.identifyFailure(port, err);
     }
   }
 
-  public async connectFirstPort(
-    errorCallback: any = console.warn
-  ): Promise<any> {
+  // a usb serial port that never answers quic might be running msp
+  private async identifyFailure(port: Transport, err: any) {
+    if (err !== "timeout" || port?.getInfo?.().usbVendorId === undefined) {
+      return err;
+    }
     try {
-      const ports = await WebSerial.getPorts();
-      if (!ports.length) {
-        throw new Error("no ports");
+      const msp = await probeMsp(port);
+      if (msp) {
+        Log.warn("serial", "found", msp.firmware, msp.version, msp.board);
+        return new ForeignFirmwareError(msp);
       }
-      await this._connectPort(ports[0], errorCallback);
-      return await this.get(QuicVal.Info, 10_000);
-    } catch (err) {
+    } catch (probeErr) {
+      Log.warn("serial", "msp probe failed", probeErr);
+    }
+    return err;
+  }
+
+  public async detect(
+    port: Transport,
+    timeout = DETECT_TIMEOUT
+  ): Promise<any> {
+    if (this.port) {
+      throw new Error("port already connected");
+    }
+    try {
+      await this._connectPort(port);
+      return await this.getWith(QuicVal.Info, { timeout, retries: 0 });
+    } catch {
+      return undefined;
+    } finally {
       await this.close();
-      throw err;
     }
   }
 
-  private async _connectPort(port: any, errorCallback: any = console.warn) {
+  private async handshake(opts: ConnectOptions = {}) {
+    const timeout = opts.timeout ?? HANDSHAKE_TIMEOUT;
+    const info = await this.getInfo({ maxAge: 0, timeout });
+    this.capabilities = negotiateCapabilities(info);
+    this.crc = this.capabilities.crc;
+    return info;
+  }
+
+  private async _connectPort(
+    port: Transport,
+    errorCallback: any = console.warn,
+    opts: ConnectOptions = {}
+  ) {
     this.port = port;
     if (!this.port) {
       return;
     }
 
     this.waitingCommands = new AsyncSemaphore(1);
+    this.queuePeak = 0;
+    this.queueRejected = 0;
+    for (const kind of Object.keys(this.diagnostics)) {
+      this.diagnostics[kind] = 0;
+    }
+    this.capabilities = defaultCapabilities();
+    this.unsaved.clear();
+    this.latency.reset();
+    this.crc = false;
+    this.batch = undefined;
 
-    await this.port.open({
-      baudRate: settings.serial.baudRate,
-      bufferSize: settings.serial.bufferSize,
-      flowControl: "none",
-    });
+    try {
+      this.portLock = await acquirePortLock(port);
+    } catch (err) {
+      this.port = undefined;
+      throw err;
+    }
+
+    try {
+      await this.port.open({
+        baudRate: opts.baudRate ?? settings.serial.baudRate,
+        bufferSize: settings.serial.bufferSize,
+        dataBits: opts.dataBits ?? 8,
+        stopBits: opts.stopBits ?? 1,
+        parity: opts.parity ?? "none",
+        flowControl: opts.flowControl ?? "none",
+      });
+    } catch (err) {
+      await this.portLock.release();
+      this.portLock = undefined;
+      this.port = undefined;
+      throw isPortBusy(err) ? portBusyError(err) : err;
+    }
 
-    this.writer = await this.port.writable.getWriter();
-    this.reader = new AsyncQueue(this.port.readable, errorCallback);
+    // some boards sit in their bootloader until dtr is toggled
+    if (opts.dtrReset && this.port.setSignals) {
+      await this.port.setSignals({ dataTerminalReady: false });
+      await asyncDelay(DTR_RESET_PULSE);
+      await this.port.setSignals({ dataTerminalReady: true });
+    }
+
+    this.writer = await this.port.writable!.getWriter();
+    this.reader = new AsyncQueue(this.port.readable!, errorCallback);
+    Log.info("serial", "connected via", describeTransport(this.port));
     this.shouldRun = true;
+    this.readLoop(this.reader);
   }
 
   public async softReboot() {
@@ -100,6 +434,51 @@ export class Serial {
       filters: SERIAL_FILTERS,
     });
     await this._connectPort(port);
+    return this.rebootToBootloader();
+  }
+
+  public async resetToBootloader(
+    timeout = BOOTLOADER_TIMEOUT
+  ): Promise<BootloaderDevice> {
+    let port = this.port;
+    if (!port) {
+      port = await WebSerial.requestPort({
+        filters: SERIAL_FILTERS,
+      });
+      await this._connectPort(port);
+    }
+    const target = await this.rebootToBootloader();
+
+    const deadline = Date.now() + timeout;
+    while ((await WebSerial.getPorts()).includes(port as SerialPort)) {
+      if (Date.now() > deadline) {
+        throw new Error("port did not disconnect");
+      }
+      await asyncDelay(BOOTLOADER_POLL_INTERVAL);
+    }
+
+    for (;;) {
+      const devices = await navigator.usb.getDevices();
+      const device = devices.find(isDFUDevice);
+      if (device) {
+        return { target, device };
+      }
+      if (Date.now() > deadline) {
+        break;
+      }
+      await asyncDelay(BOOTLOADER_POLL_INTERVAL);
+    }
+
+    // never granted, which only a chooser fixes. it needs the click that
+    // started this to still count, otherwise the user has to click again
+    try {
+      return { target, device: await requestDFUDevice() };
+    } catch (err) {
+      throw new DfuNotGrantedError(err);
+    }
+  }
+
+  private async rebootToBootloader() {
     const target = await this.get(QuicVal.Target, 500)
       .then((p) => p.name)
       .catch(() => undefined);
@@ -107,11 +486,18 @@ export class Serial {
     await this.write(stringToUint8Array("\r\nbl\r\n"));
     await this.close();
 
-    return target;
+    return target as string | undefined;
   }
 
   public async get(id: QuicVal, timeout?: number): Promise<any> {
-    const packet = await this._command(QuicCmd.Get, noProgress, timeout, [id]);
+    return this.getWith(id, { timeout });
+  }
+
+  public async getWith(id: QuicVal, opts: CommandOptions): Promise<any> {
+    if (this.capabilities.values && !this.capabilities.values.includes(id)) {
+      throw new Error("unsupported value " + id);
+    }
+    const packet = await this._command(QuicCmd.Get, opts, [id]);
     if (packet.payload[0] != id) {
       throw new Error("invalid value");
     }
@@ -125,10 +511,24 @@ export class Serial {
   }
 
   public async set(id: QuicVal, ...val: any[]): Promise<any> {
-    const packet = await this.command(QuicCmd.Set, id, ...val);
+    return this.setWith(id, {}, ...val);
+  }
+
+  public async setWith(
+    id: QuicVal,
+    opts: CommandOptions,
+    ...val: any[]
+  ): Promise<any> {
+    await this.runSetHooks([id]);
+    const packet = await this._command(QuicCmd.Set, opts, [id, ...val]);
     if (packet.payload[0] != id) {
       throw new Error("invalid value");
     }
+    this.markSet(id);
+    this.events.emit(QuicEvent.ValueSet, {
+      id,
+      value: val.length == 1 ? val[0] : val,
+    });
     if (packet.payload.length < 2) {
       throw new Error("no payload");
     }
@@ -138,8 +538,295 @@ export class Serial {
     return packet.payload.slice(1);
   }
 
+  // nothing is written, the reply holds the value as the firmware would
+  // store it after clamping
+  public async setDryRun(
+    id: QuicVal,
+    val: any,
+    opts: CommandOptions = {}
+  ): Promise<any> {
+    const packet = await this._command(QuicCmd.Validate, opts, [id, val]);
+    if (packet.payload[0] != id) {
+      throw new Error("invalid value");
+    }
+    return packet.payload[1];
+  }
+
+  public async listValues(): Promise<QuicVal[]> {
+    const values: QuicVal[] = [];
+    for (const id of Object.values(QuicVal)) {
+      if (typeof id != "number" || id == QuicVal.Invalid) {
+        continue;
+      }
+      if (UNSAFE_PROBE_VALUES.includes(id)) {
+        values.push(id);
+        continue;
+      }
+
+      try {
+        await this.getWith(id, { timeout: PROBE_TIMEOUT, retries: 0 });
+        values.push(id);
+      } catch (err) {
+        if (err instanceof ClosedError) {
+          throw err;
+        }
+        // only an error reply says the value is missing, a busy link
+        // must not disable features for the whole session
+        if (!(err instanceof FirmwareError)) {
+          Log.warn("serial", "probing value", id, "failed", err);
+          values.push(id);
+        }
+      }
+    }
+
+    this.capabilities.values = values;
+    return values;
+  }
+
+  public async getValues(
+    ids: QuicVal[],
+    opts: CommandOptions = {}
+  ): Promise<Map<QuicVal, any>> {
+    const result = new Map<QuicVal, any>();
+    if (this.batch !== false && ids.length > 1) {
+      try {
+        const packet = await this._command(QuicCmd.Get, opts, ids);
+        this.readPairs(packet.payload, result);
+      } catch (err) {
+        if (this.batch) {
+          throw err;
+        }
+      }
+      this.batch = result.size == ids.length;
+    }
+    for (const id of ids) {
+      if (!result.has(id)) {
+        result.set(id, await this.getWith(id, opts));
+      }
+    }
+    return result;
+  }
+
+  public async setValues(
+    values: [QuicVal, any][],
+    opts: CommandOptions = {}
+  ): Promise<Map<QuicVal, any>> {
+    const result = new Map<QuicVal, any>();
+    if (this.batch !== false && values.length > 1) {
+      await this.runSetHooks(values.map(([id]) => id));
+      try {
+        const packet = await this._command(QuicCmd.Set, opts, values.flat());
+        this.readPairs(packet.payload, result);
+        for (const [id, value] of values) {
+          if (result.has(id)) {
+            this.markSet(id);
+            this.events.emit(QuicEvent.ValueSet, { id, value });
+          }
+        }
+      } catch (err) {
+        if (this.batch) {
+          throw err;
+        }
+      }
+      this.batch = result.size == values.length;
+    }
+    for (const [id, val] of values) {
+      if (!result.has(id)) {
+        result.set(id, await this.setWith(id, opts, val));
+      }
+    }
+    return result;
+  }
+
+  public get dirty() {
+    return this.unsaved.size > 0;
+  }
+
+  public get dirtyValues() {
+    return [...this.unsaved];
+  }
+
+  // quic has no dedicated save command, setting the profile makes the
+  // firmware write its flash storage, which holds the profile and the rx
+  // bind. other values are either written on set or never stored
+  public async persist(opts: CommandOptions = {}) {
+    const profile = await this.getWith(QuicVal.Profile, opts);
+    await this.setWith(QuicVal.Profile, opts, profile);
+  }
+
+  private markSet(id: QuicVal) {
+    const wasDirty = this.dirty;
+    if (id == QuicVal.Profile) {
+      for (const saved of SAVED_WITH_PROFILE) {
+        this.unsaved.delete(saved);
+      }
+    } else if (SAVED_WITH_PROFILE.includes(id)) {
+      this.unsaved.add(id);
+    }
+    if (wasDirty != this.dirty) {
+      this.events.emit(QuicEvent.DirtyChanged, this.dirty);
+    }
+  }
+
+  private readPairs(payload: any[], result: Map<QuicVal, any>) {
+    for (let i = 0; i + 1 < payload.length; i += 2) {
+      result.set(payload[i], payload[i + 1]);
+    }
+  }
+
+  public use(fn: PacketMiddleware) {
+    this.middleware.push(fn);
+    return () => {
+      this.middleware = this.middleware.filter((m) => m != fn);
+    };
+  }
+
+  // runs before a value is written, a throwing hook aborts the write
+  public beforeSet(fn: SetHook) {
+    this.setHooks.push(fn);
+    return () => {
+      this.setHooks = this.setHooks.filter((h) => h != fn);
+    };
+  }
+
+  private async runSetHooks(ids: QuicVal[]) {
+    for (const hook of [...this.setHooks]) {
+      await hook(ids);
+    }
+  }
+
+  public startTrace() {
+    this.stopTrace();
+
+    const trace = new PacketTrace();
+    this.removeTrace = this.use((dir, hdr, payload) =>
+      trace.record(dir, hdr, payload)
+    );
+    this.trace = trace;
+    return trace;
+  }
+
+  public stopTrace() {
+    const trace = this.trace;
+    this.removeTrace?.();
+    this.removeTrace = undefined;
+    this.trace = undefined;
+    return trace;
+  }
+
+  public async passthrough(
+    opts: PassthroughOptions
+  ): Promise<PassthroughStream> {
+    await this.command(
+      QuicCmd.Serial,
+      0,
+      opts.port,
+      opts.baudrate,
+      opts.half_duplex ? 1 : 0,
+      opts.stop_bits
+    );
+    return this.detach();
+  }
+
+  // stops the quic read loop and hands the raw streams to the caller, the
+  // readable continues from the bytes the read loop had not consumed yet
+  public async detach(): Promise<PassthroughStream> {
+    this.shouldRun = false;
+    this.rejectPending(new ClosedError());
+    this.waitingCommands.release();
+
+    const reader = this.reader;
+    this.reader = undefined;
+    if (!this.port || !reader) {
+      throw new ClosedError();
+    }
+    reader.cancelReads(new ClosedError());
+
+    return {
+      readable: reader.stream(),
+      writable: new WritableStream<Uint8Array>({
+        write: (chunk) => this.write(chunk),
+      }),
+      close: async () => {
+        await reader.close();
+        await this.close();
+      },
+    };
+  }
+
+  public get connectedPort() {
+    return this.port;
+  }
+
+  public queueStats(): QueueStats {
+    return {
+      depth: this.waitingCommands.waiting,
+      peak: this.queuePeak,
+      rejected: this.queueRejected,
+    };
+  }
+
+  public isConnectedTo(port: Transport) {
+    return !!port && this.port === port;
+  }
+
+  public async ping(timeout?: number) {
+    const start = performance.now();
+    await this.getInfo({ maxAge: 0, timeout });
+    return performance.now() - start;
+  }
+
+  public async getInfo(opts: InfoOptions = {}): Promise<any> {
+    const maxAge = opts.maxAge ?? INFO_TTL;
+    if (this.info && performance.now() - this.info.fetched <= maxAge) {
+      return this.info.value;
+    }
+
+    const info = await this.get(QuicVal.Info, opts.timeout);
+    this.info = { value: info, fetched: performance.now() };
+
+    const previous = this.lastInfo;
+    this.lastInfo = info;
+    if (previous && infoIdentity(previous) != infoIdentity(info)) {
+      this.events.emit(QuicEvent.InfoChanged, { previous, info });
+    }
+    return info;
+  }
+
+  public invalidateInfo() {
+    this.info = undefined;
+  }
+
+  public supports(cmd: QuicCmd) {
+    return this.capabilities.commands.includes(cmd);
+  }
+
   public async command(cmd: QuicCmd, ...values: any[]): Promise<QuicPacket> {
-    return this._command(cmd, noProgress, undefined, values);
+    return this._command(cmd, {}, values);
+  }
+
+  public async commandStream(
+    cmd: QuicCmd,
+    source: AsyncIterable<Uint8Array>,
+    opts: CommandOptions = {}
+  ): Promise<QuicPacket> {
+    return this._command(cmd, opts, [], source);
+  }
+
+  public async commandWith(
+    cmd: QuicCmd,
+    opts: CommandOptions,
+    ...values: any[]
+  ): Promise<QuicPacket> {
+    return this._command(cmd, opts, values);
+  }
+
+  public async commandTimeout(
+    cmd: QuicCmd,
+    timeout: number,
+    ...values: any[]
+  ): Promise<QuicPacket> {
+    return this._command(cmd, { timeout }, values);
   }
 
   public async commandProgress(
@@ -147,12 +834,24 @@ export class Serial {
     progress: ProgressCallbackType,
     ...values: any[]
   ): Promise<QuicPacket> {
-    return this._command(cmd, progress, undefined, values);
+    return this._command(cmd, { progress }, values);
   }
 
   async close() {
+    if (!this.closing) {
+      this.closing = this._close().finally(() => (this.closing = undefined));
+    }
+    return this.closing;
+  }
+
+  private async _close() {
+    const wasOpen = !!this.port;
+
     this.reSync = true;
     this.shouldRun = false;
+    this.invalidateInfo();
+    this.rejectPending(new ClosedError());
+    this.waitingCommands.release();
 
     if (this.reader) {
       try {
@@ -179,29 +878,90 @@ export class Serial {
     this.reader = undefined;
     this.writer = undefined;
 
+    await this.portLock?.release();
+    this.portLock = undefined;
     this.port = undefined;
+
+    if (wasOpen) {
+      this.events.emit(QuicEvent.Disconnect);
+    }
   }
 
   private async _command(
     cmd: QuicCmd,
-    progress: ProgressCallbackType,
-    timeout: number | undefined,
-    values: any[]
+    opts: CommandOptions,
+    values: any[],
+    source?: AsyncIterable<Uint8Array>
   ) {
-    await this.waitingCommands.wait();
+    if (this.writeProtected && isWriteCommand(cmd, values)) {
+      throw new Error("write protected");
+    }
+    if (!this.supports(cmd)) {
+      throw new Error("unsupported command " + cmd);
+    }
+
+    const policy = this.policies[cmd] || {};
+    const timeout = opts.timeout ?? policy.timeout;
+    const retries = opts.retries ?? policy.retries ?? 0;
+    const backoff = policy.backoff ?? 100;
+
+    for (let attempt = 0; ; attempt++) {
+      try {
+        const res = await this._attempt(
+          cmd,
+          { ...opts, timeout },
+          values,
+          source
+        );
+        if (cmd == QuicCmd.Set) {
+          this.invalidateInfo();
+        }
+        return res;
+      } catch (err) {
+        if (!isRetryable(err) || attempt >= retries || opts.signal?.aborted) {
+          throw err;
+        }
+        Log.warn("serial", "[quic] retry cmd:", cmd, "attempt:", attempt + 1);
+        await asyncDelay(backoff * 2 ** attempt);
+      }
+    }
+  }
+
+  private async _attempt(
+    cmd: QuicCmd,
+    opts: CommandOptions,
+    values: any[],
+    source?: AsyncIterable<Uint8Array>
+  ) {
+    opts.signal?.throwIfAborted();
+
+    const waitingCommands = this.waitingCommands;
+    const depth = waitingCommands.waiting;
+    if (depth >= settings.serial.maxQueuedCommands) {
+      this.queueRejected++;
+      throw new BusyError(depth);
+    }
+    this.queuePeak = Math.max(this.queuePeak, depth + 1);
+    await waitingCommands.wait();
     try {
-      const packet = await this.send(cmd, progress, timeout, values);
+      if (!this.shouldRun) {
+        throw new ClosedError();
+      }
+      opts.signal?.throwIfAborted();
+      const packet = source
+        ? await this.sendStream(cmd, opts, source)
+        : await this.send(cmd, opts, values);
 
       if (packet.cmd != cmd) {
         throw new Error("invalid command");
       }
       if (packet.flag & QuicFlag.Error) {
-        throw new Error(packet.payload[0]);
+        throw new FirmwareError(cmd, packet.payload);
       }
 
       return packet;
     } finally {
-      this.waitingCommands.signal();
+      waitingCommands.signal();
     }
   }
 
@@ -215,18 +975,24 @@ export class Serial {
 
   private async send(
     cmd: QuicCmd,
-    progress: ProgressCallbackType,
-    timeout: number | undefined,
+    opts: CommandOptions,
     values: any[]
   ): Promise<QuicPacket> {
-    const payload = this.encodeValues(values);
-
-    const request = Uint8Array.from([
-      QUIC_MAGIC,
-      cmd,
-      (payload.length >> 8) & 0xff,
-      payload.length & 0xff,
-    ]);
+    let flag = QuicFlag.None;
+    let payload = this.encodeValues(values);
+    if (
+      this.capabilities.compression &&
+      payload.length > COMPRESSION_THRESHOLD
+    ) {
+      payload = await deflate(payload);
+      flag = QuicFlag.Compressed;
+    }
+    if (payload.length > this.capabilities.maxPayload) {
+      if (!this.capabilities.streaming) {
+        throw new Error("payload too large");
+      }
+      return this.sendStream(cmd, opts, [payload], flag);
+    }
 
     Log.trace(
       "serial",
@@ -237,108 +1003,302 @@ export class Serial {
       values
     );
 
-    await this.write(concatUint8Array(request, payload));
+    const hdr = { cmd, flag, len: payload.length };
+    return this.exchange(cmd, opts, () => this.writePacket(hdr, payload));
+  }
+
+  private async sendStream(
+    cmd: QuicCmd,
+    opts: CommandOptions,
+    source: AsyncIterable<Uint8Array> | Iterable<Uint8Array>,
+    extraFlag = QuicFlag.None
+  ): Promise<QuicPacket> {
+    const max = Math.min(this.capabilities.maxPayload, WRITE_CHUNK_SIZE);
+    const flag = QuicFlag.Streaming | extraFlag;
+
+    return this.exchange(cmd, opts, async () => {
+      for await (const chunk of source) {
+        for (let i = 0; i < chunk.length; i += max) {
+          const part = chunk.subarray(i, i + max);
+          await this.writePacket({ cmd, flag, len: part.length }, part);
+        }
+      }
+      await this.writePacket({ cmd, flag, len: 0 }, new Uint8Array());
+    });
+  }
 
-    let packet = await this.readPacket(progress, timeout);
-    while (packet.cmd == QuicCmd.Log) {
-      Log.info("serial", "[quic] " + packet.payload[0]);
-      packet = await this.readPacket(progress, timeout);
+  private async writePacket(hdr: QuicHeader, payload: Uint8Array) {
+    this.runMiddleware("tx", hdr, payload);
+
+    const header = encodeHeader(hdr);
+    await this.write(header);
+    for (let i = 0; i < payload.length; i += WRITE_CHUNK_SIZE) {
+      await this.write(payload.subarray(i, i + WRITE_CHUNK_SIZE));
+    }
+
+    if (this.crc) {
+      const crc = crc16(payload, crc16(header));
+      await this.write(Uint8Array.from([crc >> 8, crc]));
+    }
+  }
+
+  private async exchange(
+    cmd: QuicCmd,
+    opts: CommandOptions,
+    write: () => Promise<void>
+  ): Promise<QuicPacket> {
+    const response = new Promise<QuicPacket>((resolve, reject) => {
+      this.pending = {
+        cmd,
+        progress: opts.progress || noProgress,
+        timeout: opts.timeout,
+        resolve,
+        reject,
+      };
+      this.touchPending();
+    });
+
+    const signal = opts.signal;
+    const abort = () => {
+      this.reSync = true;
+      this.rejectPending(signal?.reason);
+    };
+    signal?.addEventListener("abort", abort);
+
+    const start = performance.now();
+    try {
+      const [, packet] = await Promise.all([write(), response]);
+      this.latency.record(performance.now() - start);
+      Log.trace(
+        "serial",
+        "[quic] recv cmd:",
+        packet.cmd,
+        "flag:",
+        packet.flag,
+        "len:",
+        packet.len,
+        packet.payload
+      );
+      return packet;
+    } finally {
+      signal?.removeEventListener("abort", abort);
+      clearTimeout(this.pending?.timer);
+      this.pending = undefined;
+    }
+  }
+
+  private runMiddleware(
+    dir: QuicDirection,
+    hdr: QuicHeader,
+    payload: Uint8Array
+  ) {
+    for (const fn of this.middleware) {
+      try {
+        fn(dir, hdr, payload);
+      } catch (err) {
+        Log.warn("serial", err);
+      }
+    }
+  }
+
+  private touchPending() {
+    const pending = this.pending;
+    if (!pending) {
+      return;
+    }
+
+    clearTimeout(pending.timer);
+    if (pending.timeout) {
+      pending.timer = setTimeout(() => {
+        this.reSync = true;
+        pending.reject("timeout");
+      }, pending.timeout);
+    }
+  }
+
+  private rejectPending(err: any) {
+    if (this.pending) {
+      clearTimeout(this.pending.timer);
+      this.pending.reject(err);
+    }
+  }
+
+  private progress(cmd: QuicCmd, len: number) {
+    this.lastActivity = performance.now();
+    if (this.pending && this.pending.cmd == cmd) {
+      this.pending.progress(len);
+      this.touchPending();
     }
-    Log.trace(
-      "serial",
-      "[quic] recv cmd:",
-      packet.cmd,
-      "flag:",
-      packet.flag,
-      "len:",
-      packet.len,
-      packet.payload
-    );
-    return packet;
   }
 
   private encodeValues(values: any[]): Uint8Array {
-    let result = new Uint8Array();
+    const writer = new ArrayWriter();
     for (const v of values) {
-      const encoded = CBOR.encode(v);
-      result = concatUint8Array(result, encoded);
+      writer.writeUint8s(CBOR.encode(v));
     }
-    return result;
+    return writer.array();
   }
 
-  private async readHeader(timeout: number | undefined): Promise<QuicHeader> {
-    if (!this.reader) {
-      throw new Error("no serial reader");
+  private async readLoop(reader: AsyncQueue) {
+    while (this.shouldRun && this.reader === reader) {
+      try {
+        const packet = await this.readPacket(reader);
+        this.dispatch(packet);
+      } catch (err) {
+        if (!this.shouldRun || this.reader !== reader) {
+          break;
+        }
+        Log.warn("serial", err);
+        this.reSync = true;
+        if (!(err instanceof FrameError)) {
+          this.events.emit(QuicEvent.Error, err);
+          this.rejectPending(err);
+          continue;
+        }
+
+        // the cmd byte may be what got corrupted, so any broken frame
+        // fails the transaction rather than leaving it waiting forever
+        this.diagnose(frameErrorKind(err), err.message, err.cmd);
+        this.rejectPending(err);
+      }
     }
+  }
+
+  private diagnose(kind: DiagnosticKind, message: string, cmd?: QuicCmd) {
+    this.diagnostics[kind]++;
+    const diagnostic: Diagnostic = { kind, cmd, message };
+    this.events.emit(QuicEvent.Diagnostic, diagnostic);
+  }
+
+  private dispatch(packet: QuicPacket) {
+    this.lastActivity = performance.now();
+    switch (packet.cmd) {
+      case QuicCmd.Log:
+        this.events.emit(QuicEvent.Log, packet.payload[0]);
+        return;
 
-    while (this.shouldRun) {
-      const magic = await this.reader.pop(timeout);
+      case QuicCmd.Blackbox:
+        if (this.pending?.cmd != QuicCmd.Blackbox) {
+          this.events.emit(QuicEvent.Blackbox, packet.payload);
+          return;
+        }
+        break;
+
+      default:
+        break;
+    }
+
+    if (!this.pending || this.pending.cmd != packet.cmd) {
+      Log.warn("serial", "[quic] unexpected packet cmd:", packet.cmd);
+      return;
+    }
+    this.pending.resolve(packet);
+  }
+
+  private async readHeader(reader: AsyncQueue): Promise<QuicHeader> {
+    let discarded = 0;
+    for (;;) {
+      const magic = reader.tryPop() ?? (await reader.pop(undefined));
       if (magic === QUIC_MAGIC) {
-        this.reSync = false;
         break;
       }
-      if (!this.reSync) {
-        this.reSync = true;
+      if (!discarded && !this.reSync) {
         Log.info("serial", "invalid magic " + magic);
-        throw new Error("invalid magic " + magic);
+      }
+      discarded++;
+    }
+    if (discarded && !this.reSync) {
+      this.events.emit(QuicEvent.Desync, discarded);
+      this.diagnose("desync", "discarded " + discarded + " bytes");
+    }
+    this.reSync = false;
+
+    const header = await reader.read(QUIC_HEADER_LEN - 1, undefined);
+    return parseHeader(concatUint8Array(Uint8Array.of(QUIC_MAGIC), header));
+  }
+
+  private async readChunk(
+    reader: AsyncQueue,
+    hdr: QuicHeader
+  ): Promise<Uint8Array> {
+    const buffer = await reader.read(hdr.len, undefined);
+    this.runMiddleware("rx", hdr, buffer);
+    if (this.crc) {
+      const trailer = await reader.read(QUIC_CRC_LEN, undefined);
+      const crc = crc16(buffer, crc16(encodeHeader(hdr)));
+      if (((trailer[0] << 8) | trailer[1]) != crc) {
+        throw new ChecksumError(hdr.cmd);
       }
     }
+    return buffer;
+  }
 
-    const header = await this.reader.read(QUIC_HEADER_LEN - 1, timeout);
+  private async readBody(
+    reader: AsyncQueue,
+    hdr: QuicHeader
+  ): Promise<QuicPacket> {
+    const buffer = await this.readChunk(reader, hdr);
+    this.progress(hdr.cmd, buffer.length);
+
+    let payload: any = [];
+    if (hdr.len) {
+      payload = decodePayload(hdr.cmd, await this.inflateBody(hdr, buffer));
+    }
     return {
-      cmd: header[0] & (0xff >> 3),
-      flag: header[0] >> 5,
-      len: (header[1] << 8) | header[2],
+      ...hdr,
+      payload,
     };
   }
 
-  private async readPacket(
-    progress: ProgressCallbackType,
-    timeout: number | undefined
-  ): Promise<QuicPacket> {
-    const hdr = await this.readHeader(timeout);
-    if (hdr.cmd >= QuicCmd.Max || hdr.cmd == QuicCmd.Invalid) {
-      throw new Error("invalid command");
+  // single packets and streams may both be compressed
+  private async inflateBody(hdr: QuicHeader, buffer: Uint8Array) {
+    if ((hdr.flag & QuicFlag.Compressed) == 0) {
+      return buffer;
     }
-    if (!this.reader) {
-      throw new Error("no serial reader");
+    return inflate(buffer).catch((err) => {
+      throw new DecodeError(hdr.cmd, err);
+    });
+  }
+
+  private async readPacket(reader: AsyncQueue): Promise<QuicPacket> {
+    const hdr = await this.readHeader(reader);
+    if (hdr.cmd >= QuicCmd.Max || hdr.cmd == QuicCmd.Invalid) {
+      throw new FrameError(hdr.cmd, "invalid command " + hdr.cmd);
     }
 
     if ((hdr.flag & QuicFlag.Streaming) == 0) {
-      const buffer = await this.reader.read(hdr.len, timeout);
-      progress(buffer.length);
-
-      let payload: any = [];
-      if (hdr.len) {
-        payload = CBOR.decode(buffer);
-      }
-      return {
-        ...hdr,
-        payload,
-      };
+      return this.readBody(reader, hdr);
     }
 
     const writer = new ArrayWriter();
-    writer.writeUint8s(await this.reader.read(hdr.len, timeout));
+    writer.writeUint8s(await this.readChunk(reader, hdr));
     Log.trace("serial", "[quic] recv stream chunk", writer.length);
-    progress(writer.length);
+    this.progress(hdr.cmd, writer.length);
 
-    while (writer) {
-      const nexthdr = await this.readHeader(timeout);
-      if (nexthdr.cmd != hdr.cmd || (nexthdr.flag & QuicFlag.Streaming) == 0) {
-        throw new Error("invalid command");
+    for (;;) {
+      const nexthdr = await this.readHeader(reader);
+      if (nexthdr.cmd != hdr.cmd) {
+        if (nexthdr.flag & QuicFlag.Streaming) {
+          throw new FrameError(hdr.cmd, "interleaved stream " + nexthdr.cmd);
+        }
+        this.dispatch(await this.readBody(reader, nexthdr));
+        continue;
+      }
+      if ((nexthdr.flag & QuicFlag.Streaming) == 0) {
+        throw new FrameError(hdr.cmd, "unterminated stream");
       }
+      const buf = await this.readChunk(reader, nexthdr);
       if (nexthdr.len == 0) {
         break;
       }
 
-      const buf = await this.reader.read(nexthdr.len, timeout);
       writer.writeUint8s(buf);
       Log.trace("serial", "[quic] recv stream chunk", writer.length);
-      progress(writer.length);
+      this.progress(hdr.cmd, writer.length);
     }
 
-    const payload: any[] = CBOR.decode(writer.array());
+    const buffer = await this.inflateBody(hdr, writer.array());
+    const payload: any[] = decodePayload(hdr.cmd, buffer);
     return {
       ...hdr,
       payload,
@@ -1,17 +1,32 @@
+import { QuicCmd } from "./quic";
+
 const isAndroid = /(android)/i.test(navigator.userAgent);
 
 const androidSerialSettings = {
   baudRate: 921600,
   bufferSize: 4 * 1024 * 1024,
   updateInterval: 1000,
+  maxQueuedCommands: 32,
 };
 
 const desktopSerialSettings = {
   baudRate: 921600,
   bufferSize: 4 * 1024 * 1024,
   updateInterval: 250,
+  maxQueuedCommands: 32,
+};
+
+export interface CommandPolicy {
+  timeout?: number;
+  retries?: number;
+  backoff?: number;
+}
+
+const commandPolicies: { [cmd: number]: CommandPolicy } = {
+  [QuicCmd.Get]: { retries: 2, backoff: 100 },
 };
 
 export const settings = {
   serial: isAndroid ? androidSerialSettings : desktopSerialSettings,
+  commands: commandPolicies,
 };
@@ -0,0 +1,50 @@
+import { CBOR } from "./cbor";
+import type { QuicDirection, QuicHeader } from "./quic";
+
+export interface TraceEntry {
+  time: number;
+  dir: QuicDirection;
+  cmd: number;
+  flag: number;
+  len: number;
+  payload: number[];
+}
+
+export class PacketTrace {
+  public entries: TraceEntry[] = [];
+  private start = performance.now();
+
+  record(dir: QuicDirection, hdr: QuicHeader, payload: Uint8Array) {
+    this.entries.push({
+      time: performance.now() - this.start,
+      dir,
+      cmd: hdr.cmd,
+      flag: hdr.flag,
+      len: hdr.len,
+      payload: Array.from(payload),
+    });
+  }
+}
+
+export function encodeTrace(entries: TraceEntry[]): string {
+  return entries.map((e) => JSON.stringify(e)).join("\n") + "\n";
+}
+
+export function parseTrace(text: string): TraceEntry[] {
+  return text
+    .split("\n")
+    .filter((line) => line.trim().length)
+    .map((line) => JSON.parse(line));
+}
+
+export function decodeTracePayload(entry: TraceEntry): any {
+  if (!entry.payload.length) {
+    return [];
+  }
+  try {
+    return CBOR.decode(Uint8Array.from(entry.payload));
+  } catch {
+    // streaming chunks only decode once reassembled
+    return undefined;
+  }
+}
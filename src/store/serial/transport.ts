@@ -0,0 +1,26 @@
+// anything the quic protocol can run over. web serial ports already fit
+// this shape, the other transports mimic it.
+export interface Transport {
+  readable?: ReadableStream<Uint8Array> | null;
+  writable?: WritableStream<Uint8Array> | null;
+
+  open(opts?: any): Promise<void>;
+  close(): Promise<void>;
+  getInfo(): any;
+
+  describe?(): string;
+  setSignals?(signals: any): Promise<void>;
+}
+
+export function describeTransport(port: Transport) {
+  if (port.describe) {
+    return port.describe();
+  }
+  const info = port.getInfo?.() ?? {};
+  if (info.usbVendorId === undefined) {
+    return "serial";
+  }
+  const vid = info.usbVendorId.toString(16).padStart(4, "0");
+  const pid = (info.usbProductId ?? 0).toString(16).padStart(4, "0");
+  return `serial ${vid}:${pid}`;
+}
@@ -0,0 +1,207 @@
+import { Log } from "@/log";
+import type { Transport } from "./transport";
+
+const UDP_HEADER_LEN = 3;
+const UDP_MAX_PAYLOAD = 512;
+const UDP_RETRANSMIT_TIMEOUT = 100;
+const UDP_MAX_RETRANSMITS = 10;
+const UDP_REORDER_WINDOW = 64;
+
+enum UdpFrame {
+  Data,
+  Ack,
+}
+
+interface UnackedFrame {
+  frame: Uint8Array;
+  retries: number;
+  timer?: any;
+}
+
+export interface DatagramSocket {
+  open(host: string, port: number): Promise<void>;
+  send(data: Uint8Array): void;
+  close(): void;
+  onMessage?: (data: Uint8Array) => void;
+  onClose?: () => void;
+}
+
+// wifi bridges drop and reorder datagrams, every frame carries a
+// sequence number, is acked by the other side and retransmitted until
+// it is. received frames are deduplicated and delivered in order.
+export class UdpPort implements Transport {
+  public readable?: ReadableStream<Uint8Array>;
+  public writable?: WritableStream<Uint8Array>;
+
+  private controller?: ReadableStreamDefaultController<Uint8Array>;
+  private txSeq = 0;
+  private rxSeq = 0;
+  private unacked = new Map<number, UnackedFrame>();
+  private reorder = new Map<number, Uint8Array>();
+
+  constructor(
+    private host: string,
+    private port: number,
+    private socket: DatagramSocket = electronSocket()
+  ) {}
+
+  public getInfo() {
+    return {};
+  }
+
+  public describe() {
+    return `udp ${this.host}:${this.port}`;
+  }
+
+  public async open(_opts?: any) {
+    this.txSeq = 0;
+    this.rxSeq = 0;
+
+    this.readable = new ReadableStream<Uint8Array>({
+      start: (controller) => {
+        this.controller = controller;
+      },
+    });
+    this.writable = new WritableStream<Uint8Array>({
+      write: (chunk) => this.write(chunk),
+    });
+
+    this.socket.onMessage = (data) => this.receive(data);
+    this.socket.onClose = () => this.fail(new Error("udp socket closed"));
+    await this.socket.open(this.host, this.port);
+  }
+
+  public async close() {
+    for (const f of this.unacked.values()) {
+      clearTimeout(f.timer);
+    }
+    this.unacked.clear();
+    this.reorder.clear();
+
+    this.socket.onMessage = undefined;
+    this.socket.onClose = undefined;
+    this.socket.close();
+
+    try {
+      this.controller?.close();
+    } catch {
+      // already closed by the reader
+    }
+    this.controller = undefined;
+    this.readable = undefined;
+    this.writable = undefined;
+  }
+
+  private write(chunk: Uint8Array) {
+    for (let i = 0; i < chunk.length; i += UDP_MAX_PAYLOAD) {
+      const seq = this.txSeq;
+      this.txSeq = (this.txSeq + 1) & 0xffff;
+
+      const payload = chunk.subarray(i, i + UDP_MAX_PAYLOAD);
+      const frame = encodeFrame(UdpFrame.Data, seq, payload);
+      this.unacked.set(seq, { frame, retries: 0 });
+      this.transmit(seq);
+    }
+  }
+
+  private transmit(seq: number) {
+    const f = this.unacked.get(seq);
+    if (!f) {
+      return;
+    }
+    if (f.retries++ > UDP_MAX_RETRANSMITS) {
+      return this.fail(new Error("udp frame " + seq + " lost"));
+    }
+    this.socket.send(f.frame);
+    f.timer = setTimeout(() => this.transmit(seq), UDP_RETRANSMIT_TIMEOUT);
+  }
+
+  private receive(data: Uint8Array) {
+    if (data.length < UDP_HEADER_LEN) {
+      return;
+    }
+    const type = data[0];
+    const seq = (data[1] << 8) | data[2];
+
+    if (type == UdpFrame.Ack) {
+      clearTimeout(this.unacked.get(seq)?.timer);
+      this.unacked.delete(seq);
+      return;
+    }
+
+    this.socket.send(encodeFrame(UdpFrame.Ack, seq));
+
+    const ahead = (seq - this.rxSeq) & 0xffff;
+    const behind = (this.rxSeq - seq) & 0xffff;
+    if (ahead >= UDP_REORDER_WINDOW) {
+      if (behind <= UDP_REORDER_WINDOW) {
+        // already delivered, our ack got lost
+        return;
+      }
+      // neither a duplicate nor a reorder, the peer kept counting while
+      // we reconnected. its sequence is taken over from here
+      Log.info("serial", "udp resync from", this.rxSeq, "to", seq);
+      this.reorder.clear();
+      this.rxSeq = seq;
+    }
+    this.reorder.set(seq, data.slice(UDP_HEADER_LEN));
+
+    let payload = this.reorder.get(this.rxSeq);
+    while (payload) {
+      this.reorder.delete(this.rxSeq);
+      this.rxSeq = (this.rxSeq + 1) & 0xffff;
+      if (payload.length) {
+        this.controller?.enqueue(payload);
+      }
+      payload = this.reorder.get(this.rxSeq);
+    }
+  }
+
+  private fail(err: Error) {
+    Log.warn("serial", err.message);
+    try {
+      this.controller?.error(err);
+    } catch {
+      // already errored
+    }
+  }
+}
+
+function encodeFrame(type: UdpFrame, seq: number, payload?: Uint8Array) {
+  const frame = new Uint8Array(UDP_HEADER_LEN + (payload?.length || 0));
+  frame[0] = type;
+  frame[1] = (seq >> 8) & 0xff;
+  frame[2] = seq & 0xff;
+  if (payload) {
+    frame.set(payload, UDP_HEADER_LEN);
+  }
+  return frame;
+}
+
+function electronSocket(): DatagramSocket {
+  const ipc = window.electron?.ipcRenderer;
+
+  const socket: DatagramSocket = {
+    async open(host, port) {
+      if (!ipc) {
+        throw new Error("udp is only available in the desktop app");
+      }
+      ipc.removeAllListeners("udp-data");
+      ipc.removeAllListeners("udp-close");
+      ipc.on("udp-data", (_event, data) =>
+        socket.onMessage?.(new Uint8Array(data))
+      );
+      ipc.on("udp-close", () => socket.onClose?.());
+      await ipc.invoke("udp-open", host, port);
+    },
+    send(data) {
+      ipc?.send("udp-send", data);
+    },
+    close() {
+      ipc?.send("udp-close");
+      ipc?.removeAllListeners("udp-data");
+      ipc?.removeAllListeners("udp-close");
+    },
+  };
+  return socket;
+}
@@ -0,0 +1,123 @@
+import { QuicVal } from "./quic";
+import type { Serial } from "./serial";
+
+export enum VtxProtocol {
+  Invalid,
+  Tramp,
+  SmartAudio,
+  MspVtx,
+}
+
+export enum VtxBand {
+  A,
+  B,
+  E,
+  F,
+  R,
+  L,
+}
+
+export enum VtxPitMode {
+  Off,
+  On,
+  NoSupport,
+}
+
+export const VTX_FREQUENCY_TABLE = [
+  [5865, 5845, 5825, 5805, 5785, 5765, 5745, 5725],
+  [5733, 5752, 5771, 5790, 5809, 5828, 5847, 5866],
+  [5705, 5685, 5665, 5645, 5885, 5905, 5925, 5945],
+  [5740, 5760, 5780, 5800, 5820, 5840, 5860, 5880],
+  [5658, 5695, 5732, 5769, 5806, 5843, 5880, 5917],
+  [5333, 5373, 5413, 5453, 5493, 5533, 5573, 5613],
+];
+
+export interface VtxPowerTable {
+  levels: number;
+  labels: string[];
+  values: number[];
+}
+
+export interface VtxSettings {
+  protocol: VtxProtocol;
+  detected: number;
+  band: VtxBand;
+  channel: number;
+  power_level?: number;
+  pit_mode?: VtxPitMode;
+  power_table?: VtxPowerTable;
+}
+
+export function vtxFrequency(band: VtxBand, channel: number) {
+  return VTX_FREQUENCY_TABLE[band]?.[channel];
+}
+
+export function vtxChannelForFrequency(freq: number) {
+  for (let band = 0; band < VTX_FREQUENCY_TABLE.length; band++) {
+    const channel = VTX_FREQUENCY_TABLE[band].indexOf(freq);
+    if (channel >= 0) {
+      return { band: band as VtxBand, channel };
+    }
+  }
+  return undefined;
+}
+
+// firmware expects three character power labels
+export function padPowerTable(table: VtxPowerTable): VtxPowerTable {
+  return {
+    ...table,
+    labels: table.labels.map((l) => l.padEnd(3, " ")),
+  };
+}
+
+// the firmware forwards these to the vtx over tramp, smartaudio or msp
+export class VtxControl {
+  constructor(private serial: Serial) {}
+
+  public get(): Promise<VtxSettings> {
+    return this.serial.get(QuicVal.VtxSettings);
+  }
+
+  public async set(update: Partial<VtxSettings>): Promise<VtxSettings> {
+    const settings = { ...(await this.get()), ...update };
+    if (!settings.detected) {
+      throw new Error("no vtx detected");
+    }
+    if (settings.power_table) {
+      settings.power_table = padPowerTable(settings.power_table);
+    }
+    return this.serial.set(QuicVal.VtxSettings, settings);
+  }
+
+  public setChannel(band: VtxBand, channel: number) {
+    if (vtxFrequency(band, channel) === undefined) {
+      throw new Error(`invalid vtx channel ${VtxBand[band]}${channel + 1}`);
+    }
+    return this.set({ band, channel });
+  }
+
+  public setFrequency(freq: number) {
+    const match = vtxChannelForFrequency(freq);
+    if (!match) {
+      throw new Error(`${freq}MHz is not in the vtx table`);
+    }
+    return this.setChannel(match.band, match.channel);
+  }
+
+  public async setPower(level: number) {
+    const table = await this.table();
+    if (table && (level < 0 || level >= table.levels)) {
+      throw new Error("invalid vtx power level " + level);
+    }
+    return this.set({ power_level: level });
+  }
+
+  public setPitMode(on: boolean) {
+    return this.set({ pit_mode: on ? VtxPitMode.On : VtxPitMode.Off });
+  }
+
+  public async table() {
+    const settings = await this.get();
+    return settings.power_table;
+  }
+}
@@ -0,0 +1,80 @@
+import type { Transport } from "./transport";
+
+const WEBSOCKET_CONNECT_TIMEOUT = 5000;
+
+// browsers cannot open raw tcp sockets, SITL builds and emulators are
+// reached through a websocket bridge instead. tcp:// urls are mapped
+// onto ws:// so the same address can be used on both sides.
+export function websocketUrl(url: string) {
+  if (url.startsWith("tcp://")) {
+    return "ws://" + url.slice("tcp://".length);
+  }
+  if (!/^wss?:\/\//.test(url)) {
+    return "ws://" + url;
+  }
+  return url;
+}
+
+export class WebSocketPort implements Transport {
+  public readable?: ReadableStream<Uint8Array>;
+  public writable?: WritableStream<Uint8Array>;
+
+  private socket?: WebSocket;
+
+  constructor(public readonly url: string) {}
+
+  public getInfo() {
+    return {};
+  }
+
+  public describe() {
+    return "websocket " + websocketUrl(this.url);
+  }
+
+  public async open(_opts?: any) {
+    const socket = new WebSocket(websocketUrl(this.url));
+    socket.binaryType = "arraybuffer";
+
+    await new Promise<void>((resolve, reject) => {
+      const timer = setTimeout(() => {
+        socket.close();
+        reject(new Error("websocket connect timeout"));
+      }, WEBSOCKET_CONNECT_TIMEOUT);
+      socket.onopen = () => {
+        clearTimeout(timer);
+        resolve();
+      };
+      socket.onerror = () => {
+        clearTimeout(timer);
+        reject(new Error("websocket connect failed"));
+      };
+    });
+
+    this.socket = socket;
+    this.readable = new ReadableStream<Uint8Array>({
+      start: (controller) => {
+        socket.onmessage = (event) => {
+          controller.enqueue(new Uint8Array(event.data));
+        };
+        socket.onclose = () => {
+          try {
+            controller.close();
+          } catch {
+            // already closed by the reader
+          }
+        };
+        socket.onerror = (err) => controller.error(err);
+      },
+    });
+    this.writable = new WritableStream<Uint8Array>({
+      write: (chunk) => socket.send(chunk),
+    });
+  }
+
+  public async close() {
+    this.socket?.close();
+    this.socket = undefined;
+    this.readable = undefined;
+    this.writable = undefined;
+  }
+}
@@ -1,8 +1,10 @@
 import { QuicVal } from "./serial/quic";
 import { serial } from "./serial/serial";
 import { Log } from "@/log";
-import { FailloopMessages } from "./constants";
+import { FailloopMessages, useConstantStore } from "./constants";
 import { defineStore } from "pinia";
+import { RcPreview, type RcFrame } from "./serial/rcpreview";
+import { useBlackboxStore } from "./blackbox";
 
 export const useStateStore = defineStore("state", {
   state: () => ({
@@ -33,6 +35,10 @@ export const useStateStore = defineStore("state", {
     failloopMessage(state) {
       return FailloopMessages[state.failloop];
     },
+    is_armed(state) {
+      const constants = useConstantStore();
+      return !!state.aux[constants.AuxFunctions.AUX_ARMING];
+    },
   },
   actions: {
     fetch_state() {
@@ -41,5 +47,21 @@ export const useStateStore = defineStore("state", {
         .then((update) => this.$patch(update))
         .catch((err) => Log.warn("state", err));
     },
+    preview_rc(fn: (f: RcFrame) => void, rate?: number) {
+      const preview = new RcPreview(serial, rate);
+      const unsubscribe = preview.subscribe(fn);
+      const unsubscribeFrames = useBlackboxStore().subscribe_frames((f) => {
+        if (f.rx) {
+          preview.push({ channels: f.rx, time: f.time, source: "blackbox" });
+        }
+      });
+      preview.start();
+
+      return () => {
+        preview.stop();
+        unsubscribe();
+        unsubscribeFrames();
+      };
+    },
   },
 });
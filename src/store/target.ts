@@ -4,8 +4,11 @@ import { defineStore } from "pinia";
 import type { target_t } from "./types";
 
 import YAML from "yaml";
+import { Log } from "@/log";
 import { useInfoStore } from "./info";
 import { useRootStore } from "./root";
+import { cacheGet, cacheSet, deviceId } from "./util/cache";
+import { rememberTarget } from "./util/porting";
 
 export function skipEmpty(val: any) {
   if (val === undefined) {
@@ -40,6 +43,9 @@ export function skipEmpty(val: any) {
   return val;
 }
 
+// set while the pins shown came from the cache, they are not written back
+let fromCache = false;
+
 export const useTargetStore = defineStore("target", {
   state: (): target_t => ({
     name: "",
@@ -99,10 +105,37 @@ export const useTargetStore = defineStore("target", {
   },
   actions: {
     fetch() {
-      return serial.get(QuicVal.Target).then((target) => this.$patch(target));
+      const id = deviceId(useInfoStore());
+      return serial.get(QuicVal.Target).then((target) => {
+        this.$patch(target);
+        fromCache = false;
+        if (id) {
+          cacheSet("target/" + id, target);
+        }
+        rememberTarget(target);
+      });
+    },
+    // the board is always asked, the cache only fills in for display when
+    // it does not answer
+    fetch_cached() {
+      const id = deviceId(useInfoStore());
+      return this.fetch().catch((err) => {
+        const target = id && cacheGet("target/" + id);
+        if (!target) {
+          throw err;
+        }
+        Log.warn("target", "showing cached target", err);
+        this.$patch(target);
+        fromCache = true;
+      });
     },
     apply(target: target_t) {
       const root = useRootStore();
+      if (fromCache) {
+        return Promise.reject(
+          new Error("target was not read from the board, reconnect first")
+        );
+      }
       return serial
         .set(QuicVal.Target, target)
         .then(() => this.fetch())
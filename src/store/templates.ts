@@ -1,4 +1,16 @@
 import { defineStore } from "pinia";
+import semver from "semver";
+import YAML from "yaml";
+import { Log } from "@/log";
+import { mergeDeep, useProfileStore } from "./profile";
+import { useAuditStore } from "./audit";
+import { setValueDryRun } from "./dryrun";
+import { useInfoStore } from "./info";
+import { cacheGet, cacheSet } from "./util/cache";
+import { serial } from "./serial/serial";
+import { QuicVal } from "./serial/quic";
+import { cloneDeep, flattenObject, getPath } from "./util/diff";
+import { parseProfileText } from "./util/profilefile";
 
 const isDevelop = import.meta.env.VITE_BRANCH_NAME;
 
@@ -7,6 +19,11 @@ const DEVELOP_TEMPLATE_URL =
 const MASTER_TEMPLATE_URL =
   "https://raw.githubusercontent.com/BossHobby/Templates/master-deploy/";
 
+const INDEX_CACHE_KEY = "templates/index";
+const INDEX_CACHE_TTL = 60 * 60 * 1000;
+
+const OVERLAYS_STORAGE_KEY = "template-overlays";
+
 export interface TemplateOptionEntry {
   title?: string;
   name: string;
@@ -43,6 +60,54 @@ export interface TemplateEntry {
   category: string;
   profile: string;
   image: string;
+  craft?: string;
+  firmware?: string;
+}
+
+export interface TemplatePreviewEntry {
+  path: string;
+  current: any;
+  preset: any;
+}
+
+export interface TemplateOverlay {
+  id: string;
+  name: string;
+  profile: any;
+}
+
+export interface ComposedProfile {
+  patch: any;
+  // paths a later layer took over from an earlier one
+  overridden: string[];
+}
+
+// layers are merged in order, later ones win. the result is a single
+// patch so the board only ever sees the finished profile.
+export function composeProfile(base: any, overlays: any[]): ComposedProfile {
+  const patch = mergeDeep({}, base || {});
+  const seen = new Set(flattenObject(patch).map(([path]) => path));
+  const overridden = new Set<string>();
+
+  for (const overlay of overlays) {
+    for (const [path] of flattenObject(overlay)) {
+      if (seen.has(path)) {
+        overridden.add(path);
+      }
+      seen.add(path);
+    }
+    mergeDeep(patch, overlay);
+  }
+
+  return { patch, overridden: [...overridden] };
+}
+
+function loadOverlays(): TemplateOverlay[] {
+  try {
+    return JSON.parse(localStorage.getItem(OVERLAYS_STORAGE_KEY) || "[]");
+  } catch {
+    return [];
+  }
 }
 
 export function templateUrl(file: string) {
@@ -50,24 +115,174 @@ export function templateUrl(file: string) {
   return url + file;
 }
 
+async function fetchYAML(url: string) {
+  const res = await fetch(url);
+  if (!res.ok) {
+    throw new Error("fetching " + url + " failed");
+  }
+  return YAML.parse(await res.text());
+}
+
+// entries without a firmware range predate it and stay visible, as does
+// everything when running a build that is not a tagged release
+function isCompatible(entry: TemplateEntry, version: string) {
+  if (!entry.firmware || !semver.valid(version)) {
+    return true;
+  }
+  return semver.satisfies(version, entry.firmware);
+}
+
 export const useTemplatesStore = defineStore("templates", {
   state: () => ({
     index: [] as TemplateEntry[],
+    craft: "",
+    overlays: loadOverlays(),
+    selected_overlays: [] as string[],
   }),
+  getters: {
+    crafts(state) {
+      const crafts = state.index.map((e) => e.craft).filter((c) => !!c);
+      return [...new Set(crafts)] as string[];
+    },
+    compatible(state) {
+      const info = useInfoStore();
+      return state.index
+        .filter((e) => !state.craft || e.craft == state.craft)
+        .filter((e) => isCompatible(e, info.git_version));
+    },
+    active_overlays(state) {
+      return state.selected_overlays
+        .map((id) => state.overlays.find((o) => o.id == id))
+        .filter((o) => !!o) as TemplateOverlay[];
+    },
+  },
   actions: {
-    fetch_templates() {
+    // served from the local copy while fresh, and as a fallback when the
+    // template repo cannot be reached
+    async fetch_templates(force = false) {
+      const cached = cacheGet<{ fetched: number; index: any[] }>(
+        INDEX_CACHE_KEY
+      );
+      if (cached && !force && Date.now() - cached.fetched < INDEX_CACHE_TTL) {
+        this.set_index(cached.index);
+        return;
+      }
+
       const url = isDevelop ? DEVELOP_TEMPLATE_URL : MASTER_TEMPLATE_URL;
-      return fetch(url + "index.json")
-        .then((res) => res.json())
-        .then((index) => {
-          this.index = index.map((e) => {
-            if (e.image) {
-              e.image = templateUrl(e.image);
-            }
-            e.profile = templateUrl(e.profile);
-            return e;
+      try {
+        const index = await fetch(url + "index.json").then((res) => res.json());
+        cacheSet(INDEX_CACHE_KEY, { fetched: Date.now(), index });
+        this.set_index(index);
+      } catch (err) {
+        if (!cached) {
+          throw err;
+        }
+        Log.warn("template", "using cached index", err);
+        this.set_index(cached.index);
+      }
+    },
+    set_index(index: any[]) {
+      this.index = index.map((e) => {
+        if (e.image) {
+          e.image = templateUrl(e.image);
+        }
+        e.profile = templateUrl(e.profile);
+        return e;
+      });
+    },
+    async resolve_template(tmpl: TemplateEntry, selected: any) {
+      const patch = await fetchYAML(tmpl.profile);
+
+      for (const option of tmpl.options || []) {
+        const entry = option.entries.find(
+          (e) => e.name == selected[option.name]
+        );
+        if (!entry) {
+          continue;
+        }
+
+        const fragment = await fetchYAML(templateUrl(entry.file));
+        Log.info("template", "applying option", entry.name);
+        mergeDeep(patch, fragment.profile);
+      }
+
+      for (const mut of tmpl.mutations || []) {
+        const match = mut.options.find((o) => {
+          return Object.entries(o.selector).every(([key, values]) => {
+            return values.includes(selected[key]);
           });
         });
+        if (!match) {
+          continue;
+        }
+        Log.info("template", "applying mutation", match.name);
+        mergeDeep(patch, match.profile);
+      }
+
+      return this.compose_overlays(patch).patch;
+    },
+    compose_overlays(base: any) {
+      const overlays = this.active_overlays;
+      for (const overlay of overlays) {
+        Log.info("template", "applying overlay", overlay.name);
+      }
+      return composeProfile(base, overlays.map((o) => o.profile));
+    },
+    persist_overlays() {
+      localStorage.setItem(OVERLAYS_STORAGE_KEY, JSON.stringify(this.overlays));
+    },
+    // fragments may be bare profile sections or wrapped like the option
+    // files of the template repo
+    add_overlay(name: string, text: string) {
+      const parsed = parseProfileText(text);
+      const profile = parsed?.profile || parsed;
+      if (!profile || typeof profile !== "object") {
+        throw new Error("file does not contain a profile fragment");
+      }
+
+      const overlay: TemplateOverlay = {
+        id: `${Date.now()}/${name}`,
+        name,
+        profile,
+      };
+      this.overlays = [...this.overlays, overlay];
+      this.persist_overlays();
+      return overlay;
+    },
+    delete_overlay(id: string) {
+      this.overlays = this.overlays.filter((o) => o.id != id);
+      this.selected_overlays = this.selected_overlays.filter((s) => s != id);
+      this.persist_overlays();
+    },
+    // selection order is layering order
+    toggle_overlay(id: string) {
+      if (this.selected_overlays.includes(id)) {
+        this.selected_overlays = this.selected_overlays.filter((s) => s != id);
+      } else {
+        this.selected_overlays = [...this.selected_overlays, id];
+      }
+    },
+    apply_template(patch: any) {
+      return useAuditStore().with_source("template", () =>
+        useProfileStore().merge_profile(patch)
+      );
+    },
+    async dry_run_template(patch: any) {
+      const current = await serial.get(QuicVal.Profile);
+      const merged = mergeDeep(current, cloneDeep(patch));
+      return setValueDryRun(QuicVal.Profile, merged);
+    },
+    apply_overlays() {
+      return this.apply_template(this.compose_overlays({}).patch);
+    },
+    preview_template(patch: any, profile: any): TemplatePreviewEntry[] {
+      return flattenObject(patch)
+        .map(([path, preset]) => ({
+          path,
+          current: getPath(profile, path),
+          preset,
+        }))
+        .filter((e) => e.current !== e.preset);
     },
   },
 });
@@ -289,12 +289,18 @@ export enum target_feature_t {
   FEATURE_OSD = 1 << 2,
   FEATURE_BLACKBOX = 1 << 3,
   FEATURE_DEBUG = 1 << 4,
+  FEATURE_QUIC_CRC = 1 << 5,
+  FEATURE_QUIC_COMPRESSION = 1 << 6,
+  FEATURE_QUIC_DRY_RUN = 1 << 7,
+  FEATURE_BLACKBOX_RANGE = 1 << 8,
 }
 
 export interface target_info_t {
   target_name: string;
   mcu: string;
   git_version: string;
+  // mcu serial number, only reported by newer firmware
+  uid?: number[];
 
   features: number;
   rx_protocols: number[];
@@ -0,0 +1,415 @@
+import {
+  vtxChannelForFrequency,
+  type VtxPowerTable,
+  type VtxSettings,
+} from "../serial/vtx";
+import { cloneDeep } from "./diff";
+import { OSD_ELEMENT_NAMES, enableElement, moveElement } from "./osdlayout";
+import { betaflightRatesFromValues, importBetaflightRates } from "./rates";
+
+export type BetaflightLineStatus = "applied" | "approximated" | "skipped";
+
+export interface BetaflightImportLine {
+  line: number;
+  text: string;
+  status: BetaflightLineStatus;
+  note?: string;
+}
+
+export interface BetaflightImport {
+  profile: any;
+  vtx?: VtxSettings;
+  lines: BetaflightImportLine[];
+}
+
+interface DiffLine {
+  line: number;
+  text: string;
+  command: string;
+  key: string;
+  value: string;
+  // index of the pid or rate profile the line sits in, -1 for the master
+  profile: number;
+  rateprofile: number;
+}
+
+// only structure the dump, nothing to apply or report
+const STRUCTURE_COMMANDS = [
+  "batch",
+  "defaults",
+  "save",
+  "profile",
+  "rateprofile",
+  "board_name",
+  "manufacturer_id",
+  "mcu_id",
+  "signature",
+  "diff",
+];
+
+const NO_EQUIVALENT = "no quicksilver equivalent";
+
+const RATE_KEYS = /^(rates_type|(roll|pitch|yaw)_(rc_rate|srate|expo))$/;
+
+const FILTER_PASSES: { [key: string]: [string, number] } = {
+  gyro_lpf1: ["gyro", 0],
+  gyro_lpf2: ["gyro", 1],
+  dterm_lpf1: ["dterm", 0],
+  dterm_lpf2: ["dterm", 1],
+};
+
+// quicksilver has no biquad, a pt2 comes closest
+const FILTER_TYPES: { [type: string]: number } = {
+  PT1: 1,
+  PT2: 2,
+  PT3: 3,
+  BIQUAD: 2,
+};
+
+// element name and whether betaflight shows something slightly different
+const OSD_ELEMENTS: { [key: string]: [string, boolean] } = {
+  osd_craft_name_pos: ["CALLSIGN", false],
+  osd_avg_cell_voltage_pos: ["FUELGAUGE VOLTS", true],
+  osd_vbat_pos: ["FILTERED VOLTS", false],
+  osd_core_temp_pos: ["GYRO TEMP", true],
+  osd_flymode_pos: ["FLIGHT MODE", false],
+  osd_rssi_pos: ["RSSI", false],
+  osd_tim_2_pos: ["STOPWATCH", true],
+  osd_warnings_pos: ["SYSTEM STATUS", true],
+  osd_throttle_pos: ["THROTTLE", false],
+  osd_vtx_channel_pos: ["VTX CHANNEL", false],
+  osd_current_pos: ["CURRENT", false],
+  osd_crosshairs_pos: ["CROSSHAIR", false],
+};
+
+// x in the low 5 bits, y in the next 5, per osd profile visibility from
+// bit 11 on
+function decodeBetaflightPos(pos: number) {
+  return {
+    x: pos & 0x1f,
+    y: (pos >> 5) & 0x1f,
+    active: (pos & 0x3800) != 0,
+  };
+}
+
+function parseLines(text: string) {
+  const lines: DiffLine[] = [];
+  let profile = -1;
+  let rateprofile = -1;
+  let activeProfile = 0;
+  let activeRateprofile = 0;
+
+  text.split(/\r?\n/).forEach((raw, i) => {
+    const text = raw.trim();
+    if (!text.length || text.startsWith("#")) {
+      return;
+    }
+    const [command, ...args] = text.split(/\s+/);
+    const lower = command.toLowerCase();
+
+    // the last selection in the dump restores the profile that was active
+    if (lower == "profile") {
+      profile = activeProfile = parseInt(args[0]) || 0;
+      rateprofile = -1;
+    } else if (lower == "rateprofile") {
+      rateprofile = activeRateprofile = parseInt(args[0]) || 0;
+      profile = -1;
+    }
+    if (STRUCTURE_COMMANDS.includes(lower)) {
+      return;
+    }
+
+    const set = text.match(/^set\s+(\w+)\s*=\s*(.*)$/i);
+    lines.push({
+      line: i + 1,
+      text,
+      command: set ? "set" : lower,
+      key: set ? set[1].toLowerCase() : (args[0] || "").toLowerCase(),
+      value: set ? set[2].trim() : args.slice(1).join(" "),
+      profile,
+      rateprofile,
+    });
+  });
+  return { lines, activeProfile, activeRateprofile };
+}
+
+class DiffImporter {
+  public lines: BetaflightImportLine[] = [];
+  public vtx?: VtxSettings;
+
+  private rates: { [key: string]: string } = {};
+  private rateLines: DiffLine[] = [];
+  private vtxBands: { [band: number]: number[] } = {};
+  private vtxBandLines: DiffLine[] = [];
+  private vtxBand?: DiffLine;
+  private vtxChannel?: DiffLine;
+  private vtxFreq?: DiffLine;
+
+  constructor(public profile: any, vtx?: VtxSettings) {
+    this.vtx = vtx && cloneDeep(vtx);
+  }
+
+  report(l: DiffLine, status: BetaflightLineStatus, note?: string) {
+    this.lines.push({ line: l.line, text: l.text, status, note });
+  }
+
+  set(l: DiffLine) {
+    const key = l.key;
+    const num = parseFloat(l.value);
+
+    if (RATE_KEYS.test(key)) {
+      this.rates[key] = l.value;
+      this.rateLines.push(l);
+      return;
+    }
+
+    const filter = key.match(/^(\w+_lpf\d)_(static_hz|type)$/);
+    if (filter && FILTER_PASSES[filter[1]]) {
+      return this.setFilter(l, FILTER_PASSES[filter[1]], filter[2], num);
+    }
+
+    if (OSD_ELEMENTS[key]) {
+      return this.setOSDElement(l, OSD_ELEMENTS[key], num);
+    }
+
+    switch (key) {
+      case "dterm_lpf1_dyn_min_hz":
+        this.profile.filter.dterm_dynamic_enable = num > 0 ? 1 : 0;
+        if (num > 0) {
+          this.profile.filter.dterm_dynamic_min = num;
+        }
+        return this.report(l, "applied");
+      case "dterm_lpf1_dyn_max_hz":
+        this.profile.filter.dterm_dynamic_max = num;
+        return this.report(l, "applied");
+      case "thr_mid":
+        this.profile.rate.throttle_mid = num / 100;
+        return this.report(l, "applied");
+      case "thr_expo":
+        this.profile.rate.throttle_expo = num / 100;
+        return this.report(l, "applied");
+      case "deadband":
+        // betaflight counts us of the 500us half throw
+        this.profile.rate.sticks_deadband = num / 500;
+        return this.report(l, "approximated", "converted from us");
+      case "craft_name":
+        return this.setName(l, l.value);
+      case "vtx_band":
+        this.vtxBand = l;
+        return;
+      case "vtx_channel":
+        this.vtxChannel = l;
+        return;
+      case "vtx_freq":
+        this.vtxFreq = l;
+        return;
+      case "vtx_power":
+        if (!this.vtx) {
+          return this.report(l, "skipped", "no vtx settings");
+        }
+        this.vtx.power_level = Math.max(0, num - 1);
+        return this.report(l, "applied");
+    }
+
+    this.report(l, "skipped", NO_EQUIVALENT);
+  }
+
+  setName(l: DiffLine, name: string) {
+    if (!this.profile.osd) {
+      return this.report(l, "skipped", "no osd");
+    }
+    this.profile.osd.callsign = name;
+    this.report(l, "applied");
+  }
+
+  setFilter(
+    l: DiffLine,
+    [kind, pass]: [string, number],
+    attr: string,
+    num: number
+  ) {
+    const f = this.profile.filter?.[kind]?.[pass];
+    if (!f) {
+      return this.report(l, "skipped", `no ${kind} filter ${pass + 1}`);
+    }
+    if (attr == "static_hz") {
+      // betaflight turns a pass off with a zero cutoff
+      if (num == 0) {
+        f.type = 0;
+      } else {
+        f.type = f.type || FILTER_TYPES.PT1;
+        f.cutoff_freq = num;
+      }
+      return this.report(l, "applied");
+    }
+
+    const type = l.value.toUpperCase();
+    if (FILTER_TYPES[type] === undefined) {
+      return this.report(l, "skipped", `unknown filter type ${l.value}`);
+    }
+    if (f.type != 0) {
+      f.type = FILTER_TYPES[type];
+    }
+    if (type == "BIQUAD") {
+      return this.report(l, "approximated", "biquad replaced by pt2");
+    }
+    this.report(l, "applied");
+  }
+
+  setOSDElement(l: DiffLine, [name, approx]: [string, boolean], pos: number) {
+    const elements = this.profile.osd?.elements;
+    const index = OSD_ELEMENT_NAMES.indexOf(name);
+    if (!elements || index < 0 || index >= elements.length) {
+      return this.report(l, "skipped", `no ${name} element`);
+    }
+
+    const { x, y, active } = decodeBetaflightPos(pos);
+    this.profile.osd.elements = enableElement(
+      moveElement(elements, index, x, y),
+      index,
+      active
+    );
+    this.report(l, approx ? "approximated" : "applied", `as ${name}`);
+  }
+
+  vtxtable(l: DiffLine) {
+    if (!this.vtx) {
+      return this.report(l, "skipped", "no vtx settings");
+    }
+
+    const args = l.value.split(/\s+/);
+    const table: VtxPowerTable = this.vtx.power_table || {
+      levels: 0,
+      labels: [],
+      values: [],
+    };
+    switch (l.key) {
+      case "band": {
+        // vtxtable band <n> <name> <letter> <factory|custom> <freqs...>
+        this.vtxBands[parseInt(args[0])] = args.slice(4).map(Number);
+        this.vtxBandLines.push(l);
+        return;
+      }
+      case "powerlevels":
+        table.levels = parseInt(args[0]);
+        break;
+      case "powervalues":
+        table.values = args.map(Number);
+        break;
+      case "powerlabels":
+        table.labels = args;
+        break;
+      default:
+        return this.report(l, "skipped", "quicksilver has a fixed band table");
+    }
+    this.vtx.power_table = table;
+    this.report(l, "applied");
+  }
+
+  finishRates() {
+    if (!this.rateLines.length) {
+      return;
+    }
+    try {
+      const bf = betaflightRatesFromValues(this.rates);
+      const rate = importBetaflightRates(bf);
+      const rates = this.profile.rate.rates;
+      rates[this.profile.rate.profile] = rate;
+
+      const exact = bf.type == "BETAFLIGHT" || bf.type == "ACTUAL";
+      for (const l of this.rateLines) {
+        this.report(
+          l,
+          exact ? "applied" : "approximated",
+          exact ? undefined : `${bf.type} rates fitted`
+        );
+      }
+    } catch (err) {
+      for (const l of this.rateLines) {
+        this.report(l, "skipped", String(err));
+      }
+    }
+  }
+
+  finishVtx() {
+    const used = new Set<DiffLine>();
+    let freq: number | undefined;
+    if (this.vtxFreq && parseInt(this.vtxFreq.value) > 0) {
+      freq = parseInt(this.vtxFreq.value);
+      used.add(this.vtxFreq);
+    } else if (this.vtxBand && this.vtxChannel) {
+      const band = this.vtxBands[parseInt(this.vtxBand.value)];
+      freq = band?.[parseInt(this.vtxChannel.value) - 1];
+      used.add(this.vtxBand).add(this.vtxChannel);
+    }
+
+    const found = freq ? vtxChannelForFrequency(freq) : undefined;
+    if (found && this.vtx) {
+      this.vtx.band = found.band;
+      this.vtx.channel = found.channel;
+    }
+    for (const l of used) {
+      if (found && this.vtx) {
+        this.report(l, "applied", `${freq}MHz`);
+      } else {
+        this.report(l, "skipped", "frequency not in the quicksilver table");
+      }
+    }
+    for (const l of [this.vtxBand, this.vtxChannel, this.vtxFreq]) {
+      if (l && !used.has(l)) {
+        this.report(l, "skipped", "superseded");
+      }
+    }
+    const lookup =
+      this.vtxBand && used.has(this.vtxBand) ? this.vtxBand.value : undefined;
+    for (const l of this.vtxBandLines) {
+      if (found && l.value.split(/\s+/)[0] == lookup) {
+        this.report(l, "approximated", "used to look up the frequency");
+      } else {
+        this.report(l, "skipped", "quicksilver has a fixed band table");
+      }
+    }
+  }
+}
+
+// best effort, every line that carries a setting is reported as applied,
+// approximated or skipped. settings of inactive profiles are left out
+export function importBetaflightDiff(
+  text: string,
+  profile: any,
+  vtx?: VtxSettings
+): BetaflightImport {
+  const { lines, activeProfile, activeRateprofile } = parseLines(text);
+  const importer = new DiffImporter(cloneDeep(profile), vtx);
+
+  for (const l of lines) {
+    if (
+      (l.profile >= 0 && l.profile != activeProfile) ||
+      (l.rateprofile >= 0 && l.rateprofile != activeRateprofile)
+    ) {
+      importer.report(l, "skipped", "inactive profile");
+      continue;
+    }
+    switch (l.command) {
+      case "set":
+        importer.set(l);
+        break;
+      case "vtxtable":
+        importer.vtxtable(l);
+        break;
+      case "name":
+        importer.setName(l, l.text.substring(4).trim());
+        break;
+      default:
+        importer.report(l, "skipped", NO_EQUIVALENT);
+    }
+  }
+  importer.finishRates();
+  importer.finishVtx();
+
+  return {
+    profile: importer.profile,
+    vtx: importer.vtx,
+    lines: importer.lines.sort((a, b) => a.line - b.line),
+  };
+}
@@ -3,6 +3,13 @@ import { ArrayWriter } from ".";
 import { transformBlackboxFieldFlags, type BlackboxFile } from "../blackbox";
 import { BlackboxField } from "../constants";
 import type { profile_t } from "../types";
+import { exportBetaflightRates } from "./rates";
+import type { Recording } from "./recorder";
+
+const BF_RATES_TYPES = ["BETAFLIGHT", "RACEFLIGHT", "KISS", "ACTUAL", "QUICK"];
+
+// FLIGHT_LOG_EVENT_LOG_END, explorer takes the log as complete after it
+const BF_EVENT_LOG_END = 255;
 
 export interface FieldDefinition {
   name: string;
@@ -376,8 +383,7 @@ export class Blackbox {
 
     // this.writeHeaderRaw("debug_mode", "3")
 
-    this.writeHeaderRaw("rates", "78,78,78");
-    this.writeHeaderRaw("rates_type", "3");
+    this.writeRates(profile);
 
     this.writeHeaderRaw("minthrottle", "1000");
     this.writeHeaderRaw("maxthrottle", "2000");
@@ -545,10 +551,38 @@ export class Blackbox {
     }
   }
 
+  public writeLogEnd() {
+    this.buffer.writeUint8("E".charCodeAt(0));
+    this.buffer.writeUint8(BF_EVENT_LOG_END);
+    const str = "End of log\0";
+    for (let i = 0; i < str.length; i++) {
+      this.buffer.writeUint8(str.charCodeAt(i));
+    }
+  }
+
+  public toBlob() {
+    return new Blob([this.buffer.array()], { type: "octet/stream" });
+  }
+
   public toUrl() {
-    const buf = this.buffer.array();
-    const blob = new Blob([buf], { type: "octet/stream" });
-    return window.URL.createObjectURL(blob);
+    return window.URL.createObjectURL(this.toBlob());
+  }
+
+  // legacy profiles carry no rate profiles, explorer then gets the
+  // actual rates quicksilver used to default to
+  private writeRates(profile: profile_t) {
+    const rates = profile.rate?.rates?.[profile.rate.profile];
+    if (!rates) {
+      this.writeHeaderRaw("rates", "78,78,78");
+      this.writeHeaderRaw("rates_type", "3");
+      return;
+    }
+
+    const bf = exportBetaflightRates(rates);
+    this.writeHeaderRaw("rc_rates", bf.rc_rate.join(","));
+    this.writeHeaderRaw("rc_expo", bf.expo.join(","));
+    this.writeHeaderRaw("rates", bf.srate.join(","));
+    this.writeHeaderRaw("rates_type", BF_RATES_TYPES.indexOf(bf.type) + "");
   }
 
   private writeHeaderJoin(key: string, fn: (d: FieldDefinition) => string) {
@@ -590,3 +624,28 @@ export class Blackbox {
     return this.writeUnsigned(unsigned);
   }
 }
+
+// recordings store frames the way the flash hands them out, so they go
+// through the same writer
+export function recordingToBlackbox(
+  recording: Recording,
+  profile: profile_t
+): Blackbox {
+  const { header, frames } = recording;
+  const rate = header.sample_rate_hz;
+  // without a looptime every logged frame is taken as one loop
+  const looptime = header.looptime || Math.round(1e6 / rate);
+  const writer = new Blackbox({
+    field_flags: header.field_flags,
+    looptime,
+    blackbox_rate: Math.max(1, Math.round(1e6 / looptime / rate)),
+    start: header.part_start,
+    size: 0,
+  });
+  writer.writeHeaders(header.profile || profile);
+  for (const values of frames) {
+    writer.writeValue(values);
+  }
+  writer.writeLogEnd();
+  return writer;
+}
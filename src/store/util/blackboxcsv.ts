@@ -0,0 +1,86 @@
+import type { BlackboxFieldDef, BlackboxFrame } from "../blackbox";
+import { encodeCSVRow } from "./csv";
+import {
+  decodeFrame,
+  encodeRecording,
+  type Recording,
+  type RecordingEncoder,
+  type RecordingHeader,
+} from "./recorder";
+
+// frame time is a 32 bit counter in us
+const TIME_WRAP = 2 ** 32;
+
+// one column per axis, named so pandas and spreadsheets take them as is
+export function blackboxColumns(fields: BlackboxFieldDef[]) {
+  const columns = ["time_s"];
+  for (const f of fields) {
+    if (f.axis) {
+      columns.push(...f.axis.map((a) => `${f.name}_${a.toLowerCase()}`));
+    } else {
+      columns.push(f.name);
+    }
+  }
+  return columns;
+}
+
+// values are scaled back to their unit, the firmware sends fixed point
+export function blackboxValues(
+  fields: BlackboxFieldDef[],
+  frame: BlackboxFrame
+) {
+  const values: number[] = [];
+  for (const f of fields) {
+    const val = frame[f.name];
+    if (Array.isArray(val)) {
+      values.push(...val.map((v) => v / f.scale));
+    } else {
+      values.push(val / f.scale);
+    }
+  }
+  return values;
+}
+
+// keeps the time origin across parts, one encoder per recording gives a
+// continuous time column
+export class BlackboxCSVEncoder implements RecordingEncoder {
+  readonly extension = ".csv";
+
+  private origin?: number;
+  private last = 0;
+  private offset = 0;
+
+  header(header: RecordingHeader) {
+    return encodeCSVRow(blackboxColumns(header.fields));
+  }
+
+  frame(header: RecordingHeader, frame: BlackboxFrame) {
+    const time = this.seconds(frame.time).toFixed(6);
+    return encodeCSVRow([time, ...blackboxValues(header.fields, frame)]);
+  }
+
+  private seconds(time: number) {
+    if (time < this.last) {
+      this.offset += TIME_WRAP;
+    }
+    this.last = time;
+
+    const t = time + this.offset;
+    if (this.origin === undefined) {
+      this.origin = t;
+    }
+    return (t - this.origin) / 1e6;
+  }
+}
+
+export function recordingToCSV(
+  recording: Recording,
+  encoder = new BlackboxCSVEncoder()
+) {
+  const { header, frames } = recording;
+  return encodeRecording(
+    header,
+    frames.map((values) => decodeFrame(header.fields, values)),
+    encoder
+  );
+}
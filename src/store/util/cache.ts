@@ -0,0 +1,38 @@
+import type { target_info_t } from "../types";
+
+const CACHE_PREFIX = "cache:";
+
+export function deviceKey(info: target_info_t): string {
+  return [info.target_name, info.mcu, info.git_version].join("/");
+}
+
+// tells boards of the same build apart, undefined for firmware that does
+// not report the mcu uid. board specific data is only cached under this
+export function deviceId(info: target_info_t): string | undefined {
+  if (!info.uid?.length) {
+    return undefined;
+  }
+  return info.uid
+    .map((b) => (b & 0xff).toString(16).padStart(2, "0"))
+    .join("");
+}
+
+export function cacheGet<T = any>(key: string): T | undefined {
+  const val = localStorage.getItem(CACHE_PREFIX + key);
+  if (val == null) {
+    return undefined;
+  }
+  try {
+    return JSON.parse(val);
+  } catch {
+    return undefined;
+  }
+}
+
+export function cacheSet(key: string, val: any) {
+  localStorage.setItem(CACHE_PREFIX + key, JSON.stringify(val));
+}
+
+export function cacheDelete(key: string) {
+  localStorage.removeItem(CACHE_PREFIX + key);
+}
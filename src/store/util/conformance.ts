@@ -0,0 +1,215 @@
+import { QuicCmd, QuicVal } from "../serial/quic";
+import type { Serial } from "../serial/serial";
+import { settings } from "../serial/settings";
+import { $enum } from "ts-enum-util";
+
+const CONFORMANCE_TIMEOUT = 2000;
+const PIPELINE_COUNT = 32;
+const MAX_PAYLOAD_LEN = 0xffff - 16;
+
+export interface ConformanceResult {
+  name: string;
+  passed: boolean;
+  skipped?: boolean;
+  message?: string;
+  duration: number;
+}
+
+interface ConformanceCase {
+  name: string;
+  write?: boolean;
+  // returns why the case does not apply to the connected board
+  skip?: (serial: Serial) => string | undefined;
+  run: (serial: Serial) => Promise<string | void>;
+}
+
+// values that only answer on boards with the matching hardware or mode
+function skipValue(serial: Serial, val: QuicVal) {
+  const values = serial.capabilities.values;
+  if (values && !values.includes(val)) {
+    return "not supported by the board";
+  }
+  if (val == QuicVal.OSDFont && !serial.supports(QuicCmd.OSD)) {
+    return "no osd";
+  }
+  if (val == QuicVal.BLHeliSettings) {
+    return "needs esc passthrough";
+  }
+  return undefined;
+}
+
+async function expectError(p: Promise<any>) {
+  try {
+    await p;
+  } catch (err) {
+    if (err == "timeout") {
+      throw new Error("no response");
+    }
+    return "rejected with " + err;
+  }
+  throw new Error("accepted invalid request");
+}
+
+async function expectAlive(serial: Serial) {
+  const info = await serial.get(QuicVal.Info, CONFORMANCE_TIMEOUT);
+  if (!info || !info.quic_protocol_version) {
+    throw new Error("link not responding after test");
+  }
+}
+
+const ConformanceCases: ConformanceCase[] = [
+  {
+    name: "info",
+    run: async (serial) => {
+      const info = await serial.get(QuicVal.Info, CONFORMANCE_TIMEOUT);
+      if (!info.quic_protocol_version) {
+        throw new Error("missing quic_protocol_version");
+      }
+      return "protocol version " + info.quic_protocol_version;
+    },
+  },
+  ...$enum(QuicVal)
+    .getEntries()
+    .filter(([, val]) => val != QuicVal.Invalid)
+    .map(([key, val]) => {
+      return {
+        name: "get " + key,
+        skip: (serial: Serial) => skipValue(serial, val),
+        run: async (serial: Serial) => {
+          const res = await serial.get(val, CONFORMANCE_TIMEOUT);
+          if (res === undefined) {
+            throw new Error("empty payload");
+          }
+        },
+      };
+    }),
+  {
+    name: "get invalid value",
+    run: async (serial) => {
+      const res = await expectError(
+        serial.commandTimeout(QuicCmd.Get, CONFORMANCE_TIMEOUT, 0xff)
+      );
+      await expectAlive(serial);
+      return res;
+    },
+  },
+  {
+    name: "get bad type",
+    run: async (serial) => {
+      const res = await expectError(
+        serial.commandTimeout(QuicCmd.Get, CONFORMANCE_TIMEOUT, "info")
+      );
+      await expectAlive(serial);
+      return res;
+    },
+  },
+  {
+    name: "get empty payload",
+    run: async (serial) => {
+      const res = await expectError(
+        serial.commandTimeout(QuicCmd.Get, CONFORMANCE_TIMEOUT)
+      );
+      await expectAlive(serial);
+      return res;
+    },
+  },
+  {
+    name: "max length payload",
+    run: async (serial) => {
+      const padding = new Uint8Array(MAX_PAYLOAD_LEN);
+      try {
+        await serial.commandTimeout(
+          QuicCmd.Get,
+          CONFORMANCE_TIMEOUT,
+          QuicVal.Info,
+          padding
+        );
+      } catch (err) {
+        if (err == "timeout") {
+          throw new Error("no response");
+        }
+      }
+      await expectAlive(serial);
+    },
+  },
+  {
+    name: "pipelined requests",
+    run: async (serial) => {
+      // leave room for the keepalive so the queue does not run full
+      const count = Math.min(
+        PIPELINE_COUNT,
+        settings.serial.maxQueuedCommands - serial.queueStats().depth - 1
+      );
+      if (count < 2) {
+        throw new Error("command queue is busy");
+      }
+
+      const start = performance.now();
+      const pending = Array.from(Array(count).keys()).map(() =>
+        serial.get(QuicVal.State, CONFORMANCE_TIMEOUT)
+      );
+      await Promise.all(pending);
+      const delta = (performance.now() - start) / count;
+      return count + " requests, " + delta.toFixed(1) + "ms per request";
+    },
+  },
+  {
+    name: "profile round trip",
+    write: true,
+    run: async (serial) => {
+      const profile = await serial.get(QuicVal.Profile, CONFORMANCE_TIMEOUT);
+      const res = await serial.set(QuicVal.Profile, profile);
+      if (JSON.stringify(res) != JSON.stringify(profile)) {
+        throw new Error("profile changed during round trip");
+      }
+    },
+  },
+];
+
+export async function runConformance(
+  serial: Serial,
+  onResult?: (r: ConformanceResult) => void
+): Promise<ConformanceResult[]> {
+  const results: ConformanceResult[] = [];
+  for (const c of ConformanceCases) {
+    const start = performance.now();
+
+    let result: ConformanceResult;
+    const skip =
+      c.write && serial.writeProtected
+        ? "write protected"
+        : c.skip?.(serial);
+    if (skip) {
+      result = {
+        name: c.name,
+        passed: false,
+        skipped: true,
+        message: skip,
+        duration: 0,
+      };
+    } else {
+      try {
+        const message = await c.run(serial);
+        result = {
+          name: c.name,
+          passed: true,
+          message: message || undefined,
+          duration: performance.now() - start,
+        };
+      } catch (err) {
+        result = {
+          name: c.name,
+          passed: false,
+          message: String(err),
+          duration: performance.now() - start,
+        };
+      }
+    }
+
+    results.push(result);
+    if (onResult) {
+      onResult(result);
+    }
+  }
+  return results;
+}
@@ -0,0 +1,18 @@
+function escapeField(val: any): string {
+  if (val === undefined || val === null) {
+    return "";
+  }
+  const str = val.toString();
+  if (/[",\n\r]/.test(str)) {
+    return '"' + str.replace(/"/g, '""') + '"';
+  }
+  return str;
+}
+
+export function encodeCSVRow(row: any[]): string {
+  return row.map(escapeField).join(",");
+}
+
+export function encodeCSV(header: string[], rows: any[][]): string {
+  return [header, ...rows].map(encodeCSVRow).join("\n");
+}
@@ -0,0 +1,119 @@
+export interface DiffEntry {
+  path: string;
+  lhs: any;
+  rhs: any;
+}
+
+function isObject(val: any) {
+  return val !== null && typeof val === "object";
+}
+
+// unlike a json round trip this keeps byte strings and cbor tags intact
+export function cloneDeep<T>(val: T): T {
+  if (!isObject(val)) {
+    return val;
+  }
+  if (val instanceof Uint8Array) {
+    return new Uint8Array(val) as T;
+  }
+  if (Array.isArray(val)) {
+    return val.map((v) => cloneDeep(v)) as T;
+  }
+  const res = Object.create(Object.getPrototypeOf(val));
+  for (const [key, v] of Object.entries(val as any)) {
+    res[key] = cloneDeep(v);
+  }
+  return res;
+}
+
+export function diffObjects(lhs: any, rhs: any, prefix = ""): DiffEntry[] {
+  if (!isObject(lhs) || !isObject(rhs)) {
+    if (lhs === rhs) {
+      return [];
+    }
+    return [{ path: prefix, lhs, rhs }];
+  }
+
+  const result: DiffEntry[] = [];
+  const keys = new Set([...Object.keys(lhs), ...Object.keys(rhs)]);
+  for (const key of keys) {
+    const path = prefix.length ? prefix + "." + key : key;
+    result.push(...diffObjects(lhs[key], rhs[key], path));
+  }
+  return result;
+}
+
+export function getPath(obj: any, path: string): any {
+  let res = obj;
+  for (const key of path.split(".")) {
+    if (!isObject(res)) {
+      return undefined;
+    }
+    res = res[key];
+  }
+  return res;
+}
+
+export function setPath(obj: any, path: string, val: any) {
+  const keys = path.split(".");
+  const last = keys.pop()!;
+
+  let res = obj;
+  for (const key of keys) {
+    if (!isObject(res[key])) {
+      res[key] = {};
+    }
+    res = res[key];
+  }
+  res[last] = val;
+  return obj;
+}
+
+export function flattenObject(obj: any, prefix = ""): [string, any][] {
+  if (!isObject(obj)) {
+    return [[prefix, obj]];
+  }
+
+  const result: [string, any][] = [];
+  for (const [key, val] of Object.entries(obj)) {
+    const path = prefix.length ? prefix + "." + key : key;
+    result.push(...flattenObject(val, path));
+  }
+  return result;
+}
+
+// byte strings, cbor tags and arrays are values of their own, only plain
+// objects merge
+function isPlainObject(val: any) {
+  if (!isObject(val) || Array.isArray(val)) {
+    return false;
+  }
+  const proto = Object.getPrototypeOf(val);
+  return proto === Object.prototype || proto === null;
+}
+
+export interface MergePatchOptions {
+  // rfc 7396, null removes a key instead of being set
+  deleteNulls?: boolean;
+}
+
+// objects merge, anything else replaces, arrays included
+export function applyMergePatch(
+  target: any,
+  patch: any,
+  opts: MergePatchOptions = {}
+): any {
+  if (!isPlainObject(patch)) {
+    return patch;
+  }
+
+  const res = isPlainObject(target) ? { ...target } : {};
+  for (const [key, val] of Object.entries(patch)) {
+    if (val === null && opts.deleteNulls) {
+      delete res[key];
+    } else {
+      res[key] = applyMergePatch(res[key], val, opts);
+    }
+  }
+  return res;
+}
@@ -0,0 +1,88 @@
+import type { BlackboxFrame } from "../blackbox";
+
+type FrameHandler = (frame: BlackboxFrame) => void;
+
+// index of the min and max in the order they were seen
+function extremes(values: number[]): [number, number] {
+  let min = 0;
+  let max = 0;
+  values.forEach((v, i) => {
+    if (v < values[min]) {
+      min = i;
+    }
+    if (v > values[max]) {
+      max = i;
+    }
+  });
+  return min <= max ? [min, max] : [max, min];
+}
+
+// two frames carry the extremes of every value in the bucket, so spikes
+// survive where averaging or picking every nth frame would drop them
+export function decimateFrames(frames: BlackboxFrame[]): BlackboxFrame[] {
+  if (frames.length <= 2) {
+    return frames;
+  }
+
+  const rows = frames as any[];
+  const head = rows[0];
+  const tail = rows[rows.length - 1];
+  const first: any = { loop: head.loop, time: head.time };
+  const second: any = { loop: tail.loop, time: tail.time };
+  for (const key of Object.keys(head)) {
+    if (key == "loop" || key == "time") {
+      continue;
+    }
+    if (!Array.isArray(head[key])) {
+      const values = rows.map((f) => f[key]);
+      const [a, b] = extremes(values);
+      first[key] = values[a];
+      second[key] = values[b];
+      continue;
+    }
+
+    first[key] = [];
+    second[key] = [];
+    head[key].forEach((_, i: number) => {
+      const values = rows.map((f) => f[key][i]);
+      const [a, b] = extremes(values);
+      first[key][i] = values[a];
+      second[key][i] = values[b];
+    });
+  }
+  return [first, second];
+}
+
+// buckets frames by their timestamp, a bucket spans two output frames. a
+// rate of 0 passes every frame through
+export class FrameDecimator {
+  private bucket: BlackboxFrame[] = [];
+  private bucketStart = 0;
+
+  constructor(private rate: number, private emit: FrameHandler) {}
+
+  push(frame: BlackboxFrame) {
+    if (!this.rate) {
+      this.emit(frame);
+      return;
+    }
+
+    // frame time is in us and restarts with the board
+    const width = 2e6 / this.rate;
+    const elapsed = frame.time - this.bucketStart;
+    if (this.bucket.length && (elapsed < 0 || elapsed >= width)) {
+      this.flush();
+    }
+    if (!this.bucket.length) {
+      this.bucketStart = frame.time;
+    }
+    this.bucket.push(frame);
+  }
+
+  flush() {
+    for (const frame of decimateFrames(this.bucket)) {
+      this.emit(frame);
+    }
+    this.bucket = [];
+  }
+}
@@ -0,0 +1,167 @@
+import {
+  BlobWriter,
+  TextReader,
+  TextWriter,
+  Uint8ArrayReader,
+  Uint8ArrayWriter,
+  ZipReader,
+  ZipWriter,
+} from "@zip.js/zip.js";
+import { $enum } from "ts-enum-util";
+import { Log } from "@/log";
+import { CBOR } from "../serial/cbor";
+import { QuicVal } from "../serial/quic";
+import type { Serial } from "../serial/serial";
+
+const MANIFEST_NAME = "manifest.json";
+const DUMP_FORMAT = 1;
+
+// live telemetry, not configuration
+const VOLATILE_VALUES = [QuicVal.State, QuicVal.PerfCounters];
+
+// reading esc settings needs the passthrough, fonts go through the osd
+// command, neither can be round tripped with a plain get/set
+const UNDUMPABLE_VALUES = [QuicVal.BLHeliSettings, QuicVal.OSDFont];
+
+// written in this order, then saved with Serial.persist
+export const RESTORABLE_VALUES = [
+  QuicVal.BindInfo,
+  QuicVal.VtxSettings,
+  QuicVal.Profile,
+];
+
+export interface DumpManifest {
+  format: number;
+  created: number;
+  target_name: string;
+  git_version: string;
+  values: string[];
+  skipped: string[];
+}
+
+export interface ConfigDump {
+  manifest: DumpManifest;
+  values: Map<QuicVal, any>;
+}
+
+export type DumpProgress = (done: number, total: number) => void;
+
+function valueName(id: QuicVal) {
+  return $enum(QuicVal).getKeyOrThrow(id);
+}
+
+function dumpableValues(serial: Serial) {
+  const known = serial.capabilities.values;
+  return $enum(QuicVal)
+    .getValues()
+    .filter((id) => id != QuicVal.Invalid)
+    .filter((id) => !VOLATILE_VALUES.includes(id))
+    .filter((id) => !UNDUMPABLE_VALUES.includes(id))
+    .filter((id) => !known?.length || known.includes(id));
+}
+
+export async function dumpAll(
+  serial: Serial,
+  onProgress: DumpProgress = () => undefined
+): Promise<ConfigDump> {
+  const ids = dumpableValues(serial);
+  const values = new Map<QuicVal, any>();
+  const skipped: string[] = [];
+
+  for (const [i, id] of ids.entries()) {
+    try {
+      values.set(id, await serial.get(id));
+    } catch (err) {
+      Log.warn("dump", "skipping", valueName(id), err);
+      skipped.push(valueName(id));
+    }
+    onProgress(i + 1, ids.length);
+  }
+
+  const info = values.get(QuicVal.Info) || {};
+  return {
+    manifest: {
+      format: DUMP_FORMAT,
+      created: Math.floor(Date.now() / 1000),
+      target_name: info.target_name || "",
+      git_version: info.git_version || "",
+      values: [...values.keys()].map(valueName),
+      skipped,
+    },
+    values,
+  };
+}
+
+// values are kept as cbor so byte strings and float widths survive as
+// the firmware sent them
+export async function encodeDump(dump: ConfigDump): Promise<Blob> {
+  const zip = new ZipWriter(new BlobWriter("application/zip"));
+  await zip.add(
+    MANIFEST_NAME,
+    new TextReader(JSON.stringify(dump.manifest, null, 2))
+  );
+  for (const [id, val] of dump.values) {
+    await zip.add(
+      valueName(id) + ".cbor",
+      new Uint8ArrayReader(CBOR.encode(val))
+    );
+  }
+  return zip.close();
+}
+
+export async function decodeDump(data: Uint8Array): Promise<ConfigDump> {
+  const zip = new ZipReader(new Uint8ArrayReader(data));
+  const entries = await zip.getEntries();
+
+  const manifestEntry = entries.find((e) => e.filename == MANIFEST_NAME);
+  if (!manifestEntry?.getData) {
+    throw new Error("not a configuration dump");
+  }
+  const manifest: DumpManifest = JSON.parse(
+    await manifestEntry.getData(new TextWriter())
+  );
+  if (manifest.format > DUMP_FORMAT) {
+    throw new Error("dump format " + manifest.format + " is not supported");
+  }
+
+  const values = new Map<QuicVal, any>();
+  for (const entry of entries) {
+    const name = entry.filename.replace(/\.cbor$/, "");
+    if (name == entry.filename || !entry.getData || !(name in QuicVal)) {
+      continue;
+    }
+    const [val] = CBOR.decode(await entry.getData(new Uint8ArrayWriter()));
+    values.set(QuicVal[name as keyof typeof QuicVal], val);
+  }
+  await zip.close();
+
+  return { manifest, values };
+}
+
+export interface RestoreOptions {
+  force?: boolean;
+  onProgress?: DumpProgress;
+}
+
+export async function restoreAll(
+  serial: Serial,
+  dump: ConfigDump,
+  opts: RestoreOptions = {}
+) {
+  const info = await serial.get(QuicVal.Info);
+  if (!opts.force && info.target_name != dump.manifest.target_name) {
+    throw new Error(
+      `dump is for ${dump.manifest.target_name}, board is ${info.target_name}`
+    );
+  }
+
+  const ids = RESTORABLE_VALUES.filter((id) => dump.values.has(id));
+  const restored: string[] = [];
+  for (const [i, id] of ids.entries()) {
+    await serial.set(id, dump.values.get(id));
+    restored.push(valueName(id));
+    opts.onProgress?.(i + 1, ids.length);
+  }
+  await serial.persist();
+  return restored;
+}
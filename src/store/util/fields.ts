@@ -0,0 +1,207 @@
+import tooltipEntries from "@/assets/tooltips.json";
+import type { ProfileSchema } from "./schema";
+
+export interface FieldMeta {
+  unit?: string;
+  min?: number;
+  max?: number;
+  step?: number;
+  // key into the tooltip texts, shared with the help icons
+  tooltip?: string;
+  description?: string;
+}
+
+export interface FieldEntry extends FieldMeta {
+  // dotted profile path, * stands in for any one segment
+  path: string;
+}
+
+const PID_RANGE = { min: 0, max: 500, step: 1 };
+const CUTOFF_RANGE = { unit: "Hz", min: 10, max: 1000, step: 1 };
+const PERCENT_RANGE = { unit: "%", min: 0, max: 100 };
+
+// rate values depend on the rate mode and are described by RATE_LIMITS
+export const PROFILE_FIELDS: FieldEntry[] = [
+  {
+    path: "pid.pid_rates.*.kp.*",
+    ...PID_RANGE,
+    description: "Proportional gain",
+  },
+  { path: "pid.pid_rates.*.ki.*", ...PID_RANGE, description: "Integral gain" },
+  {
+    path: "pid.pid_rates.*.kd.*",
+    ...PID_RANGE,
+    description: "Derivative gain",
+  },
+  { path: "pid.stick_rates.*.accelerator.*", step: 0.01 },
+  { path: "pid.stick_rates.*.transition.*", step: 0.01 },
+  { path: "pid.small_angle.*", step: 0.01, tooltip: "pid.angle_strength" },
+  { path: "pid.big_angle.*", step: 0.01, tooltip: "pid.angle_strength" },
+  {
+    path: "pid.throttle_dterm_attenuation.tda_breakpoint",
+    min: 0,
+    max: 1,
+    step: 0.05,
+    tooltip: "pid.tda_breakpoint",
+  },
+  {
+    path: "pid.throttle_dterm_attenuation.tda_percent",
+    min: 0,
+    max: 1,
+    step: 0.05,
+    tooltip: "pid.tda_percent",
+  },
+  {
+    path: "rate.level_max_angle",
+    unit: "deg",
+    min: 0,
+    max: 90,
+    step: 1,
+    tooltip: "rate.level_max_angle",
+  },
+  {
+    path: "rate.sticks_deadband",
+    min: 0,
+    max: 0.5,
+    step: 0.01,
+    tooltip: "rate.sticks_deadband",
+  },
+  {
+    path: "rate.throttle_mid",
+    min: 0,
+    max: 1,
+    step: 0.01,
+    tooltip: "rate.throttle_mid",
+  },
+  {
+    path: "rate.throttle_expo",
+    min: 0,
+    max: 1,
+    step: 0.01,
+    tooltip: "rate.throttle_expo",
+  },
+  {
+    path: "filter.gyro.0.cutoff_freq",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.gyro_1_freq",
+  },
+  {
+    path: "filter.gyro.1.cutoff_freq",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.gyro_2_freq",
+  },
+  {
+    path: "filter.dterm.0.cutoff_freq",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.dterm_1_freq",
+  },
+  {
+    path: "filter.dterm.1.cutoff_freq",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.dterm_2_freq",
+  },
+  {
+    path: "filter.dterm_dynamic_min",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.dterm_dynamic_min",
+  },
+  {
+    path: "filter.dterm_dynamic_max",
+    ...CUTOFF_RANGE,
+    tooltip: "filter.dterm_dynamic_max",
+  },
+  { path: "blackbox.sample_rate_hz", unit: "Hz" },
+  {
+    path: "voltage.lipo_cell_count",
+    min: 0,
+    max: 8,
+    step: 1,
+    description: "Cells in the pack, 0 detects them on plug in",
+  },
+  { path: "voltage.vbattlow", unit: "V", min: 0, step: 0.01 },
+  { path: "voltage.actual_battery_voltage", unit: "V", min: 0, step: 0.01 },
+  {
+    path: "voltage.reported_telemetry_voltage",
+    unit: "V",
+    min: 0,
+    step: 0.01,
+  },
+  {
+    path: "motor.digital_idle",
+    ...PERCENT_RANGE,
+    step: 0.1,
+    tooltip: "motor.digital_idle",
+  },
+  {
+    path: "motor.motor_limit",
+    ...PERCENT_RANGE,
+    step: 1,
+    tooltip: "motor.motor_limit",
+  },
+  {
+    path: "motor.turtle_throttle_percent",
+    ...PERCENT_RANGE,
+    step: 1,
+    tooltip: "motor.turtle_throttle_percent",
+  },
+  {
+    path: "motor.torque_boost",
+    min: 0,
+    step: 0.1,
+    tooltip: "motor.torque_boost",
+  },
+  {
+    path: "motor.throttle_boost",
+    min: 0,
+    step: 0.1,
+    tooltip: "motor.throttle_boost",
+  },
+];
+
+function compilePath(path: string) {
+  const pattern = path
+    .split(".")
+    .map((part) => (part == "*" ? "[^.]+" : part.replace(/[^\w]/g, "\\$&")))
+    .join("\\.");
+  return new RegExp("^" + pattern + "$");
+}
+
+export function compileFields(fields: FieldEntry[]) {
+  const compiled = fields.map(({ path, ...meta }) => ({
+    re: compilePath(path),
+    meta: meta as FieldMeta,
+  }));
+
+  return (path: string): FieldMeta | undefined => {
+    const match = compiled.find(({ re }) => re.test(path));
+    if (!match) {
+      return undefined;
+    }
+
+    const meta = { ...match.meta };
+    if (!meta.description && meta.tooltip) {
+      meta.description = tooltipEntries[meta.tooltip]?.text;
+    }
+    return meta;
+  };
+}
+
+const matchProfileField = compileFields(PROFILE_FIELDS);
+
+// a schema overrides the registry for the firmware it describes
+export function fieldMeta(
+  path: string,
+  schema?: ProfileSchema
+): FieldMeta | undefined {
+  return schema?.fieldMeta(path) || matchProfileField(path);
+}
+
+export function fieldUnit(path: string, schema?: ProfileSchema) {
+  return fieldMeta(path, schema)?.unit || "";
+}
+
+// ready to bind onto a number input
+export function fieldAttrs(path: string, schema?: ProfileSchema) {
+  const meta = fieldMeta(path, schema);
+  return { min: meta?.min, max: meta?.max, step: meta?.step };
+}
@@ -0,0 +1,67 @@
+import { Log } from "@/log";
+
+const FILE_POLL_INTERVAL = 1000;
+const FILE_DEBOUNCE = 500;
+
+export type FileChangeHandler = (text: string) => Promise<void> | void;
+
+// the file system access api has no change events, a handle is polled for
+// its modification time instead. editors tend to write in bursts, so the
+// handler only runs once the file has settled.
+export class FileWatcher {
+  private timer?: any;
+  private debounceTimer?: any;
+  private lastModified = 0;
+
+  constructor(
+    private handle: any,
+    private onChange: FileChangeHandler,
+    private interval = FILE_POLL_INTERVAL,
+    private debounce = FILE_DEBOUNCE
+  ) {}
+
+  get name(): string {
+    return this.handle.name;
+  }
+
+  async start() {
+    this.stop();
+
+    const file = await this.handle.getFile();
+    this.lastModified = file.lastModified;
+    this.timer = setInterval(() => this.poll(), this.interval);
+    await this.onChange(await file.text());
+  }
+
+  stop() {
+    clearInterval(this.timer);
+    clearTimeout(this.debounceTimer);
+    this.timer = undefined;
+    this.debounceTimer = undefined;
+  }
+
+  private async poll() {
+    try {
+      const file = await this.handle.getFile();
+      if (file.lastModified == this.lastModified) {
+        return;
+      }
+      this.lastModified = file.lastModified;
+
+      clearTimeout(this.debounceTimer);
+      this.debounceTimer = setTimeout(() => this.fire(), this.debounce);
+    } catch (err) {
+      Log.warn("filewatch", "poll failed", err);
+    }
+  }
+
+  private async fire() {
+    this.debounceTimer = undefined;
+    try {
+      const file = await this.handle.getFile();
+      await this.onChange(await file.text());
+    } catch (err) {
+      Log.warn("filewatch", "change handler failed", err);
+    }
+  }
+}
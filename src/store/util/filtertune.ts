@@ -0,0 +1,158 @@
+import { DEFAULT_SPECTRUM_OPTIONS, spectrum } from "../analysis/spectrum";
+import type { profile_filter_t } from "../types";
+
+export interface GyroSpectrum {
+  sample_rate: number;
+  freqs: number[];
+  // averaged over the axes, arbitrary units
+  power: number[];
+}
+
+export interface CraftSpec {
+  motor_kv: number;
+  prop_inch: number;
+  cells: number;
+}
+
+export interface FilterSuggestion {
+  gyro: number[];
+  dterm: number[];
+  dterm_dynamic_min: number;
+  dterm_dynamic_max: number;
+  // strongest noise above stick motion, 0 if none stood out
+  noise_peak: number;
+  motor_freq: number;
+  notes: string[];
+}
+
+const MIN_CUTOFF = 50;
+const MAX_CUTOFF = 500;
+
+// everything below is what the pilot does with the sticks
+const NOISE_MIN_FREQ = 70;
+
+// a peak has to stand this far above the median to count as noise
+const NOISE_PEAK_RATIO = 4;
+
+// bigger props spin slower and need less filter room, values are roughly
+// where stock tunes for each size end up
+const PROP_CUTOFFS = [
+  { prop_inch: 2, cutoff: 300 },
+  { prop_inch: 3, cutoff: 250 },
+  { prop_inch: 5, cutoff: 200 },
+  { prop_inch: Infinity, cutoff: 150 },
+];
+
+const CELL_VOLTAGE = 3.7;
+const HOVER_THROTTLE = 0.35;
+
+function clampCutoff(freq: number) {
+  return Math.round(Math.min(Math.max(freq, MIN_CUTOFF), MAX_CUTOFF) / 5) * 5;
+}
+
+// welch averaged over the capture, then over the axes
+export function gyroSpectrum(
+  samples: number[][],
+  sample_rate: number,
+  size = DEFAULT_SPECTRUM_OPTIONS.size
+): GyroSpectrum {
+  // the fft wants a power of two, short captures get a smaller window
+  let n = size;
+  while (n > 2 && n > samples.length) {
+    n >>= 1;
+  }
+  const axes = samples.length ? samples[0].length : 0;
+  const series = Array.from({ length: axes }, (_, axis) =>
+    samples.map((s) => s[axis])
+  );
+
+  const avg = spectrum(series, sample_rate, {
+    ...DEFAULT_SPECTRUM_OPTIONS,
+    size: n,
+  });
+  return {
+    sample_rate,
+    freqs: avg.freqs,
+    power: avg.freqs.map((_, k) =>
+      avg.power.reduce((sum, p) => sum + p[k] / axes, 0)
+    ),
+  };
+}
+
+export function noisePeak(spectrum: GyroSpectrum, minFreq = NOISE_MIN_FREQ) {
+  const candidates = spectrum.freqs
+    .map((freq, i) => ({ freq, power: spectrum.power[i] }))
+    .filter((b) => b.freq >= minFreq);
+  if (!candidates.length) {
+    return 0;
+  }
+
+  const sorted = candidates.map((b) => b.power).sort((a, b) => a - b);
+  const median = sorted[Math.floor(sorted.length / 2)];
+  const peak = candidates.reduce((a, b) => (b.power > a.power ? b : a));
+  return peak.power > median * NOISE_PEAK_RATIO ? peak.freq : 0;
+}
+
+// motor rotation at hover, the fundamental of the noise the frame carries
+export function motorFrequency(craft: CraftSpec) {
+  return (craft.motor_kv * craft.cells * CELL_VOLTAGE * HOVER_THROTTLE) / 60;
+}
+
+export function suggestFilters(
+  spectrum: GyroSpectrum,
+  craft: CraftSpec
+): FilterSuggestion {
+  const notes: string[] = [];
+  const motor_freq = motorFrequency(craft);
+  const noise_peak = noisePeak(spectrum);
+
+  const prop = PROP_CUTOFFS.find((p) => craft.prop_inch <= p.prop_inch)!;
+  let cutoff = prop.cutoff;
+  if (noise_peak) {
+    notes.push(`noise peak at ${Math.round(noise_peak)}Hz`);
+    // keep the first pass well below the peak so it is damped by the slope
+    if (noise_peak * 0.7 < cutoff) {
+      cutoff = noise_peak * 0.7;
+      notes.push("gyro cutoff lowered below the noise peak");
+    }
+  } else {
+    notes.push("no clear noise peak, using the prop size default");
+  }
+  if (motor_freq && cutoff > motor_freq) {
+    notes.push(
+      `motors hover around ${Math.round(motor_freq)}Hz, below the gyro cutoff`
+    );
+  }
+
+  const gyro = clampCutoff(cutoff);
+  const dterm = clampCutoff(gyro * 0.6);
+  return {
+    gyro: [gyro, clampCutoff(gyro * 1.5)],
+    dterm: [dterm, clampCutoff(dterm * 1.5)],
+    dterm_dynamic_min: clampCutoff(dterm * 0.7),
+    dterm_dynamic_max: clampCutoff(dterm * 1.5),
+    noise_peak,
+    motor_freq,
+    notes,
+  };
+}
+
+// filter types are left alone, only the cutoffs move
+export function applyFilterSuggestion(
+  filter: profile_filter_t,
+  s: FilterSuggestion
+): profile_filter_t {
+  return {
+    ...filter,
+    gyro: filter.gyro.map((f, i) => ({
+      ...f,
+      cutoff_freq: s.gyro[i] ?? f.cutoff_freq,
+    })),
+    dterm: filter.dterm.map((f, i) => ({
+      ...f,
+      cutoff_freq: s.dterm[i] ?? f.cutoff_freq,
+    })),
+    dterm_dynamic_min: s.dterm_dynamic_min,
+    dterm_dynamic_max: s.dterm_dynamic_max,
+  };
+}
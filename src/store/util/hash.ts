@@ -0,0 +1,61 @@
+import { CBORTag } from "../serial/cbor";
+
+// bookkeeping the firmware rewrites on every save, two profiles that only
+// differ here hold the same tune
+const HASH_IGNORED_PATHS = ["meta.datetime", "semver"];
+
+function toHex(data: Uint8Array) {
+  return Array.from(data, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+// names come back from the firmware padded with \0, floats are rounded to
+// what a float32 can hold so a value read back matches what was written
+function canonicalValue(val: any, path: string): any {
+  if (HASH_IGNORED_PATHS.includes(path)) {
+    return undefined;
+  }
+  if (typeof val === "string") {
+    return val.replace(/\0/g, "");
+  }
+  if (typeof val === "number") {
+    return Number.isInteger(val) ? val : Math.fround(val);
+  }
+  if (val === null || typeof val !== "object") {
+    return val;
+  }
+  if (val instanceof Uint8Array) {
+    return { $binary: toHex(val) };
+  }
+  if (val instanceof CBORTag) {
+    return { $tag: val.tag, $value: canonicalValue(val.value, path) };
+  }
+
+  const child = (key: string) => (path.length ? path + "." + key : key);
+  if (Array.isArray(val)) {
+    return val.map((v, i) => canonicalValue(v, child(String(i))));
+  }
+
+  const res: any = {};
+  for (const key of Object.keys(val).sort()) {
+    const v = canonicalValue(val[key], child(key));
+    if (v !== undefined) {
+      res[key] = v;
+    }
+  }
+  return res;
+}
+
+// sorted keys and no whitespace, equal profiles encode to equal strings
+export function canonicalJSON(profile: any) {
+  return JSON.stringify(canonicalValue(profile, ""));
+}
+
+export async function profileHash(profile: any) {
+  const data = new TextEncoder().encode(canonicalJSON(profile));
+  const digest = await crypto.subtle.digest("SHA-256", data);
+  return toHex(new Uint8Array(digest));
+}
+
+export function shortHash(hash: string) {
+  return hash.substring(0, 8);
+}
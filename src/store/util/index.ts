@@ -15,6 +15,16 @@ export function stringToUint8Array(str: string): Uint8Array {
   return res;
 }
 
+export function crc16(data: ArrayLike<number>, crc = 0): number {
+  for (let i = 0; i < data.length; i++) {
+    crc ^= data[i] << 8;
+    for (let j = 0; j < 8; j++) {
+      crc = crc & 0x8000 ? (crc << 1) ^ 0x1021 : crc << 1;
+    }
+  }
+  return crc & 0xffff;
+}
+
 export class ArrayWriter {
   private offset = 0;
   private buf = new ArrayBuffer(4);
@@ -46,7 +56,7 @@ export class ArrayWriter {
 
   public writeUint8s(values: ArrayLike<number>) {
     this.grow(values.length);
-    new Uint8Array(this.buf).set(Uint8Array.from(values), this.offset);
+    new Uint8Array(this.buf).set(values, this.offset);
     this.offset += values.length;
   }
 
@@ -78,13 +88,11 @@ export class ArrayWriter {
 
 export class ArrayReader {
   private offset = 0;
-  private buf = new ArrayBuffer(0);
-  private view = new DataView(this.buf);
+  private view = new DataView(new ArrayBuffer(0));
 
   constructor(array?: Uint8Array) {
     if (array) {
-      this.buf = array.buffer.slice(0, array.length);
-      this.view = new DataView(this.buf);
+      this.view = new DataView(array.buffer, array.byteOffset, array.length);
     }
   }
 
@@ -93,7 +101,7 @@ export class ArrayReader {
   }
 
   public remaining(): number {
-    return this.buf.byteLength - this.offset;
+    return this.view.byteLength - this.offset;
   }
 
   public peekUint8(): number {
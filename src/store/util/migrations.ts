@@ -0,0 +1,94 @@
+import semver from "semver";
+import { Log } from "@/log";
+import type { target_info_t, target_t } from "../types";
+
+export interface MigrationContext {
+  target: target_t;
+  info?: target_info_t;
+  from: string;
+  to: string;
+}
+
+// a migration runs when a profile older than `version` is loaded onto
+// firmware at or past it
+export interface ProfileMigration {
+  version: string;
+  description: string;
+  migrate: (profile: any, ctx: MigrationContext) => any;
+}
+
+const migrations: ProfileMigration[] = [];
+
+export function registerMigration(migration: ProfileMigration) {
+  if (!semver.valid(migration.version)) {
+    throw new Error("invalid migration version " + migration.version);
+  }
+  migrations.push(migration);
+  migrations.sort((a, b) => semver.compare(a.version, b.version));
+}
+
+export function pendingMigrations(from: string, to: string) {
+  return migrations.filter(
+    (m) => semver.gt(m.version, from) && semver.lte(m.version, to)
+  );
+}
+
+export function runMigrations(profile: any, ctx: MigrationContext) {
+  let p = profile;
+  for (const m of pendingMigrations(ctx.from, ctx.to)) {
+    Log.info("profile", "migrating to", m.version, m.description);
+    p = m.migrate(p, ctx) ?? p;
+  }
+  return p;
+}
+
+registerMigration({
+  version: "v0.1.1",
+  description: "split rates into silverware and betaflight profiles",
+  migrate(profile) {
+    const silverware = {
+      mode: 0,
+      rate: [
+        profile.rate.silverware?.max_rate || [860, 860, 500],
+        profile.rate.silverware?.acro_expo || [0.8, 0.8, 0.6],
+        profile.rate.silverware?.angle_expo || [0.55, 0, 0.55],
+      ],
+    };
+    const betaflight = {
+      mode: 1,
+      rate: [
+        profile.rate.betaflight?.rc_rate || [1.3, 1.3, 1.3],
+        profile.rate.betaflight?.super_rate || [0.7, 0.7, 0.7],
+        profile.rate.betaflight?.expo || [0.4, 0.4, 0.4],
+      ],
+    };
+
+    profile.rate.profile = 0;
+
+    if (profile.rate.mode == 0) {
+      profile.rate.rates = [silverware, betaflight];
+    } else {
+      profile.rate.rates = [betaflight, silverware];
+    }
+    return profile;
+  },
+});
+
+registerMigration({
+  version: "v0.2.2",
+  description: "serial ports referenced by index instead of position",
+  migrate(profile, { target }) {
+    const serial_ports = target.serial_ports.filter((p) => p.index != 0);
+    for (const key of Object.keys(profile.serial || {})) {
+      if (profile.serial[key] == 0) {
+        continue;
+      }
+      if (profile.serial[key] <= serial_ports.length) {
+        profile.serial[key] = serial_ports[profile.serial[key] - 1].index;
+      } else {
+        profile.serial[key] = profile.serial[key] - serial_ports.length + 100;
+      }
+    }
+    return profile;
+  },
+});
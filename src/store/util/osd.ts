@@ -5,6 +5,10 @@ export class OSD {
 
   public static FONT_WIDTH = 16;
   public static FONT_HEIGHT = 16;
+  public static FONT_CHARS = OSD.FONT_WIDTH * OSD.FONT_HEIGHT;
+
+  public static CHAR_SIZE = (OSD.CHAR_WIDTH * OSD.CHAR_HEIGHT) / 4;
+  public static MCM_CHAR_SIZE = 64;
 
   public static FULL_WIDTH = OSD.pixelsWidth(OSD.FONT_WIDTH);
   public static FULL_HEIGHT = OSD.pixelsHeight(OSD.FONT_HEIGHT);
@@ -184,6 +188,43 @@ export class OSD {
     return OSD.packCanvas(ctx);
   }
 
+  public static parseMCM(text: string): Uint8Array[] {
+    const lines = text
+      .split(/\r?\n/)
+      .map((l) => l.trim())
+      .filter((l) => l.length);
+    if (lines.shift() != "MAX7456") {
+      throw new Error("Invalid MCM header");
+    }
+    if (lines.length < OSD.FONT_CHARS * OSD.MCM_CHAR_SIZE) {
+      throw new Error("Truncated MCM font");
+    }
+
+    const data = new Uint8Array(OSD.FONT_CHARS * OSD.MCM_CHAR_SIZE);
+    for (let i = 0; i < data.length; i++) {
+      if (!/^[01]{8}$/.test(lines[i])) {
+        throw new Error(`Invalid MCM line ${i + 2}`);
+      }
+      data[i] = parseInt(lines[i], 2);
+    }
+    return OSD.parseFontBinary(data);
+  }
+
+  public static parseFontBinary(data: Uint8Array): Uint8Array[] {
+    let stride = OSD.MCM_CHAR_SIZE;
+    if (data.length == OSD.FONT_CHARS * OSD.CHAR_SIZE) {
+      stride = OSD.CHAR_SIZE;
+    } else if (data.length < OSD.FONT_CHARS * OSD.MCM_CHAR_SIZE) {
+      throw new Error("Invalid font size");
+    }
+
+    const font: Uint8Array[] = [];
+    for (let i = 0; i < OSD.FONT_CHARS; i++) {
+      font.push(data.slice(i * stride, i * stride + OSD.CHAR_SIZE));
+    }
+    return font;
+  }
+
   public static packLogo(
     fontCanvas: HTMLCanvasElement,
     logoCanvas: HTMLCanvasElement,
@@ -0,0 +1,145 @@
+import { OSD } from "./osd";
+
+export interface OSDScreen {
+  width: number;
+  height: number;
+}
+
+export const OSD_SCREENS: { [name: string]: OSDScreen } = {
+  PAL: { width: 30, height: 15 },
+  // NTSC has less lines
+  NTSC: { width: 30, height: 13 },
+  HD: { width: 50, height: 18 },
+};
+
+// in the order the firmware stores them in osd.elements
+export const OSD_ELEMENT_NAMES = [
+  "CALLSIGN",
+  "CELL COUNT",
+  "FUELGAUGE VOLTS",
+  "FILTERED VOLTS",
+  "GYRO TEMP",
+  "FLIGHT MODE",
+  "RSSI",
+  "STOPWATCH",
+  "SYSTEM STATUS",
+  "THROTTLE",
+  "VTX CHANNEL",
+  "CURRENT",
+  "CROSSHAIR",
+];
+
+// sample values in font codes, the callsign comes from the profile
+export const OSD_PREVIEW_TEXT: { [name: string]: string } = {
+  "CELL COUNT": "1S",
+  "FUELGAUGE VOLTS": " 4.3\x70",
+  "FILTERED VOLTS": " 4.3\x06",
+  "GYRO TEMP": "  40\x0e",
+  "FLIGHT MODE": "   ACRO   ",
+  RSSI: "  90\x01",
+  STOPWATCH: "01:20",
+  "SYSTEM STATUS": "     **FAILSAFE**     ",
+  THROTTLE: "  50\x04",
+  "VTX CHANNEL": "R:7:1",
+  CURRENT: "0.00\x9a",
+  CROSSHAIR: "\x72\x73\x74",
+};
+
+export interface OSDElement {
+  index: number;
+  name: string;
+  active: boolean;
+  invert: boolean;
+  x: number;
+  y: number;
+}
+
+export function decodeElement(raw: number, index: number): OSDElement {
+  return {
+    index,
+    name: OSD_ELEMENT_NAMES[index] || `ELEMENT ${index}`,
+    active: OSD.elementDecode(raw, "active") == 1,
+    invert: OSD.elementDecode(raw, "invert") == 1,
+    x: OSD.elementDecode(raw, "pos_x"),
+    y: OSD.elementDecode(raw, "pos_y"),
+  };
+}
+
+// bits outside the known attributes are kept as they were
+export function encodeElement(el: Omit<OSDElement, "index" | "name">, raw = 0) {
+  raw = OSD.elementEncode(raw, "active", el.active);
+  raw = OSD.elementEncode(raw, "invert", el.invert);
+  raw = OSD.elementEncode(raw, "pos_x", el.x);
+  return OSD.elementEncode(raw, "pos_y", el.y);
+}
+
+export function decodeLayout(raw: number[]): OSDElement[] {
+  return raw.map((el, i) => decodeElement(el, i));
+}
+
+function updateElement(
+  raw: number[],
+  index: number,
+  fn: (el: OSDElement) => Partial<OSDElement>
+) {
+  if (index < 0 || index >= raw.length) {
+    throw new Error("no osd element " + index);
+  }
+  const copy = [...raw];
+  const el = decodeElement(raw[index], index);
+  copy[index] = encodeElement({ ...el, ...fn(el) }, raw[index]);
+  return copy;
+}
+
+export function moveElement(
+  raw: number[],
+  index: number,
+  x: number,
+  y: number,
+  screen: OSDScreen = OSD_SCREENS.PAL
+) {
+  return updateElement(raw, index, () => ({
+    x: Math.min(Math.max(Math.floor(x), 0), screen.width - 1),
+    y: Math.min(Math.max(Math.floor(y), 0), screen.height - 1),
+  }));
+}
+
+export function enableElement(raw: number[], index: number, active = true) {
+  return updateElement(raw, index, () => ({ active }));
+}
+
+export function invertElement(raw: number[], index: number, invert = true) {
+  return updateElement(raw, index, () => ({ invert }));
+}
+
+// font codes outside printable ascii are symbols, shown as a placeholder
+function gridChar(code: number) {
+  return code < 0x20 || code > 0x7e ? "*" : String.fromCharCode(code);
+}
+
+// plain text preview of what the goggles would show, one string per line
+export function renderLayout(
+  raw: number[],
+  screen: OSDScreen,
+  texts: { [name: string]: string } = OSD_PREVIEW_TEXT
+) {
+  const grid = Array.from({ length: screen.height }, () =>
+    new Array(screen.width).fill(" ")
+  );
+
+  for (const el of decodeLayout(raw)) {
+    const text = texts[el.name];
+    if (!el.active || !text || el.y >= screen.height) {
+      continue;
+    }
+    for (let i = 0; i < text.length && el.x + i < screen.width; i++) {
+      const code = text.charCodeAt(i);
+      if (code == 0) {
+        break;
+      }
+      grid[el.y][el.x + i] = gridChar(code);
+    }
+  }
+
+  return grid.map((row) => row.join(""));
+}
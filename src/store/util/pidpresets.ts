@@ -0,0 +1,105 @@
+import {
+  pid_voltage_compensation_t,
+  type pid_rate_t,
+  type profile_motor_t,
+  type profile_voltage_t,
+} from "../types";
+
+export type CraftClass = "whoop" | "toothpick" | "freestyle";
+
+export interface PidPreset {
+  craft: CraftClass;
+  name: string;
+  // the pack the gains were tuned on
+  cells: number;
+  rate: pid_rate_t;
+}
+
+export const PID_PRESETS: PidPreset[] = [
+  {
+    craft: "whoop",
+    name: "Whoop 65-75mm 1S",
+    cells: 1,
+    rate: {
+      kp: [30.5, 32, 50],
+      ki: [70, 70, 70],
+      kd: [45, 40, 0],
+    },
+  },
+  {
+    craft: "toothpick",
+    name: "Toothpick 2.5-3in 3S",
+    cells: 3,
+    rate: {
+      kp: [50, 52, 60],
+      ki: [70, 70, 70],
+      kd: [32, 34, 0],
+    },
+  },
+  {
+    craft: "freestyle",
+    name: "Freestyle 5in 4S",
+    cells: 4,
+    rate: {
+      kp: [72, 72, 60],
+      ki: [70, 70, 70],
+      kd: [37, 37, 0],
+    },
+  },
+];
+
+const MIN_SCALE = 0.5;
+const MAX_SCALE = 1.5;
+
+// motor limits below this are taken as a deliberate power cap and left alone
+const MIN_MOTOR_LIMIT = 50;
+
+export interface PresetContext {
+  voltage?: Partial<profile_voltage_t>;
+  motor?: Partial<profile_motor_t>;
+}
+
+export function findPidPreset(craft: CraftClass) {
+  const preset = PID_PRESETS.find((p) => p.craft == craft);
+  if (!preset) {
+    throw new Error("no pid preset for " + craft);
+  }
+  return preset;
+}
+
+// authority grows with pack voltage and shrinks with the motor limit, so
+// gains are scaled back to what the preset was tuned on
+export function presetScale(preset: PidPreset, ctx: PresetContext) {
+  let scale = 1;
+
+  const compensated =
+    ctx.voltage?.pid_voltage_compensation ==
+    pid_voltage_compensation_t.PID_VOLTAGE_COMPENSATION_ACTIVE;
+  const cells = ctx.voltage?.lipo_cell_count;
+  if (!compensated && cells && cells > 0) {
+    scale *= preset.cells / cells;
+  }
+
+  const limit = ctx.motor?.motor_limit;
+  if (limit && limit >= MIN_MOTOR_LIMIT && limit < 100) {
+    scale *= 100 / limit;
+  }
+
+  return Math.min(MAX_SCALE, Math.max(MIN_SCALE, scale));
+}
+
+function scaleTerm(term: number[], scale: number) {
+  return term.map((v) => Math.round(v * scale * 10) / 10);
+}
+
+export function applyPidPreset(
+  preset: PidPreset,
+  ctx: PresetContext = {}
+): pid_rate_t {
+  const scale = presetScale(preset, ctx);
+  return {
+    kp: scaleTerm(preset.rate.kp, scale),
+    ki: [...preset.rate.ki],
+    kd: scaleTerm(preset.rate.kd, scale),
+  };
+}
@@ -0,0 +1,148 @@
+import type { target_t } from "../types";
+import { cacheGet, cacheSet } from "./cache";
+import { cloneDeep, getPath, setPath } from "./diff";
+
+const PORTING_CACHE_KEY = "porting/targets";
+
+const SOFT_PORT_OFFSET = 100;
+
+// measured on the board itself, the new board keeps its own
+const BOARD_PATHS = ["voltage.vbat_scale", "voltage.ibat_scale"];
+
+// escs differ between brushed and brushless builds
+const MOTOR_PATHS = ["motor.dshot_time", "motor.digital_idle"];
+
+export interface PortingTable {
+  name: string;
+  brushless: boolean;
+  motor_pins: string[];
+  // port indices as the profile references them, soft ports offset by 100
+  serial_ports: number[];
+}
+
+export interface PortResult {
+  profile: any;
+  notes: string[];
+  // problems the port can not resolve on its own, the profile must not be
+  // applied until the user fixed them
+  conflicts: string[];
+}
+
+export function portingTable(target: target_t): PortingTable {
+  return {
+    name: target.name,
+    brushless: target.brushless,
+    motor_pins: [...(target.motor_pins || [])],
+    serial_ports: [
+      ...(target.serial_ports || []).map((p) => p.index),
+      ...(target.serial_soft_ports || []).map(
+        (p) => SOFT_PORT_OFFSET + p.index
+      ),
+    ].filter((i) => i != 0 && i != SOFT_PORT_OFFSET),
+  };
+}
+
+// every target seen is remembered, a dead board can no longer be asked
+export function knownTargets(): { [name: string]: PortingTable } {
+  return cacheGet(PORTING_CACHE_KEY) || {};
+}
+
+export function rememberTarget(target: target_t) {
+  if (!target.name) {
+    return;
+  }
+  cacheSet(PORTING_CACHE_KEY, {
+    ...knownTargets(),
+    [target.name]: portingTable(target),
+  });
+}
+
+function portName(index: number) {
+  return index >= SOFT_PORT_OFFSET
+    ? `SERIAL_SOFT_PORT${index - SOFT_PORT_OFFSET}`
+    : `SERIAL_PORT${index}`;
+}
+
+// a motor keeps its pad, boards wire pads to different gpios so matching
+// by gpio would reorder motors. pads the new board lacks are left to the
+// user instead of guessing
+function portMotorPins(
+  pins: number[],
+  from: PortingTable | undefined,
+  to: PortingTable,
+  notes: string[],
+  conflicts: string[]
+) {
+  pins.forEach((pin, motor) => {
+    if (pin >= to.motor_pins.length) {
+      conflicts.push(
+        `motor ${motor + 1} uses pad ${pin}, which ${to.name} lacks`
+      );
+      return;
+    }
+    const before = from?.motor_pins[pin];
+    const after = to.motor_pins[pin];
+    if (before && before != after) {
+      notes.push(
+        `motor ${motor + 1} pad ${pin} is ${after} instead of ${before}`
+      );
+    }
+  });
+
+  const used = new Set<number>();
+  for (const pin of pins) {
+    if (used.has(pin)) {
+      conflicts.push(`pad ${pin} is assigned to more than one motor`);
+    }
+    used.add(pin);
+  }
+  return [...pins];
+}
+
+function portSerial(serial: any, to: PortingTable, notes: string[]) {
+  for (const key of Object.keys(serial || {})) {
+    const index = serial[key];
+    if (!index || to.serial_ports.includes(index)) {
+      continue;
+    }
+    notes.push(`${key} used ${portName(index)}, which ${to.name} lacks`);
+    serial[key] = 0;
+  }
+}
+
+export function portProfile(
+  profile: any,
+  from: PortingTable | undefined,
+  to: PortingTable,
+  defaults: any
+): PortResult {
+  const p = cloneDeep(profile);
+  const notes: string[] = [];
+  const conflicts: string[] = [];
+
+  if (p.motor?.motor_pins) {
+    p.motor.motor_pins = portMotorPins(
+      p.motor.motor_pins,
+      from,
+      to,
+      notes,
+      conflicts
+    );
+  }
+  portSerial(p.serial, to, notes);
+
+  const paths = [...BOARD_PATHS];
+  if (from && from.brushless != to.brushless) {
+    notes.push("brushed and brushless differ, motor output reset");
+    paths.push(...MOTOR_PATHS);
+  }
+  for (const path of paths) {
+    const val = getPath(defaults, path);
+    if (val !== undefined && getPath(p, path) !== val) {
+      setPath(p, path, val);
+      notes.push(`${path} reset to the ${to.name} default`);
+    }
+  }
+
+  return { profile: p, notes, conflicts };
+}
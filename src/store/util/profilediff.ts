@@ -0,0 +1,126 @@
+import { cloneDeep, diffObjects, getPath, setPath } from "./diff";
+
+export interface ProfileDiffEntry {
+  path: string;
+  default: any;
+  current: any;
+}
+
+// meta changes on every save and says nothing about the tune
+const IGNORED_PATHS = [/^meta\./, /^semver$/];
+
+export function diffProfile(defaults: any, current: any): ProfileDiffEntry[] {
+  return diffObjects(defaults, current)
+    .filter((e) => !IGNORED_PATHS.some((re) => re.test(e.path)))
+    .filter((e) => e.rhs !== undefined)
+    .map((e) => ({ path: e.path, default: e.lhs, current: e.rhs }));
+}
+
+function formatValue(val: any, unit = "") {
+  if (val === undefined) {
+    return "-";
+  }
+  if (typeof val === "number" && !Number.isInteger(val)) {
+    val = parseFloat(val.toFixed(4));
+  }
+  const str = typeof val === "object" ? JSON.stringify(val) : String(val);
+  return unit.length ? `${str} ${unit}` : str;
+}
+
+export function formatProfileDiff(
+  entries: ProfileDiffEntry[],
+  unit: (path: string) => string = () => ""
+) {
+  if (!entries.length) {
+    return "# no changes from defaults\n";
+  }
+  return entries
+    .map((e) => {
+      const u = unit(e.path);
+      const from = formatValue(e.default, u);
+      return `${e.path} = ${formatValue(e.current, u)} # default ${from}`;
+    })
+    .join("\n")
+    .concat("\n");
+}
+
+export interface CliSetEntry {
+  path: string;
+  value: any;
+}
+
+// strings are quoted and numbers written in full so a pasted diff parses
+// back to exactly the same values
+function formatCliValue(val: any) {
+  if (typeof val === "string" || typeof val === "object") {
+    return JSON.stringify(val);
+  }
+  return String(val);
+}
+
+function parseCliValue(str: string) {
+  try {
+    return JSON.parse(str);
+  } catch {
+    return str;
+  }
+}
+
+export function formatCliDiff(
+  entries: ProfileDiffEntry[],
+  header: string[] = []
+) {
+  return [
+    ...header.map((line) => `# ${line}`),
+    ...entries.map((e) => `set ${e.path} = ${formatCliValue(e.current)}`),
+  ]
+    .join("\n")
+    .concat("\n");
+}
+
+export function parseCliDiff(text: string): CliSetEntry[] {
+  const entries: CliSetEntry[] = [];
+  for (const [index, raw] of text.split(/\r?\n/).entries()) {
+    const line = raw.trim();
+    if (!line.length || line.startsWith("#")) {
+      continue;
+    }
+
+    const match = line.match(/^set\s+([\w.]+)\s*=\s*(.*)$/);
+    if (!match) {
+      throw new Error(`line ${index + 1}: expected "set key = value"`);
+    }
+    entries.push({ path: match[1], value: parseCliValue(match[2]) });
+  }
+  return entries;
+}
+
+// the "# key value" comments formatCliDiff writes above the settings
+export function parseCliHeader(text: string): { [key: string]: string } {
+  const header = {};
+  for (const raw of text.split(/\r?\n/)) {
+    const match = raw.trim().match(/^#\s*(\w+)\s+(.+)$/);
+    if (match) {
+      header[match[1]] = match[2].trim();
+    }
+  }
+  return header;
+}
+
+// a diff is relative to the defaults, so it is applied on top of them
+// rather than on top of whatever the board currently holds. keys the
+// defaults lack are typos or from other firmware and are refused
+export function applyCliDiff(defaults: any, entries: CliSetEntry[]) {
+  const unknown = entries
+    .map((e) => e.path)
+    .filter((path) => getPath(defaults, path) === undefined);
+  if (unknown.length) {
+    throw new Error("unknown settings " + unknown.join(", "));
+  }
+
+  const profile = cloneDeep(defaults);
+  for (const e of entries) {
+    setPath(profile, e.path, e.value);
+  }
+  return profile;
+}
@@ -0,0 +1,102 @@
+import YAML from "yaml";
+import { CBORTag } from "../serial/cbor";
+
+export type ProfileFormat = "json" | "yaml";
+
+const BINARY_KEY = "$binary";
+const TAG_KEY = "$tag";
+const TAG_VALUE_KEY = "$value";
+
+function toBase64(data: Uint8Array) {
+  return btoa(String.fromCharCode(...data));
+}
+
+function fromBase64(str: string) {
+  return Uint8Array.from(atob(str), (c) => c.charCodeAt(0));
+}
+
+// json has no byte strings or tags, wrap them so they survive a round
+// trip. yaml keeps byte strings as !!binary on its own.
+function jsonReplacer(_key: string, val: any) {
+  if (val instanceof Uint8Array) {
+    return { [BINARY_KEY]: toBase64(val) };
+  }
+  if (val instanceof CBORTag) {
+    return { [TAG_KEY]: val.tag, [TAG_VALUE_KEY]: val.value };
+  }
+  return val;
+}
+
+function yamlReplacer(_key: any, val: any) {
+  if (val instanceof CBORTag) {
+    return { [TAG_KEY]: val.tag, [TAG_VALUE_KEY]: val.value };
+  }
+  return val;
+}
+
+function jsonReviver(_key: string, val: any) {
+  if (val === null || typeof val !== "object") {
+    return val;
+  }
+  const keys = Object.keys(val);
+  if (keys.length == 1 && typeof val[BINARY_KEY] == "string") {
+    return fromBase64(val[BINARY_KEY]);
+  }
+  if (keys.length == 2 && typeof val[TAG_KEY] == "number") {
+    return new CBORTag(val[TAG_KEY], val[TAG_VALUE_KEY]);
+  }
+  return val;
+}
+
+export function encodeJSON(val: any, space?: number) {
+  return JSON.stringify(val, jsonReplacer, space);
+}
+
+export function decodeJSON(text: string) {
+  return JSON.parse(text, jsonReviver);
+}
+
+export function profileFormat(filename: string): ProfileFormat | undefined {
+  const name = filename.toLowerCase();
+  if (name.endsWith(".json")) {
+    return "json";
+  }
+  if (name.endsWith(".yaml") || name.endsWith(".yml")) {
+    return "yaml";
+  }
+  return undefined;
+}
+
+export function profileFilename(profile: any, format: ProfileFormat) {
+  const date = new Date((profile.meta?.datetime || 0) * 1000)
+    .toISOString()
+    .substring(0, 10);
+  const name = (profile.meta?.name || "").replace(/\0/g, "");
+  return `Profile_${name}_${date}.${format}`;
+}
+
+export function exportProfile(profile: any, format: ProfileFormat): string {
+  if (format == "json") {
+    return encodeJSON(profile, 2);
+  }
+  return YAML.stringify(profile, yamlReplacer);
+}
+
+// yaml is a superset of json, so anything not explicitly json goes through
+// the yaml parser. a leading brace is enough to pick json for pasted text.
+export function parseProfileText(text: string, format?: ProfileFormat) {
+  format = format || (text.trimStart().startsWith("{") ? "json" : "yaml");
+  return format == "json" ? decodeJSON(text) : YAML.parse(text, jsonReviver);
+}
+
+export function importProfile(text: string, format?: ProfileFormat) {
+  const profile = parseProfileText(text, format);
+  if (!profile || typeof profile !== "object" || !profile.meta) {
+    throw new Error("file does not contain a profile");
+  }
+  return profile;
+}
+
+export function profileMimeType(format: ProfileFormat) {
+  return format == "json" ? "application/json" : "text/yaml";
+}
@@ -0,0 +1,407 @@
+import { rate_modes_t, type rate_t } from "../types";
+
+export interface RateLimit {
+  min: number;
+  max: number;
+  unit?: string;
+}
+
+// input bounds per mode, indexed like rate_t.rate
+export const RATE_LIMITS: RateLimit[][] = [
+  [
+    { min: 0, max: 1800, unit: "deg/s" },
+    { min: 0, max: 1 },
+    { min: 0, max: 1 },
+  ],
+  [
+    { min: 0, max: 3 },
+    { min: 0, max: 3 },
+    { min: 0, max: 1 },
+  ],
+  [
+    { min: 0, max: 500, unit: "deg/s" },
+    { min: 0, max: 1800, unit: "deg/s" },
+    { min: 0, max: 1 },
+  ],
+];
+
+export const RATE_DEFAULTS: number[][][] = [
+  [
+    [860, 860, 500],
+    [0.8, 0.8, 0.6],
+    [0.55, 0.0, 0.55],
+  ],
+  [
+    [1.3, 1.3, 1.3],
+    [0.7, 0.7, 0.7],
+    [0.4, 0.4, 0.4],
+  ],
+  [
+    [70, 70, 70],
+    [670, 670, 670],
+    [0.0, 0.0, 0.0],
+  ],
+];
+
+const SILVERWARE_MAX_RATE = 0;
+const SILVERWARE_ACRO_EXPO = 1;
+
+const BETAFLIGHT_RC_RATE = 0;
+const BETAFLIGHT_SUPER_RATE = 1;
+const BETAFLIGHT_EXPO = 2;
+
+const ACTUAL_CENTER_SENSITIVITY = 0;
+const ACTUAL_MAX_RATE = 1;
+const ACTUAL_EXPO = 2;
+
+const RC_RATE_INCREMENTAL = 14.54;
+const SETPOINT_RATE_LIMIT = 1998;
+
+const FIT_POINTS = 50;
+const FIT_STEPS = 50;
+
+function constrain(val: number, lower: number, upper: number) {
+  return Math.min(upper, Math.max(lower, val));
+}
+
+function round(val: number, digits: number) {
+  const f = Math.pow(10, digits);
+  return Math.round(val * f) / f;
+}
+
+export function calcSilverware(rate: number[][], axis: number, rc: number) {
+  const expo = rate[SILVERWARE_ACRO_EXPO][axis];
+  const maxRate = rate[SILVERWARE_MAX_RATE][axis];
+  const rate_expo = rc * rc * rc * expo + rc * (1 - expo);
+  return rate_expo * maxRate;
+}
+
+export function calcBetaflight(rate: number[][], axis: number, rc: number) {
+  const expo = rate[BETAFLIGHT_EXPO][axis];
+  const rc_abs = Math.abs(rc);
+  if (expo) {
+    rc = rc * Math.pow(rc_abs, 3) * expo + rc * (1 - expo);
+  }
+
+  let rc_rate = rate[BETAFLIGHT_RC_RATE][axis];
+  if (rc_rate > 2.0) {
+    rc_rate += RC_RATE_INCREMENTAL * (rc_rate - 2.0);
+  }
+
+  let angle_rate = 200.0 * rc_rate * rc;
+
+  const super_rate = rate[BETAFLIGHT_SUPER_RATE][axis];
+  if (super_rate) {
+    const super_factor = 1.0 / constrain(1.0 - rc_abs * super_rate, 0.01, 1.0);
+    angle_rate *= super_factor;
+  }
+
+  return angle_rate;
+}
+
+export function calcActual(rate: number[][], axis: number, rc: number) {
+  const expo = rate[ACTUAL_EXPO][axis];
+
+  const rc_abs = Math.abs(rc);
+  const rate_expo = rc_abs * (Math.pow(rc, 5) * expo + rc * (1 - expo));
+
+  const center_sensitivity = rate[ACTUAL_CENTER_SENSITIVITY][axis];
+  const max_rate = rate[ACTUAL_MAX_RATE][axis];
+  const stick_movement = Math.max(0, max_rate - center_sensitivity);
+
+  return rc * center_sensitivity + stick_movement * rate_expo;
+}
+
+// deg/s for a stick position between -1 and 1
+export function rateCurve(setting: rate_t, axis: number, rc: number) {
+  switch (setting.mode) {
+    case rate_modes_t.RATE_MODE_SILVERWARE:
+      return calcSilverware(setting.rate, axis, rc);
+    case rate_modes_t.RATE_MODE_BETAFLIGHT:
+      return calcBetaflight(setting.rate, axis, rc);
+    case rate_modes_t.RATE_MODE_ACTUAL:
+      return calcActual(setting.rate, axis, rc);
+  }
+  return 0;
+}
+
+export function maxRate(setting: rate_t, axis: number) {
+  return rateCurve(setting, axis, 1);
+}
+
+export const RATE_AXES = ["Roll", "Pitch", "Yaw"];
+
+export interface RateCurveOptions {
+  // sample count per stick direction
+  steps?: number;
+  deadband?: number;
+  // low rate switch, 1 is full rates
+  multiplier?: number;
+}
+
+export interface RateCurveSample {
+  stick: number;
+  rate: number;
+}
+
+export interface AxisRateCurve {
+  axis: string;
+  max: number;
+  points: RateCurveSample[];
+}
+
+// the firmware rescales what is left after the deadband back to -1..1
+function applyDeadband(rc: number, deadband: number) {
+  if (Math.abs(rc) <= deadband) {
+    return 0;
+  }
+  return (Math.sign(rc) * (Math.abs(rc) - deadband)) / (1 - deadband);
+}
+
+// stick position from -1 to 1 against deg/s, one curve per axis
+export function rateCurves(
+  setting: rate_t,
+  opts: RateCurveOptions = {}
+): AxisRateCurve[] {
+  const { steps = 100, deadband = 0, multiplier = 1 } = opts;
+  return RATE_AXES.map((axis, i) => {
+    const points: RateCurveSample[] = [];
+    for (let step = -steps; step <= steps; step++) {
+      const stick = step / steps;
+      const rc = applyDeadband(stick, deadband);
+      points.push({ stick, rate: rateCurve(setting, i, rc) * multiplier });
+    }
+    return { axis, max: maxRate(setting, i) * multiplier, points };
+  });
+}
+
+type Curve = (rc: number) => number;
+
+function curveError(a: Curve, b: Curve) {
+  let err = 0;
+  for (let i = 1; i <= FIT_POINTS; i++) {
+    const rc = i / FIT_POINTS;
+    err += Math.pow(a(rc) - b(rc), 2);
+  }
+  return err;
+}
+
+interface AxisFit {
+  params: number[];
+  error: number;
+}
+
+function clampParams(mode: rate_modes_t, params: number[]) {
+  return params.map((v, index) => {
+    const limit = RATE_LIMITS[mode][index];
+    const digits = limit.max > 10 ? 0 : 2;
+    return round(constrain(v, limit.min, limit.max), digits);
+  });
+}
+
+// full stick rate is kept exact, the two remaining shape parameters are
+// searched on a grid for the least squared error over the throw
+function fitAxis(mode: rate_modes_t, curve: Curve): number[] {
+  const max = curve(1);
+  const bSteps = mode == rate_modes_t.RATE_MODE_SILVERWARE ? 0 : FIT_STEPS;
+
+  let best: AxisFit | undefined;
+  for (let i = 0; i <= FIT_STEPS; i++) {
+    for (let j = 0; j <= bSteps; j++) {
+      const params = fitParams(mode, i / FIT_STEPS, j / FIT_STEPS, max);
+      if (!params) {
+        continue;
+      }
+
+      const rate = clampParams(mode, params).map((p) => [p]);
+      const error = curveError(curve, (rc) =>
+        rateCurve({ mode, rate }, 0, rc)
+      );
+      if (!best || error < best.error) {
+        best = { params: rate.map(([p]) => p), error };
+      }
+    }
+  }
+  return best?.params ?? RATE_DEFAULTS[mode].map((r) => r[0]);
+}
+
+function fitParams(
+  mode: rate_modes_t,
+  a: number,
+  b: number,
+  max: number
+): number[] | undefined {
+  switch (mode) {
+    case rate_modes_t.RATE_MODE_SILVERWARE:
+      return [max, a, RATE_DEFAULTS[mode][2][0]];
+
+    case rate_modes_t.RATE_MODE_ACTUAL:
+      return [a * max, max, b];
+
+    case rate_modes_t.RATE_MODE_BETAFLIGHT: {
+      if (b >= 1) {
+        return undefined;
+      }
+      let rc_rate = (max * (1 - b)) / 200;
+      if (rc_rate > 2.0) {
+        rc_rate =
+          (rc_rate + RC_RATE_INCREMENTAL * 2) / (1 + RC_RATE_INCREMENTAL);
+      }
+      return [rc_rate, b, a];
+    }
+  }
+  return undefined;
+}
+
+// numeric fit of the target mode onto the source curve, axis by axis
+export function convertRates(setting: rate_t, mode: rate_modes_t): rate_t {
+  if (setting.mode == mode) {
+    return { mode, rate: setting.rate.map((r) => [...r]) };
+  }
+  return convertCurves(
+    [0, 1, 2].map((axis) => (rc) => rateCurve(setting, axis, rc)),
+    mode
+  );
+}
+
+export function convertCurves(curves: Curve[], mode: rate_modes_t): rate_t {
+  const rate: number[][] = [[], [], []];
+  curves.forEach((curve, axis) => {
+    fitAxis(mode, curve).forEach((p, index) => (rate[index][axis] = p));
+  });
+  return { mode, rate };
+}
+
+export type BetaflightRatesType =
+  | "BETAFLIGHT"
+  | "RACEFLIGHT"
+  | "KISS"
+  | "ACTUAL"
+  | "QUICK";
+
+export interface BetaflightRates {
+  type: BetaflightRatesType;
+  rc_rate: number[];
+  srate: number[];
+  expo: number[];
+}
+
+const BF_AXES = ["roll", "pitch", "yaw"];
+
+// reads `set` lines from a betaflight cli diff or dump, raw cli units
+export function parseBetaflightRates(text: string): BetaflightRates {
+  const values: { [key: string]: string } = {};
+  for (const line of text.split(/\r?\n/)) {
+    const match = line.trim().match(/^set\s+(\w+)\s*=\s*(\S+)/i);
+    if (match) {
+      values[match[1].toLowerCase()] = match[2];
+    }
+  }
+  return betaflightRatesFromValues(values);
+}
+
+export function betaflightRatesFromValues(values: {
+  [key: string]: string;
+}): BetaflightRates {
+  const type = (values["rates_type"] || "BETAFLIGHT").toUpperCase();
+  // betaflight defaults, a diff leaves out what was not changed
+  const defaults = { rc_rate: 100, srate: 70, expo: 0 };
+  if (type == "ACTUAL") {
+    Object.assign(defaults, { rc_rate: 7, srate: 67, expo: 0 });
+  }
+
+  const read = (key: string, fallback: number) =>
+    BF_AXES.map((axis) => {
+      const val = values[`${axis}_${key}`];
+      return val === undefined ? fallback : parseFloat(val);
+    });
+
+  return {
+    type: type as BetaflightRatesType,
+    rc_rate: read("rc_rate", defaults.rc_rate),
+    srate: read("srate", defaults.srate),
+    expo: read("expo", defaults.expo),
+  };
+}
+
+function quickCurve(bf: BetaflightRates, axis: number): Curve {
+  const rcRate = bf.rc_rate[axis] * 2;
+  const maxDPS = Math.max(bf.srate[axis] * 10, rcRate);
+  const expo = bf.expo[axis] / 100;
+  const superFactorConfig = (maxDPS / rcRate - 1) / (maxDPS / rcRate);
+  return (rc) => {
+    const abs = Math.abs(rc);
+    const curve = Math.pow(abs, 3) * expo + abs * (1 - expo);
+    const superFactor = 1 / constrain(1 - curve * superFactorConfig, 0.01, 1);
+    const rate = rc * rcRate * superFactor;
+    return constrain(rate, -SETPOINT_RATE_LIMIT, SETPOINT_RATE_LIMIT);
+  };
+}
+
+function kissCurve(bf: BetaflightRates, axis: number): Curve {
+  const curve = bf.expo[axis] / 100;
+  return (rc) => {
+    const abs = Math.abs(rc);
+    const useRates = 1 / constrain(1 - abs * (bf.srate[axis] / 100), 0.01, 1);
+    const command =
+      (Math.pow(rc, 3) * curve + rc * (1 - curve)) * (bf.rc_rate[axis] / 1000);
+    const rate = 2000 * useRates * command;
+    return constrain(rate, -SETPOINT_RATE_LIMIT, SETPOINT_RATE_LIMIT);
+  };
+}
+
+// betaflight and actual rates exist natively and map one to one, the
+// other types are fitted onto the requested mode
+export function importBetaflightRates(
+  bf: BetaflightRates,
+  mode = rate_modes_t.RATE_MODE_ACTUAL
+): rate_t {
+  if (bf.type == "BETAFLIGHT") {
+    return {
+      mode: rate_modes_t.RATE_MODE_BETAFLIGHT,
+      rate: [
+        bf.rc_rate.map((v) => v / 100),
+        bf.srate.map((v) => v / 100),
+        bf.expo.map((v) => v / 100),
+      ],
+    };
+  }
+  if (bf.type == "ACTUAL") {
+    return {
+      mode: rate_modes_t.RATE_MODE_ACTUAL,
+      rate: [
+        bf.rc_rate.map((v) => v * 10),
+        bf.srate.map((v) => v * 10),
+        bf.expo.map((v) => v / 100),
+      ],
+    };
+  }
+  if (bf.type == "QUICK") {
+    return convertCurves([0, 1, 2].map((a) => quickCurve(bf, a)), mode);
+  }
+  if (bf.type == "KISS") {
+    return convertCurves([0, 1, 2].map((a) => kissCurve(bf, a)), mode);
+  }
+  throw new Error("unsupported betaflight rates type " + bf.type);
+}
+
+// the reverse of importBetaflightRates in raw cli units, silverware has no
+// betaflight counterpart and is fitted onto actual rates
+export function exportBetaflightRates(setting: rate_t): BetaflightRates {
+  if (setting.mode == rate_modes_t.RATE_MODE_BETAFLIGHT) {
+    return {
+      type: "BETAFLIGHT",
+      rc_rate: setting.rate[0].map((v) => Math.round(v * 100)),
+      srate: setting.rate[1].map((v) => Math.round(v * 100)),
+      expo: setting.rate[2].map((v) => Math.round(v * 100)),
+    };
+  }
+
+  const actual = convertRates(setting, rate_modes_t.RATE_MODE_ACTUAL);
+  return {
+    type: "ACTUAL",
+    rc_rate: actual.rate[0].map((v) => Math.round(v / 10)),
+    srate: actual.rate[1].map((v) => Math.round(v / 10)),
+    expo: actual.rate[2].map((v) => Math.round(v * 100)),
+  };
+}
@@ -0,0 +1,292 @@
+import { Log } from "@/log";
+import {
+  blackboxFieldDefs,
+  blackboxSampleRate,
+  type BlackboxFieldDef,
+  type BlackboxFrame,
+} from "../blackbox";
+
+export const RECORDING_FORMAT = "quic-blackbox-stream";
+export const RECORDING_VERSION = 1;
+export const RECORDING_EXTENSION = ".qbb";
+
+// frames are buffered and written in batches, the writable stream is slow
+// to take a line at a time
+const FLUSH_FRAMES = 256;
+
+export interface RecordingFirmware {
+  target_name: string;
+  git_version: string;
+  quic_protocol_semver: string;
+}
+
+// the first line of every file, a part can be read without the others
+export interface RecordingHeader {
+  format: string;
+  version: number;
+  part: number;
+  // ms since epoch, of the recording and of this part
+  start: number;
+  part_start: number;
+  firmware: RecordingFirmware;
+  field_flags: number;
+  sample_rate_hz: number;
+  // us, 0 if the board had not measured it yet
+  looptime?: number;
+  fields: BlackboxFieldDef[];
+  profile: any;
+}
+
+export interface Recording {
+  header: RecordingHeader;
+  // values in the order of header.fields
+  frames: any[][];
+}
+
+export interface RecordingSource {
+  firmware: RecordingFirmware;
+  field_flags: number;
+  sample_rate_hz: number;
+  looptime?: number;
+  profile: any;
+}
+
+export interface RecordSink {
+  write(text: string): Promise<void>;
+  close(): Promise<void>;
+}
+
+export type RecordSinkFactory = (name: string) => Promise<RecordSink>;
+
+// turns the header and frames into the lines of a file, without newlines
+export interface RecordingEncoder {
+  extension: string;
+  header(header: RecordingHeader): string;
+  frame(header: RecordingHeader, frame: BlackboxFrame): string;
+}
+
+export interface RecorderOptions {
+  name: string;
+  encoder?: RecordingEncoder;
+  // a new part is started once either limit is hit, 0 for no limit
+  max_bytes?: number;
+  max_duration?: number;
+}
+
+export interface RecordedPart {
+  name: string;
+  frames: number;
+  bytes: number;
+}
+
+// one file per part in a directory picked through the file system access api
+export function directorySink(dir: any): RecordSinkFactory {
+  return async (name) => {
+    const handle = await dir.getFileHandle(name, { create: true });
+    const writable = await handle.createWritable();
+    return {
+      write: (text) => writable.write(text),
+      close: () => writable.close(),
+    };
+  };
+}
+
+export function encodeFrame(fields: BlackboxFieldDef[], frame: BlackboxFrame) {
+  return fields.map((f) => frame[f.name]);
+}
+
+export function decodeFrame(fields: BlackboxFieldDef[], values: any[]) {
+  const frame: any = {};
+  fields.forEach((f, i) => (frame[f.name] = values[i]));
+  return frame as BlackboxFrame;
+}
+
+export const recordingEncoder: RecordingEncoder = {
+  extension: RECORDING_EXTENSION,
+  header: (header) => JSON.stringify(header),
+  frame: (header, frame) => JSON.stringify(encodeFrame(header.fields, frame)),
+};
+
+export function recordingHeader(
+  src: RecordingSource,
+  part: number,
+  start: number
+): RecordingHeader {
+  return {
+    format: RECORDING_FORMAT,
+    version: RECORDING_VERSION,
+    part,
+    start,
+    part_start: Date.now(),
+    firmware: src.firmware,
+    field_flags: src.field_flags,
+    sample_rate_hz: src.sample_rate_hz,
+    looptime: src.looptime,
+    fields: blackboxFieldDefs(src.field_flags),
+    profile: src.profile,
+  };
+}
+
+// a whole file at once, for frames that were kept in memory
+export function encodeRecording(
+  header: RecordingHeader,
+  frames: BlackboxFrame[],
+  encoder = recordingEncoder
+) {
+  const lines = [encoder.header(header)];
+  for (const frame of frames) {
+    lines.push(encoder.frame(header, frame));
+  }
+  return lines.join("\n") + "\n";
+}
+
+export function parseRecording(text: string): Recording {
+  const lines = text.split("\n").filter((l) => l.trim().length);
+  const header = JSON.parse(lines[0] || "{}");
+  if (header.format != RECORDING_FORMAT) {
+    throw new Error("not a blackbox recording");
+  }
+  if (header.version > RECORDING_VERSION) {
+    throw new Error("recording version " + header.version + " not supported");
+  }
+  return { header, frames: lines.slice(1).map((l) => JSON.parse(l)) };
+}
+
+// files downloaded from the flash carry their fields next to the entries
+function parseFlashDownload(text: string): Recording | undefined {
+  let file: any;
+  try {
+    file = JSON.parse(text);
+  } catch {
+    return undefined;
+  }
+  if (!file || !Array.isArray(file.fields) || !Array.isArray(file.entries)) {
+    return undefined;
+  }
+  const header = {
+    part: 0,
+    start: 0,
+    part_start: 0,
+    field_flags: file.field_flags,
+    sample_rate_hz: blackboxSampleRate(file.looptime, file.blackbox_rate),
+    looptime: file.looptime,
+    fields: file.fields,
+  };
+  return { header: header as RecordingHeader, frames: file.entries };
+}
+
+export function parseBlackboxFile(text: string): Recording {
+  return parseFlashDownload(text) || parseRecording(text);
+}
+
+// the source is asked on every frame and should hand out references, the
+// header serializes them at the start of every part. a change of field
+// flags mid recording starts a new part with the new fields
+export class BlackboxRecorder {
+  readonly parts: RecordedPart[] = [];
+  error?: any;
+
+  private start = 0;
+  private sink?: RecordSink;
+  private header?: RecordingHeader;
+  private pending: string[] = [];
+  private queue: Promise<void> = Promise.resolve();
+  private stopped = false;
+
+  private encoder: RecordingEncoder;
+
+  constructor(
+    private open: RecordSinkFactory,
+    private source: () => RecordingSource,
+    private opts: RecorderOptions
+  ) {
+    this.encoder = opts.encoder || recordingEncoder;
+  }
+
+  get frames() {
+    return this.parts.reduce((sum, p) => sum + p.frames, 0);
+  }
+
+  get bytes() {
+    return this.parts.reduce((sum, p) => sum + p.bytes, 0);
+  }
+
+  write(frame: BlackboxFrame) {
+    if (this.stopped) {
+      return;
+    }
+    if (!this.start) {
+      this.start = Date.now();
+    }
+
+    const src = this.source();
+    if (!this.header || this.needsRotation(src)) {
+      this.rotate(src);
+    }
+
+    const line = this.encoder.frame(this.header!, frame);
+    const part = this.parts[this.parts.length - 1];
+    part.frames++;
+    part.bytes += line.length + 1;
+    this.pending.push(line);
+    if (this.pending.length >= FLUSH_FRAMES) {
+      this.flush();
+    }
+  }
+
+  async stop() {
+    if (this.stopped) {
+      return;
+    }
+    this.stopped = true;
+    this.flush();
+    this.enqueue(async () => {
+      await this.sink?.close();
+      this.sink = undefined;
+    });
+    await this.queue;
+  }
+
+  private needsRotation(src: RecordingSource) {
+    const part = this.parts[this.parts.length - 1];
+    const { max_bytes, max_duration } = this.opts;
+    return (
+      src.field_flags != this.header!.field_flags ||
+      (!!max_bytes && part.bytes >= max_bytes) ||
+      (!!max_duration && Date.now() - this.header!.part_start >= max_duration)
+    );
+  }
+
+  private rotate(src: RecordingSource) {
+    this.flush();
+
+    const part = this.parts.length;
+    const name = `${this.opts.name}_${part}${this.encoder.extension}`;
+    this.header = recordingHeader(src, part, this.start);
+
+    const line = this.encoder.header(this.header);
+    this.parts.push({ name, frames: 0, bytes: line.length + 1 });
+    this.enqueue(async () => {
+      await this.sink?.close();
+      this.sink = await this.open(name);
+      await this.sink.write(line + "\n");
+    });
+  }
+
+  private flush() {
+    if (!this.pending.length) {
+      return;
+    }
+    const text = this.pending.join("\n") + "\n";
+    this.pending = [];
+    this.enqueue(() => this.sink!.write(text));
+  }
+
+  // writes have to land in order, a failed one is logged and the rest go on
+  private enqueue(fn: () => Promise<void>) {
+    this.queue = this.queue.then(fn).catch((err) => {
+      this.error = err;
+      Log.error("recorder", "write failed", err);
+    });
+  }
+}
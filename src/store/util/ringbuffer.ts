@@ -0,0 +1,53 @@
+// fixed capacity, the oldest entry is overwritten once full
+export class RingBuffer<T> {
+  private items: (T | undefined)[];
+  private head = 0;
+  private count = 0;
+
+  constructor(readonly capacity: number) {
+    this.items = new Array(capacity);
+  }
+
+  get length() {
+    return this.count;
+  }
+
+  push(item: T) {
+    this.items[(this.head + this.count) % this.capacity] = item;
+    if (this.count < this.capacity) {
+      this.count++;
+    } else {
+      this.head = (this.head + 1) % this.capacity;
+    }
+  }
+
+  // the oldest entry
+  peek(): T | undefined {
+    return this.count ? this.items[this.head] : undefined;
+  }
+
+  shift(): T | undefined {
+    if (!this.count) {
+      return undefined;
+    }
+    const item = this.items[this.head];
+    this.items[this.head] = undefined;
+    this.head = (this.head + 1) % this.capacity;
+    this.count--;
+    return item;
+  }
+
+  clear() {
+    this.items = new Array(this.capacity);
+    this.head = 0;
+    this.count = 0;
+  }
+
+  // oldest first
+  toArray(): T[] {
+    return Array.from(
+      { length: this.count },
+      (_, i) => this.items[(this.head + i) % this.capacity] as T
+    );
+  }
+}
@@ -0,0 +1,122 @@
+import semver from "semver";
+import { compileFields, type FieldEntry, type FieldMeta } from "./fields";
+import { getPath, setPath } from "./diff";
+
+export type SchemaFeature =
+  | "legacy_stickrates"
+  | "legacy_osd"
+  | "throttle_settings"
+  | "motor_limit"
+  | "gyro_dynamic_notch"
+  | "osd_crosshair";
+
+// an entry applies from its version until the next one, later entries
+// build on the earlier ones
+export interface SchemaEntry {
+  version: string;
+  description: string;
+  features?: SchemaFeature[];
+  removed_features?: SchemaFeature[];
+  // constraints that differ from the field registry from here on
+  fields?: FieldEntry[];
+  // filled into profiles from older firmware that lack them
+  defaults?: { [path: string]: any };
+}
+
+export interface ProfileSchema {
+  version: string;
+  // first version the next schema takes over, open ended if undefined
+  until?: string;
+  features: SchemaFeature[];
+  defaults: { [path: string]: any };
+  fieldMeta: (path: string) => FieldMeta | undefined;
+}
+
+const entries: SchemaEntry[] = [];
+const resolved = new Map<string, ProfileSchema>();
+
+export function registerSchema(entry: SchemaEntry) {
+  if (!semver.valid(entry.version)) {
+    throw new Error("invalid schema version " + entry.version);
+  }
+  entries.push(entry);
+  entries.sort((a, b) => semver.compare(a.version, b.version));
+  resolved.clear();
+}
+
+export function resolveSchema(version: string): ProfileSchema {
+  const v = semver.valid(version) ? version : "v0.0.0";
+  const cached = resolved.get(v);
+  if (cached) {
+    return cached;
+  }
+
+  const applied = entries.filter((e) => semver.lte(e.version, v));
+  const next = entries.find((e) => semver.gt(e.version, v));
+
+  let features: SchemaFeature[] = [];
+  const defaults = {};
+  const fields: FieldEntry[] = [];
+  for (const e of applied) {
+    features = features
+      .filter((f) => !e.removed_features?.includes(f))
+      .concat(e.features || []);
+    Object.assign(defaults, e.defaults);
+    // later entries win, so they go first
+    fields.unshift(...(e.fields || []));
+  }
+
+  const match = compileFields(fields);
+  const schema: ProfileSchema = {
+    version: applied.length ? applied[applied.length - 1].version : v,
+    until: next?.version,
+    features,
+    defaults,
+    fieldMeta: (path) => match(path),
+  };
+  resolved.set(v, schema);
+  return schema;
+}
+
+export function hasFeature(schema: ProfileSchema, feature: SchemaFeature) {
+  return schema.features.includes(feature);
+}
+
+// only fields the profile lacks, values it carries are kept
+export function applySchemaDefaults(profile: any, schema: ProfileSchema) {
+  for (const [path, val] of Object.entries(schema.defaults)) {
+    if (getPath(profile, path) === undefined) {
+      setPath(profile, path, val);
+    }
+  }
+  return profile;
+}
+
+registerSchema({
+  version: "v0.0.0",
+  description: "silverware and betaflight rates as separate sections",
+  features: ["legacy_stickrates", "legacy_osd"],
+});
+
+registerSchema({
+  version: "v0.1.1",
+  description: "rate profiles and packed osd elements",
+  removed_features: ["legacy_stickrates", "legacy_osd"],
+});
+
+registerSchema({
+  version: "v0.2.1",
+  description: "throttle curve and motor limit",
+  features: ["throttle_settings", "motor_limit"],
+  defaults: {
+    "rate.throttle_mid": 0.5,
+    "rate.throttle_expo": 0,
+    "motor.motor_limit": 100,
+  },
+});
+
+registerSchema({
+  version: "v0.2.3",
+  description: "gyro dynamic notch and osd crosshair",
+  features: ["gyro_dynamic_notch", "osd_crosshair"],
+});
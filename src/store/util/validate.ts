@@ -0,0 +1,170 @@
+import { fieldMeta } from "./fields";
+import { RATE_LIMITS, type RateLimit } from "./rates";
+import type { ProfileSchema } from "./schema";
+
+export interface ProfileViolation {
+  path: string;
+  value: any;
+  message: string;
+  // outside a range the configurator assumes but the firmware does not
+  // publish, the write goes ahead
+  warning?: boolean;
+}
+
+export class ProfileValidationError extends Error {
+  constructor(public violations: ProfileViolation[]) {
+    super(violations.map((v) => `${v.path}: ${v.message}`).join(", "));
+  }
+}
+
+export interface ValidationContext {
+  motorPinCount?: number;
+  schema?: ProfileSchema;
+}
+
+const AXES = ["roll", "pitch", "yaw"];
+const PID_TERMS = ["kp", "ki", "kd"];
+
+const RATE_NAMES = [
+  ["max rate", "acro expo", "angle expo"],
+  ["rc rate", "super rate", "expo"],
+  ["center sensitivity", "max rate", "expo"],
+];
+
+class Validator {
+  public violations: ProfileViolation[] = [];
+
+  constructor(private schema?: ProfileSchema) {}
+
+  fail(path: string, value: any, message: string, warning = false) {
+    this.violations.push({ path, value, message, warning });
+  }
+
+  // bounds come from the field registry, fields without any are skipped
+  field(path: string, value: any, name = path) {
+    const meta = fieldMeta(path, this.schema);
+    if (meta?.min === undefined || meta?.max === undefined) {
+      return;
+    }
+    const range = { min: meta.min, max: meta.max, unit: meta.unit };
+    this.range(path, value, range, name);
+  }
+
+  range(path: string, value: any, range: RateLimit, name = path) {
+    if (value === undefined) {
+      return;
+    }
+    if (typeof value !== "number" || !isFinite(value)) {
+      this.fail(path, value, `${name} must be a number`);
+      return;
+    }
+    if (value < range.min || value > range.max) {
+      const unit = range.unit ? " " + range.unit : "";
+      this.fail(
+        path,
+        value,
+        `${name} is usually between ${range.min} and ${range.max}${unit}`,
+        true
+      );
+    }
+  }
+}
+
+function validatePids(v: Validator, pid: any) {
+  (pid?.pid_rates || []).forEach((rates, i) => {
+    for (const term of PID_TERMS) {
+      (rates?.[term] || []).forEach((val, axis) => {
+        const path = `pid.pid_rates.${i}.${term}.${axis}`;
+        const name = `${AXES[axis]} ${term.substring(1).toUpperCase()}`;
+        v.field(path, val, name);
+      });
+    }
+  });
+}
+
+function validateRates(v: Validator, rate: any) {
+  (rate?.rates || []).forEach((r, i) => {
+    const ranges = RATE_LIMITS[r?.mode];
+    if (!ranges) {
+      v.fail(`rate.rates.${i}.mode`, r?.mode, "unknown rate mode");
+      return;
+    }
+    (r.rate || []).forEach((axes, index) => {
+      (axes || []).forEach((val, axis) => {
+        const path = `rate.rates.${i}.rate.${index}.${axis}`;
+        const name = `${AXES[axis]} ${RATE_NAMES[r.mode][index]}`;
+        v.range(path, val, ranges[index], name);
+      });
+    });
+  });
+
+  v.field("rate.level_max_angle", rate?.level_max_angle, "level max angle");
+  v.field("rate.sticks_deadband", rate?.sticks_deadband, "stick deadband");
+}
+
+function validateFilters(v: Validator, filter: any) {
+  for (const kind of ["gyro", "dterm"]) {
+    (filter?.[kind] || []).forEach((f, i) => {
+      if (!f?.type) {
+        return;
+      }
+      const path = `filter.${kind}.${i}.cutoff_freq`;
+      const name = `${kind} filter ${i + 1} cutoff`;
+      v.field(path, f.cutoff_freq, name);
+    });
+  }
+
+  if (filter?.dterm_dynamic_enable) {
+    const min = filter.dterm_dynamic_min;
+    const max = filter.dterm_dynamic_max;
+    v.field("filter.dterm_dynamic_min", min, "dterm min");
+    v.field("filter.dterm_dynamic_max", max, "dterm max");
+    if (min > max) {
+      v.fail(
+        "filter.dterm_dynamic_min",
+        min,
+        "dynamic dterm min must not exceed max"
+      );
+    }
+  }
+}
+
+function validateMotors(v: Validator, motor: any, ctx: ValidationContext) {
+  const pins: any[] = motor?.motor_pins || [];
+  const seen = new Set<number>();
+  pins.forEach((pin, i) => {
+    const path = `motor.motor_pins.${i}`;
+    if (!Number.isInteger(pin) || pin < 0) {
+      v.fail(path, pin, `motor ${i} has no valid pin`);
+      return;
+    }
+    if (ctx.motorPinCount !== undefined && pin >= ctx.motorPinCount) {
+      v.fail(path, pin, `motor ${i} uses pin ${pin} the target lacks`);
+    }
+    if (seen.has(pin)) {
+      v.fail(path, pin, `motor ${i} shares pin ${pin} with another motor`);
+    }
+    seen.add(pin);
+  });
+
+  v.field("motor.digital_idle", motor?.digital_idle, "digital idle");
+  v.field("motor.motor_limit", motor?.motor_limit, "motor limit");
+}
+
+export function blockingViolations(violations: ProfileViolation[]) {
+  return violations.filter((v) => !v.warning);
+}
+
+// collects every violation instead of stopping at the first, so the user
+// can fix them all in one go
+export function validateProfile(
+  profile: any,
+  ctx: ValidationContext = {}
+): ProfileViolation[] {
+  const v = new Validator(ctx.schema);
+  validatePids(v, profile?.pid);
+  validateRates(v, profile?.rate);
+  validateFilters(v, profile?.filter);
+  validateMotors(v, profile?.motor, ctx);
+  return v.violations;
+}
@@ -2,6 +2,9 @@ import { QuicVal } from "./serial/quic";
 import { serial } from "./serial/serial";
 import { defineStore } from "pinia";
 import { useRootStore } from "./root";
+import { padPowerTable, VtxControl } from "./serial/vtx";
+
+export const vtx = new VtxControl(serial);
 
 export const useVTXStore = defineStore("vtx", {
   state: () => ({
@@ -22,11 +25,7 @@ export const useVTXStore = defineStore("vtx", {
       const root = useRootStore();
 
       if (vtx_settings.power_table) {
-        for (let i = 0; i < vtx_settings.power_table.labels.length; i++) {
-          while (vtx_settings.power_table.labels[i].length < 3) {
-            vtx_settings.power_table.labels[i] += " ";
-          }
-        }
+        vtx_settings.power_table = padPowerTable(vtx_settings.power_table);
       }
 
       return serial
@@ -39,6 +38,16 @@ export const useVTXStore = defineStore("vtx", {
           root.append_alert({ type: "danger", msg: "Apply failed" });
         });
     },
+    set_vtx_frequency(freq: number) {
+      const root = useRootStore();
+
+      return vtx
+        .setFrequency(freq)
+        .then((v) => (this.settings = v))
+        .catch((err) => {
+          root.append_alert({ type: "danger", msg: err.message });
+        });
+    },
     update_vtx_settings(force = false) {
       if (this.settings.detected == 0 || force) {
         return serial.get(QuicVal.VtxSettings).then((settings) => {